@@ -0,0 +1,22 @@
+package filedownloader
+
+import "net/http"
+
+// request a representation of content-negotiating endpoints by Download.Accept and Config.Accept.
+
+// headers of the download with Accept, Accept in Download.Header takes precedence.
+func (m *FileDownloader) requestHeader(d *Download) http.Header {
+	accept := d.Accept
+	if accept == `` {
+		accept = m.conf.Accept
+	}
+	if accept == `` || d.Header.Get(`Accept`) != `` {
+		return d.Header
+	}
+	header := d.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set(`Accept`, accept)
+	return header
+}
@@ -0,0 +1,119 @@
+package filedownloader
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// errors of the files are aggregated to the error of the download by Config.ErrorAggregator.
+
+func (m *FileDownloader) aggregateErrors(perFile map[*Download]error) error {
+	if len(perFile) == 0 {
+		return nil
+	}
+	if m.conf.ErrorAggregator != nil {
+		return m.conf.ErrorAggregator(perFile)
+	}
+	return JoinedErrors(perFile)
+}
+
+// errors of failed files ordered by URL and local path, so that aggregated error does not change by finished order.
+func sortedErrors(perFile map[*Download]error) []error {
+	var failed []*Download
+	for d, err := range perFile {
+		if err != nil {
+			failed = append(failed, d)
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		if failed[i].URL != failed[j].URL {
+			return failed[i].URL < failed[j].URL
+		}
+		return failed[i].LocalFilePath < failed[j].LocalFilePath
+	})
+	errs := make([]error, len(failed))
+	for i, d := range failed {
+		errs[i] = perFile[d]
+	}
+	return errs
+}
+
+// FirstError returns the error of the failed file whose URL is the first in order. nil if no file failed.
+func FirstError(perFile map[*Download]error) error {
+	if errs := sortedErrors(perFile); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// JoinedErrors returns all errors of failed files ordered by URL, errors.Is and errors.As find any of them.
+// The error itself is returned if only one file failed. nil if no file failed.
+func JoinedErrors(perFile map[*Download]error) error {
+	return joinErrors(sortedErrors(perFile)...)
+}
+
+// nil errors are dropped, the error itself is returned if only one.
+func joinErrors(errs ...error) error {
+	var joined []error
+	for _, err := range errs {
+		if err != nil {
+			joined = append(joined, err)
+		}
+	}
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return &joinedError{errs: joined}
+}
+
+// CountError returns ErrDownload with the number of failed files, without the errors of the files. nil if no file failed.
+func CountError(perFile map[*Download]error) error {
+	failed := len(sortedErrors(perFile))
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf(`%w: %d of %d files failed`, ErrDownload, failed, len(perFile))
+}
+
+// error of multiple errors, same as errors.Join of Go 1.20
+type joinedError struct {
+	errs []error
+}
+
+func (e *joinedError) Error() string {
+	messages := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Unwrap returns the joined errors
+func (e *joinedError) Unwrap() []error {
+	return e.errs
+}
+
+// Is finds target in any of the joined errors, errors.Is before Go 1.20 does not unwrap []error.
+func (e *joinedError) Is(target error) bool {
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first joined error matching target, as Is.
+func (e *joinedError) As(target interface{}) bool {
+	for _, err := range e.errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
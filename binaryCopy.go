@@ -49,3 +49,21 @@ loop:
 	}
 	return written, err
 }
+
+// copy buffers are shared by download goroutines, so that a batch of many files does not allocate a buffer for each.
+// buffers are not cleared, since only the bytes read into them are written.
+func (m *FileDownloader) getBuffer() *[]byte {
+	return m.buffers.Get().(*[]byte)
+}
+
+func (m *FileDownloader) putBuffer(buf *[]byte) {
+	m.buffers.Put(buf)
+}
+
+// Config.BufferSize or copyBufferSize
+func (m *FileDownloader) bufferSize() int {
+	if m.conf.BufferSize <= 0 {
+		return copyBufferSize
+	}
+	return m.conf.BufferSize
+}
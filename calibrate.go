@@ -0,0 +1,95 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// recommend MaxDownloadThreads by downloading a probe from the host at some concurrency levels.
+
+// concurrency levels tried by RecommendThreads
+var calibrationLevels = []int{1, 2, 4, 8, 16}
+
+// bytes downloaded by each probe request, replaced in tests
+var calibrationProbeBytes int64 = 256 * 1024
+
+// more threads are recommended only if throughput improves by this ratio
+const calibrationGain = 1.1
+
+// RecommendThreads downloads the head of sampleURL concurrently at some concurrency levels, and returns the level
+// from which more threads do not improve throughput by 10%. The server has to accept range requests or serve a small file.
+// Each probe reads at most 256KB, it takes a few seconds on slow networks.
+func (m *FileDownloader) RecommendThreads(ctx context.Context, sampleURL string) (int, error) {
+	best, bestRate := 0, 0.0
+	for _, level := range calibrationLevels {
+		rate, err := m.probeThroughput(ctx, sampleURL, level)
+		if err != nil {
+			return 0, err
+		}
+		m.logfunc(fmt.Sprintf(`Calibration %d threads: %.0f bytes per second`, level, rate))
+		if best > 0 && rate < bestRate*calibrationGain {
+			break
+		}
+		best, bestRate = level, rate
+	}
+	return best, nil
+}
+
+// bytes per second of downloading the probe by concurrent requests
+func (m *FileDownloader) probeThroughput(ctx context.Context, url string, concurrency int) (float64, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var total int64
+	var firstErr error
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := m.probe(ctx, url)
+			mu.Lock()
+			defer mu.Unlock()
+			total += n
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		elapsed = time.Millisecond.Seconds()
+	}
+	return float64(total) / elapsed, nil
+}
+
+func (m *FileDownloader) probe(ctx context.Context, url string) (int64, error) {
+	r, err := m.newRequest(ctx, `GET`, url, nil)
+	if err != nil {
+		return 0, &DownloadError{URL: url, Err: err}
+	}
+	r.Header.Set(`Range`, fmt.Sprintf(`bytes=0-%d`, calibrationProbeBytes-1))
+	resp, err := m.client.Do(r)
+	if err != nil {
+		return 0, &DownloadError{URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: errors.New(`unexpected status ` + resp.Status)}
+	}
+	// server ignoring Range may send a large file
+	n, err := io.CopyN(ioutil.Discard, resp.Body, calibrationProbeBytes)
+	if err != nil && err != io.EOF {
+		return n, &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
+	}
+	return n, nil
+}
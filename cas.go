@@ -0,0 +1,67 @@
+package filedownloader
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+)
+
+// content-addressed storage of Config.CASRoot, files are stored at the path of their SHA-256. ex. ab/cd/abcdef...
+// LocalFilePath of the download gets a link or copy of the stored file.
+
+// stored path of the file of the hex checksum
+func (m *FileDownloader) casPath(sum string) string {
+	return filepath.Join(m.conf.CASRoot, sum[:2], sum[2:4], sum)
+}
+
+// temp files are created in CASRoot, so it must exist before downloads.
+func (m *FileDownloader) prepareCASRoot() {
+	if m.conf.CASRoot == `` {
+		return
+	}
+	if _, ok := m.fileSystem().(osFileSystem); !ok {
+		return
+	}
+	if err := os.MkdirAll(m.conf.CASRoot, 0755); err != nil {
+		m.logfunc(`Could not create CASRoot`, err)
+	}
+}
+
+// temp file path of the download, in CASRoot so that it is renamed to the stored path.
+func (m *FileDownloader) downloadPartPath(url, localPath string) string {
+	if m.conf.CASRoot == `` {
+		return m.partFilePath(m.outputFilePath(localPath))
+	}
+	// checksum is not known until download completes, name by the hash of the download.
+	h := fnv.New32a()
+	h.Write([]byte(url + "\n" + localPath))
+	return filepath.Join(m.conf.CASRoot, fmt.Sprintf(`%08x%s`, h.Sum32(), m.partSuffix()))
+}
+
+// move the downloaded temp file to the stored path, and link it to localPath if not empty.
+// temp file is removed if the same file is already stored. returns path of the saved file.
+func (m *FileDownloader) storeCAS(partPath, sum, localPath string) (string, error) {
+	fs := m.fileSystem()
+	stored := m.casPath(sum)
+	if _, err := fs.Stat(stored); err == nil {
+		m.logfunc(`Same file is already stored ` + stored)
+		fs.Remove(partPath)
+	} else {
+		if _, ok := fs.(osFileSystem); ok {
+			if err := os.MkdirAll(filepath.Dir(stored), 0755); err != nil {
+				return ``, err
+			}
+		}
+		if err := m.finalizeDownloadFile(partPath, stored); err != nil {
+			return ``, err
+		}
+	}
+	if localPath == `` {
+		return stored, nil
+	}
+	if err := m.linkFile(stored, localPath); err != nil {
+		return ``, err
+	}
+	return localPath, nil
+}
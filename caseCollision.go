@@ -0,0 +1,85 @@
+package filedownloader
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// local paths differing only in case are the same file on case-insensitive file systems, ex. macOS and Windows.
+
+// ErrPathCollision local file path is the same file as the path of another download on a case-insensitive file system
+var ErrPathCollision = errors.New(`Local file path collides with another download ignoring case`)
+
+// replaced in tests
+var isCaseInsensitiveDir = caseInsensitiveDir
+
+// find downloads whose paths collide with earlier downloads of the batch ignoring case, only on the OS file system.
+// colliding paths are renamed by RenameCaseCollisions, otherwise the downloads fail with ErrPathCollision.
+func (m *FileDownloader) caseCollisions(downloads []*Download) map[*Download]error {
+	if _, ok := m.fileSystem().(osFileSystem); !ok {
+		return nil
+	}
+	// first path of each lower cased path
+	first := make(map[string]string)
+	var collided []*Download
+	for _, d := range downloads {
+		if d.LocalFilePath == `` || isStdout(d.LocalFilePath) {
+			continue
+		}
+		path := filepath.Clean(m.outputFilePath(d.LocalFilePath))
+		lower := strings.ToLower(path)
+		if p, ok := first[lower]; !ok {
+			first[lower] = path
+		} else if p != path && isCaseInsensitiveDir(filepath.Dir(path)) {
+			collided = append(collided, d)
+		}
+	}
+	errs := make(map[*Download]error)
+	for _, d := range collided {
+		path := filepath.Clean(m.outputFilePath(d.LocalFilePath))
+		if !m.conf.RenameCaseCollisions {
+			m.logfunc(`Local file path collides ignoring case with ` + first[strings.ToLower(path)] + `[` + d.URL + `]`)
+			errs[d] = &DownloadError{URL: d.URL, Err: fmt.Errorf(`%w: %s and %s`, ErrPathCollision, first[strings.ToLower(path)], path)}
+			continue
+		}
+		ext := filepath.Ext(d.LocalFilePath)
+		base := strings.TrimSuffix(d.LocalFilePath, ext)
+		for i := 1; ; i++ {
+			renamed := fmt.Sprintf(`%s-%d%s`, base, i, ext)
+			lower := strings.ToLower(filepath.Clean(m.outputFilePath(renamed)))
+			if _, ok := first[lower]; !ok {
+				m.logfunc(`Local file path collides ignoring case, renamed to ` + renamed + `[` + d.URL + `]`)
+				first[lower] = renamed
+				d.LocalFilePath = renamed
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// dir ignores case if a temp file in it is found by the upper cased name. dir not created yet is checked by its parent.
+func caseInsensitiveDir(dir string) bool {
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	f, err := ioutil.TempFile(dir, `.filedownloader-case-`)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		return false
+	}
+	upper, err := os.Stat(filepath.Join(dir, strings.ToUpper(filepath.Base(f.Name()))))
+	return err == nil && os.SameFile(info, upper)
+}
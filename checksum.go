@@ -0,0 +1,72 @@
+package filedownloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// verify checksum of downloaded files.
+
+// ErrChecksumMismatch downloaded file does not have the expected checksum
+var ErrChecksumMismatch = errors.New(`Checksum mismatch`)
+
+// hash of the file, bytes already in the resumed temp file are hashed first.
+func (m *FileDownloader) newPartFileHash(partPath string, offset int64) (hash.Hash, error) {
+	h := sha256.New()
+	if offset == 0 {
+		return h, nil
+	}
+	fs, ok := m.fileSystem().(ResumableFileSystem)
+	if !ok {
+		return nil, errors.New(`can not read resumed file ` + partPath)
+	}
+	f, err := fs.Open(partPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(h, f, offset); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func verifySHA256(h hash.Hash, expected string) error {
+	actual := hexSum(h)
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf(`%w: expected %s but %s`, ErrChecksumMismatch, expected, actual)
+	}
+	return nil
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// write checksums of downloaded files to Config.WriteChecksumManifest in sha256sum format.
+// files failed to download are not written.
+func (m *FileDownloader) writeChecksumManifest(files []*fileProgress) error {
+	var b strings.Builder
+	for _, f := range files {
+		if f.savedPath == `` || f.sha256 == `` || isStdout(f.savedPath) {
+			continue
+		}
+		for _, path := range append([]string{f.savedPath}, f.copies...) {
+			b.WriteString(f.sha256 + `  ` + path + "\n")
+		}
+	}
+	w, err := m.fileSystem().Create(m.conf.WriteChecksumManifest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,128 @@
+package filedownloader
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// http client of the downloader.
+
+// ErrCertificatePinMismatch certificate of the server is not in Config.PinnedCertSHA256
+var ErrCertificatePinMismatch = errors.New(`Certificate does not match pinned SHA-256`)
+
+// ErrInsecureRedirect redirect from HTTPS to HTTP is refused unless Config.AllowInsecureRedirect is set
+var ErrInsecureRedirect = errors.New(`Redirect from HTTPS to HTTP is refused`)
+
+// same as the limit of http.Client default policy
+const maxRedirects = 10
+
+// Go default transport is used unless transport settings are configured.
+func newHTTPClient(conf *Config) *http.Client {
+	client := &http.Client{CheckRedirect: checkRedirect(conf.AllowInsecureRedirect)}
+	if conf.ResponseHeaderTimeout <= 0 && len(conf.PinnedCertSHA256) == 0 && conf.DialTimeout <= 0 && conf.KeepAlive == 0 {
+		return client
+	}
+	client.Transport = newTransport(conf)
+	return client
+}
+
+// redirect downgrading HTTPS to HTTP strips transport security
+func checkRedirect(allowInsecure bool) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return errors.New(`stopped after 10 redirects`)
+		}
+		if !allowInsecure && req.URL.Scheme == `http` && via[len(via)-1].URL.Scheme == `https` {
+			return fmt.Errorf(`%w: %s`, ErrInsecureRedirect, req.URL.Redacted())
+		}
+		return nil
+	}
+}
+
+func newTransport(conf *Config) *http.Transport {
+	var transport *http.Transport
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport = t.Clone()
+	} else {
+		transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+	}
+	if conf.ResponseHeaderTimeout > 0 {
+		// dead host fails in the timeout, while reading the body is not bounded by it.
+		transport.TLSHandshakeTimeout = conf.ResponseHeaderTimeout
+		transport.ResponseHeaderTimeout = conf.ResponseHeaderTimeout
+	}
+	if dialer := newDialer(conf); dialer != nil {
+		transport.DialContext = dialer.DialContext
+	}
+	if len(conf.PinnedCertSHA256) > 0 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.VerifyPeerCertificate = verifyPinnedCert(conf.PinnedCertSHA256)
+	}
+	return transport
+}
+
+// dialer of Config.DialTimeout and KeepAlive, nil if Go default dialer is used.
+func newDialer(conf *Config) *net.Dialer {
+	timeout := conf.DialTimeout
+	if timeout <= 0 {
+		timeout = conf.ResponseHeaderTimeout
+	}
+	if timeout <= 0 && conf.KeepAlive == 0 {
+		return nil
+	}
+	// same as the dialer of http.DefaultTransport
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	keepAlive := conf.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = 30 * time.Second
+	}
+	return &net.Dialer{Timeout: timeout, KeepAlive: keepAlive}
+}
+
+// pins are SHA-256 of the leaf certificate or its public key (SPKI), in hex or base64.
+func verifyPinnedCert(pins []string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	pinned := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		if b, err := hex.DecodeString(strings.ReplaceAll(pin, `:`, ``)); err == nil && len(b) == sha256.Size {
+			pinned[string(b)] = true
+		} else if b, err := base64.StdEncoding.DecodeString(pin); err == nil && len(b) == sha256.Size {
+			pinned[string(b)] = true
+		}
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrCertificatePinMismatch
+		}
+		certSum := sha256.Sum256(rawCerts[0])
+		if pinned[string(certSum[:])] {
+			return nil
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		spkiSum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		if pinned[string(spkiSum[:])] {
+			return nil
+		}
+		return ErrCertificatePinMismatch
+	}
+}
+
+// connection refused by the security settings fails every time
+func isRefusedConnection(err error) bool {
+	return errors.Is(err, ErrCertificatePinMismatch) || errors.Is(err, ErrInsecureRedirect)
+}
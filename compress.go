@@ -0,0 +1,62 @@
+package filedownloader
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// compress downloading file while writing it to the local file.
+
+// CompressFormat compression format of the downloaded file
+type CompressFormat string
+
+// CompressGzip stores file in gzip format with .gz extension
+const CompressGzip CompressFormat = `gzip`
+
+// CompressZlib stores file in zlib format with .zz extension
+const CompressZlib CompressFormat = `zlib`
+
+// path of the file finally saved. extension is added if the file is compressed.
+func (m *FileDownloader) outputFilePath(localPath string) string {
+	if !m.conf.CompressOutput || isStdout(localPath) {
+		return localPath
+	}
+	switch m.conf.CompressFormat {
+	case CompressZlib:
+		return localPath + `.zz`
+	default:
+		return localPath + `.gz`
+	}
+}
+
+func newCompressWriter(format CompressFormat, w io.Writer) (io.WriteCloser, error) {
+	switch format {
+	case ``, CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZlib:
+		return zlib.NewWriter(w), nil
+	}
+	return nil, errors.New(`unknown compress format ` + string(format))
+}
+
+// downloaded file is gzip file if its Content-Type is gzip or URL path has .gz extension.
+// body encoded by Content-Encoding is not the case, it is decoded as response body.
+func isGzipFile(url string, resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get(`Content-Type`))
+	if mediaType == `application/gzip` || mediaType == `application/x-gzip` {
+		return true
+	}
+	u, err := neturl.Parse(url)
+	return err == nil && strings.HasSuffix(u.Path, `.gz`)
+}
+
+// local path of decompressed file, .gz extension is removed.
+func decompressedFilePath(localPath string) string {
+	return strings.TrimSuffix(localPath, `.gz`)
+}
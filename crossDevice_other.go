@@ -0,0 +1,9 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package filedownloader
+
+import "syscall"
+
+// rename across file systems fails with EXDEV
+var errCrossDevice error = syscall.EXDEV
@@ -0,0 +1,6 @@
+package filedownloader
+
+import "errors"
+
+// plan9 has no error code of rename across file systems, rename fails as it is.
+var errCrossDevice = errors.New(`cross device rename`)
@@ -0,0 +1,6 @@
+package filedownloader
+
+import "syscall"
+
+// ERROR_NOT_SAME_DEVICE returned by rename across volumes
+var errCrossDevice error = syscall.Errno(17)
@@ -0,0 +1,85 @@
+package filedownloader
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// decode response body encoded by Content-Encoding header.
+// gzip and deflate are decoded by standard library. Other encodings like br or zstd
+// are decoded only when ContentDecoder for it is set to Config.ContentDecoders.
+
+// ContentDecoder wraps encoded response body with decoding reader
+type ContentDecoder func(r io.Reader) (io.Reader, error)
+
+var builtinDecoders = map[string]ContentDecoder{
+	`gzip`: func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	`x-gzip`: func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	`deflate`: func(r io.Reader) (io.Reader, error) {
+		return zlib.NewReader(r)
+	},
+}
+
+// ErrUnsupportedEncoding response is encoded with encoding that has no decoder
+var ErrUnsupportedEncoding = errors.New(`Unsupported Content-Encoding`)
+
+func (m *FileDownloader) decoderOf(encoding string) ContentDecoder {
+	if dec, ok := m.conf.ContentDecoders[encoding]; ok {
+		return dec
+	}
+	return builtinDecoders[encoding]
+}
+
+// Accept-Encoding header value to tell the server which encodings are decodable.
+// empty if no decoders are configured, then http.Transport asks and decodes gzip by itself.
+// identity with DisableAutoDecompress, since http.Transport decodes gzip it asked for even then.
+func (m *FileDownloader) acceptEncoding() string {
+	if m.conf.DisableAutoDecompress {
+		return `identity`
+	}
+	if len(m.conf.ContentDecoders) == 0 {
+		return ``
+	}
+	var encodings []string
+	for encoding := range m.conf.ContentDecoders {
+		encodings = append(encodings, encoding)
+	}
+	sort.Strings(encodings)
+	if _, ok := m.conf.ContentDecoders[`gzip`]; !ok {
+		encodings = append(encodings, `gzip`)
+	}
+	return strings.Join(encodings, `, `)
+}
+
+// wrap body with decoders of Content-Encoding. encodings are applied in listed order, so decode them in reverse order.
+func (m *FileDownloader) decodeBody(resp *http.Response, body io.Reader) (io.Reader, error) {
+	if m.conf.DisableAutoDecompress {
+		return body, nil
+	}
+	encodings := strings.Split(resp.Header.Get(`Content-Encoding`), `,`)
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == `` || encoding == `identity` {
+			continue
+		}
+		dec := m.decoderOf(encoding)
+		if dec == nil {
+			return nil, fmt.Errorf(`%w: %s`, ErrUnsupportedEncoding, encoding)
+		}
+		var err error
+		if body, err = dec(body); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
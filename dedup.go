@@ -0,0 +1,164 @@
+package filedownloader
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// same request in a batch is downloaded only once, requests of the same URL with other headers may return other files.
+// duplicates to the same local path are dropped, duplicates to other local paths get hard link or copy of the downloaded file.
+// Download.AdditionalPaths get hard link or copy of the downloaded file in the same way.
+
+// remove downloads of the same request, first one of the request is downloaded.
+// downloads expecting other checksums are not merged, so that each file is verified.
+// downloads failed by path collisions are kept to fail with their errors.
+func (m *FileDownloader) deduplicate(downloads []*Download, collisions map[*Download]error) []*Download {
+	duplicates := make(map[*Download]*Download)
+	defer func() {
+		m.mu.Lock()
+		m.duplicates = duplicates
+		m.mu.Unlock()
+	}()
+	primary := make(map[string]*Download)
+	var unique []*Download
+	for _, d := range downloads {
+		key := m.dedupKey(d)
+		// local path decided by response can not be compared, and stdout can not be copied
+		// requests with a body may return different files from the same URL
+		p, ok := primary[key]
+		if !ok || d.LocalFilePath == `` || p.LocalFilePath == `` || isStdout(d.LocalFilePath) || d.hasBody() || collisions[d] != nil {
+			if d.LocalFilePath != `` && !isStdout(d.LocalFilePath) && !d.hasBody() && collisions[d] == nil {
+				primary[key] = d
+			}
+			unique = append(unique, d)
+			continue
+		}
+		if filepath.Clean(p.LocalFilePath) == filepath.Clean(d.LocalFilePath) {
+			m.logfunc(`Duplicated download is dropped[` + d.URL + `]`)
+		} else {
+			m.logfunc(`Duplicated download is copied from ` + p.LocalFilePath + ` to ` + d.LocalFilePath + `[` + d.URL + `]`)
+		}
+		duplicates[d] = p
+	}
+	return unique
+}
+
+// request of the download and its expected checksum, which must be the same to share a file.
+func (m *FileDownloader) dedupKey(d *Download) string {
+	header := m.requestHeader(d)
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(d.method() + "\n" + d.URL + "\n" + strings.ToLower(d.ExpectedSHA256) + "\n")
+	for _, name := range names {
+		b.WriteString(name + `: ` + strings.Join(header[name], `, `) + "\n")
+	}
+	b.Write(d.Body)
+	return b.String()
+}
+
+// Duplicates returns downloads which were not fetched because another download in the batch has the same request.
+// Values are the downloads actually fetched. The file is linked or copied to LocalFilePath of the duplicated download.
+func (m *FileDownloader) Duplicates() map[*Download]*Download {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	duplicates := make(map[*Download]*Download, len(m.duplicates))
+	for d, p := range m.duplicates {
+		duplicates[d] = p
+	}
+	return duplicates
+}
+
+// link or copy downloaded files to local paths of the duplicated downloads.
+func (m *FileDownloader) copyToDuplicates(files []*fileProgress) error {
+	saved := make(map[*Download]*fileProgress, len(files))
+	for _, f := range files {
+		saved[f.download] = f
+	}
+	var firstErr error
+	for d, p := range m.duplicates {
+		f := saved[p]
+		if f == nil || f.savedPath == `` {
+			// failed download has nothing to copy
+			if f != nil {
+				m.sendResult(d, ``, f.err)
+			}
+			continue
+		}
+		dst := m.duplicatePath(f.localPath, f.savedPath, d.LocalFilePath)
+		if filepath.Clean(dst) != filepath.Clean(f.savedPath) {
+			if err := m.linkFile(f.savedPath, dst); err != nil {
+				m.logfunc(`Could not copy duplicated download to `+dst, err)
+				err = &DownloadError{URL: d.URL, Err: &FileSystemError{Err: err}}
+				if firstErr == nil {
+					firstErr = err
+				}
+				m.sendResult(d, ``, err)
+				continue
+			}
+			f.copies = append(f.copies, dst)
+		}
+		additional, err := m.linkAdditionalPaths(d, f.localPath, f.savedPath)
+		f.copies = append(f.copies, additional...)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		m.sendResultPaths(d, dst, additional, 0, f.sha256, err)
+	}
+	return firstErr
+}
+
+// local path of the duplicated download or additional path, converted in the same way as the saved file of the fetched download.
+func (m *FileDownloader) duplicatePath(primaryPath, savedPath, localPath string) string {
+	if savedPath != m.outputFilePath(primaryPath) {
+		return m.outputFilePath(decompressedFilePath(localPath))
+	}
+	return m.outputFilePath(localPath)
+}
+
+// hard link on the OS file system, copy on other file systems or if link is not possible.
+func (m *FileDownloader) linkFile(src, dst string) error {
+	fs := m.fileSystem()
+	if _, ok := fs.(osFileSystem); ok {
+		// dst differing only in case is src itself on a case-insensitive file system
+		if srcInfo, err := os.Stat(src); err == nil {
+			if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(srcInfo, dstInfo) {
+				return nil
+			}
+		}
+		os.Remove(dst)
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+	rfs, ok := fs.(ResumableFileSystem)
+	if !ok {
+		return os.ErrInvalid
+	}
+	return copyFile(rfs, src, dst)
+}
+
+// link the saved file to AdditionalPaths of the download, created paths are returned.
+func (m *FileDownloader) linkAdditionalPaths(d *Download, primaryPath, savedPath string) ([]string, error) {
+	if savedPath == `` || isStdout(savedPath) {
+		return nil, nil
+	}
+	var created []string
+	for _, path := range d.AdditionalPaths {
+		dst := m.duplicatePath(primaryPath, savedPath, path)
+		if filepath.Clean(dst) == filepath.Clean(savedPath) {
+			continue
+		}
+		if err := m.linkFile(savedPath, dst); err != nil {
+			m.logfunc(`Could not link downloaded file to `+dst, err)
+			return created, &DownloadError{URL: d.URL, Err: &FileSystemError{Err: err}}
+		}
+		created = append(created, dst)
+	}
+	return created, nil
+}
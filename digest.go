@@ -0,0 +1,73 @@
+package filedownloader
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// verify downloaded bytes with Content-MD5 or Digest header of the response, by Config.VerifyServerDigest.
+
+// ErrDigestMismatch downloaded bytes do not have the digest told by the server
+var ErrDigestMismatch = errors.New(`Digest mismatch`)
+
+// algorithms of Digest header, stronger first
+var digestAlgorithms = []struct {
+	name    string
+	newHash func() hash.Hash
+}{
+	{`sha-512`, sha512.New},
+	{`sha-256`, sha256.New},
+	{`sha`, sha1.New},
+	{`md5`, md5.New},
+}
+
+type serverDigest struct {
+	algorithm string
+	expected  []byte
+	hash      hash.Hash
+}
+
+// digest of the body told by the response, nil if the response has no digest of supported algorithm.
+func responseDigest(resp *http.Response) *serverDigest {
+	// ex. Digest: sha-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=,md5=...
+	values := make(map[string]string)
+	for _, field := range strings.Split(resp.Header.Get(`Digest`), `,`) {
+		if i := strings.Index(field, `=`); i > 0 {
+			values[strings.ToLower(strings.TrimSpace(field[:i]))] = strings.TrimSpace(field[i+1:])
+		}
+	}
+	if md5sum := resp.Header.Get(`Content-MD5`); md5sum != `` {
+		if _, ok := values[`md5`]; !ok {
+			values[`md5`] = md5sum
+		}
+	}
+	for _, algorithm := range digestAlgorithms {
+		value, ok := values[algorithm.name]
+		if !ok {
+			continue
+		}
+		expected, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		return &serverDigest{algorithm: algorithm.name, expected: expected, hash: algorithm.newHash()}
+	}
+	return nil
+}
+
+func (d *serverDigest) verify() error {
+	actual := d.hash.Sum(nil)
+	if string(actual) != string(d.expected) {
+		return fmt.Errorf(`%w: %s expected %s but %s`, ErrDigestMismatch, d.algorithm,
+			base64.StdEncoding.EncodeToString(d.expected), base64.StdEncoding.EncodeToString(actual))
+	}
+	return nil
+}
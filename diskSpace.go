@@ -0,0 +1,90 @@
+package filedownloader
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// stop downloading when free disk space becomes less than Config.MinFreeBytes.
+
+// ErrInsufficientSpace free disk space is less than Config.MinFreeBytes
+var ErrInsufficientSpace = errors.New(`Free disk space is below MinFreeBytes`)
+
+var errFreeSpaceUnsupported = errors.New(`free disk space is not available on this platform`)
+
+// replaced in tests
+var diskFreeBytes = freeBytes
+
+// directory where the temp file of the download is written, empty if not decided yet.
+func (m *FileDownloader) downloadDir(d *Download) string {
+	if m.conf.CASRoot != `` {
+		return m.conf.CASRoot
+	}
+	if d.LocalFilePath == `` {
+		return m.conf.TempDir
+	}
+	if isStdout(d.LocalFilePath) {
+		return ``
+	}
+	return filepath.Dir(m.partFilePath(m.outputFilePath(d.LocalFilePath)))
+}
+
+// check free space of the directories, only on the OS file system.
+// directories whose free space can not be read are not checked.
+func (m *FileDownloader) checkFreeSpace(dirs ...string) error {
+	if m.conf.MinFreeBytes <= 0 {
+		return nil
+	}
+	if _, ok := m.fileSystem().(osFileSystem); !ok {
+		return nil
+	}
+	for _, dir := range dirs {
+		if dir == `` {
+			continue
+		}
+		free, err := diskFreeBytes(dir)
+		if err != nil {
+			m.logfunc(`Could not get free space of `+dir, err)
+			continue
+		}
+		if free < m.conf.MinFreeBytes {
+			return fmt.Errorf(`%w: %d bytes free in %s`, ErrInsufficientSpace, free, dir)
+		}
+	}
+	return nil
+}
+
+// abort downloading files when free space is short, called every progress report.
+func (m *FileDownloader) checkFreeSpaceWhileDownloading(files []*fileProgress) {
+	if !m.conf.AbortAtMinFreeBytes || m.conf.MinFreeBytes <= 0 {
+		return
+	}
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if dir := m.downloadDir(f.download); f.isDownloading() && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	if err := m.checkFreeSpace(dirs...); err != nil {
+		m.logfunc(`Abort downloading files.`, err)
+		m.setSpaceErr(err)
+		m.cancelBatch()
+	}
+}
+
+func (m *FileDownloader) setSpaceErr(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.spaceErr == nil {
+		m.spaceErr = err
+	}
+}
+
+func (m *FileDownloader) getSpaceErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.spaceErr
+}
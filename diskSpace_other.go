@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+package filedownloader
+
+func freeBytes(dir string) (int64, error) {
+	return 0, errFreeSpaceUnsupported
+}
@@ -0,0 +1,51 @@
+package filedownloader
+
+// progress, start, retry and end of the files delivered in order on Events, by Config.OrderedEvents.
+
+// EventType kind of Event
+type EventType string
+
+// EventProgress is sent every second with the progress and bytes per second of the batch
+const EventProgress EventType = `progress`
+
+// EventFileStart is sent when a file starts downloading
+const EventFileStart EventType = `start`
+
+// EventRetry is sent before waiting for a retry of a file
+const EventRetry EventType = `retry`
+
+// EventFileDone is sent when a file ended, including failed, skipped and not started files
+const EventFileDone EventType = `done`
+
+// Event of the download delivered on Events.
+type Event struct {
+	Type     EventType
+	Download *Download // nil for EventProgress
+	// Progress is the value sent to ProgressChan, -1 if it is not available yet. Only for EventProgress.
+	Progress       float64
+	BytesPerSecond int64  // value sent to DownloadBytesPerSecond, only for EventProgress
+	Attempt        int    // retry count from 1, only for EventRetry
+	Path           string // local path of the file, only for EventFileDone of downloaded file
+	Skipped        bool   // file was skipped by SkipCompleted or ShouldDownload, only for EventFileDone
+	Err            error  // error retried for EventRetry, error of the file for EventFileDone
+}
+
+// deliver events to Events in the order they are emitted, until in is closed.
+func (m *FileDownloader) dispatchEvents(in <-chan Event) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(m.Events)
+		for e := range in {
+			m.Events <- e
+		}
+	}()
+	return done
+}
+
+// send the event to the dispatcher, nothing if OrderedEvents is not set.
+func (m *FileDownloader) emitEvent(e Event) {
+	if m.events != nil {
+		m.events <- e
+	}
+}
@@ -0,0 +1,50 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// verify total size of the batch before downloading by MultipleFileDownloadExpectingSize.
+
+// ErrTotalSizeMismatch sum of the file sizes told by HEAD requests is not the expected total
+var ErrTotalSizeMismatch = errors.New(`Total size of the files is not the expected size`)
+
+// MultipleFileDownloadExpectingSize is MultipleFileDownload which verifies that the sum of the file sizes told by
+// HEAD requests, TotalFilesSize, is expectedTotal within Config.ExpectedSizeTolerance before downloading any file.
+// On mismatch no file is downloaded and every file fails with ErrTotalSizeMismatch, ex. when a manifest refers
+// stale or resized files. KnownSize of a Download is used as its size, and a URL downloaded by several Downloads
+// is counted once. It also fails if the size of some file is unknown, or told by the response as with SingleRequestMode.
+func (m *FileDownloader) MultipleFileDownloadExpectingSize(downloads []*Download, expectedTotal int64) error {
+	if m.State != StateReady {
+		panic(`filedownloader has already started or done`)
+	}
+	m.State = StateDownloading
+	m.expectSize = true
+	m.expectedTotal = expectedTotal
+	m.downloadFiles(context.Background(), downloads)
+	return m.err
+}
+
+// error if the total size is not expected, nil if not verified or HEAD requests were stopped by cancel.
+func (m *FileDownloader) checkExpectedTotal(ctx context.Context, files []*fileProgress) error {
+	if !m.expectSize || ctx.Err() != nil {
+		return nil
+	}
+	unknown := m.unknownSize
+	for _, f := range files {
+		unknown = unknown || f.sizePending
+	}
+	if unknown {
+		return fmt.Errorf(`%w: size of some files is unknown`, ErrTotalSizeMismatch)
+	}
+	diff := m.TotalFilesSize - m.expectedTotal
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > m.conf.ExpectedSizeTolerance {
+		return fmt.Errorf(`%w: %d bytes but expected %d bytes`, ErrTotalSizeMismatch, m.TotalFilesSize, m.expectedTotal)
+	}
+	return nil
+}
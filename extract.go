@@ -0,0 +1,191 @@
+package filedownloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// download an archive and extract it to a directory by DownloadAndExtract.
+
+// ErrUnsafeArchivePath archive has an entry outside of the destination directory, ex. ../etc/passwd
+var ErrUnsafeArchivePath = errors.New(`Archive entry is outside of the destination`)
+
+// ErrUnsupportedArchive downloaded file is not zip, tar or tar.gz
+var ErrUnsupportedArchive = errors.New(`Unsupported archive format`)
+
+// DownloadAndExtract downloads the zip, tar or tar.gz archive of url and extracts it to destDir.
+// Format is detected from the downloaded bytes. The archive is downloaded as a file of the batch, so progress,
+// retries and timeouts of the Config are applied to it. Files are extracted to a temp directory next to destDir,
+// which is renamed to destDir when all files are extracted, so destDir must not exist or be empty.
+// Nothing is left on failure. Only regular files and directories are extracted, and an entry outside of destDir
+// fails with ErrUnsafeArchivePath. Config.FileSystem is not used and CompressOutput is not supported.
+func (m *FileDownloader) DownloadAndExtract(ctx context.Context, url, destDir string) error {
+	if m.State != StateReady {
+		panic(`filedownloader has already started or done`)
+	}
+	if _, ok := m.fileSystem().(osFileSystem); !ok || m.conf.CompressOutput {
+		return &DownloadError{URL: url, Err: errors.New(`archive is extracted only on the OS file system without CompressOutput`)}
+	}
+	if err := checkEmptyDir(destDir); err != nil {
+		return &DownloadError{URL: url, Err: err}
+	}
+	staging, err := ioutil.TempDir(filepath.Dir(destDir), `.`+filepath.Base(destDir)+`.`)
+	if err != nil {
+		return &DownloadError{URL: url, Err: err}
+	}
+	defer os.RemoveAll(staging)
+	archivePath := filepath.Join(staging, `archive`)
+	m.State = StateDownloading
+	m.downloadFiles(ctx, []*Download{{URL: url, LocalFilePath: archivePath}})
+	if m.err != nil {
+		return m.err
+	}
+	extracted := filepath.Join(staging, `files`)
+	if err := extractArchive(archivePath, extracted); err != nil {
+		m.logfunc(`Could not extract archive[`+url+`]`, err)
+		return &DownloadError{URL: url, Err: err}
+	}
+	// empty destDir is replaced
+	os.Remove(destDir)
+	if err := os.Rename(extracted, destDir); err != nil {
+		return &DownloadError{URL: url, Err: err}
+	}
+	return nil
+}
+
+// dir may be created by rename
+func checkEmptyDir(dir string) error {
+	names, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return errors.New(dir + ` is not empty`)
+	}
+	return nil
+}
+
+func extractArchive(archivePath, destDir string) error {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(512)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return extractZip(archivePath, destDir)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return extractTar(gz, destDir)
+	case len(magic) >= 262 && string(magic[257:262]) == `ustar`:
+		return extractTar(r, destDir)
+	}
+	return ErrUnsupportedArchive
+}
+
+// path of the entry under destDir, error if the entry goes outside of it.
+func entryPath(destDir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != `` || clean == `..` || strings.HasPrefix(clean, `..`+string(filepath.Separator)) {
+		return ``, fmt.Errorf(`%w: %s`, ErrUnsafeArchivePath, name)
+	}
+	return filepath.Join(destDir, clean), nil
+}
+
+func extractTar(r io.Reader, destDir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path, err := entryPath(destDir, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg:
+			err = writeEntry(path, header.FileInfo().Mode(), tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(archivePath, destDir string) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, entry := range zr.File {
+		path, err := entryPath(destDir, entry.Name)
+		if err != nil {
+			return err
+		}
+		mode := entry.Mode()
+		if mode.IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			continue
+		}
+		r, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		err = writeEntry(path, mode, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeEntry(path string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
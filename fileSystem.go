@@ -0,0 +1,128 @@
+package filedownloader
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// destination file system of downloaded files.
+
+// FileSystem creates and moves downloaded files. Default is the OS file system.
+// Set Config.FileSystem to download files into other storages like memory or cloud storage.
+type FileSystem interface {
+	Create(name string) (io.WriteCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+}
+
+// ResumableFileSystem is a FileSystem which can read files and write files from the middle.
+// Downloads are resumed only when Config.FileSystem implements it.
+type ResumableFileSystem interface {
+	FileSystem
+	Open(name string) (io.ReadCloser, error)
+	// OpenAt opens existing file to write from offset
+	OpenAt(name string, offset int64) (io.WriteCloser, error)
+}
+
+// FileSystemError is the cause of DownloadError when reading or writing local files failed, ex. the disk is full,
+// to tell it from network errors by errors.As. It is not retried.
+type FileSystemError struct {
+	Err error
+}
+
+func (e *FileSystemError) Error() string {
+	return `file system error: ` + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *FileSystemError) Unwrap() error {
+	return e.Err
+}
+
+// writer of the local file, write errors are FileSystemError
+type fileSystemWriter struct {
+	w io.Writer
+}
+
+func (f fileSystemWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		err = &FileSystemError{Err: err}
+	}
+	return n, err
+}
+
+// os package implementation of FileSystem
+type osFileSystem struct{}
+
+func (osFileSystem) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (osFileSystem) OpenAt(name string, offset int64) (io.WriteCloser, error) {
+	file, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (m *FileDownloader) fileSystem() FileSystem {
+	if m.conf.FileSystem == nil {
+		return osFileSystem{}
+	}
+	return m.conf.FileSystem
+}
+
+// size of the existing file
+func fileSize(fs FileSystem, name string) (int64, error) {
+	f, err := fs.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	if f.IsDir() {
+		return 0, errors.New(name + ` is directory. Not a file`)
+	}
+	return f.Size(), nil
+}
+
+// file is closed on every error path and also by defer, so make Close safe to call twice.
+type onceCloser struct {
+	io.WriteCloser
+	once sync.Once
+	err  error
+}
+
+func closeOnce(w io.WriteCloser) io.WriteCloser {
+	return &onceCloser{WriteCloser: w}
+}
+
+func (m *onceCloser) Close() error {
+	m.once.Do(func() {
+		m.err = m.WriteCloser.Close()
+	})
+	return m.err
+}
@@ -4,37 +4,317 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	logger "log"
+	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // FileDownloader main structure
 type FileDownloader struct {
+	// 64-bit fields accessed atomically come first to be 8-byte aligned on 32-bit platforms
+	batchBytes             int64 // downloaded bytes of the batch, accessed atomically
+	inFlightBytes          int64 // reserved bytes of downloading files by MaxInFlightBytes, accessed atomically
+	active                 int32 // number of downloading files, accessed atomically
+	totalRetries           int32 // retries of the batch counted by MaxTotalRetries, accessed atomically
+	retries                int32 // retries of the batch, accessed atomically
 	conf                   *Config
-	TotalFilesSize         int64
-	ProgressChan           chan float64               // 0.0 to 1.0 float value indicates progress of downloading
+	TotalFilesSize         int64                      // sum of file sizes, files of unknown size are not included
+	ProgressChan           chan float64               // 0.0 to 1.0 float value indicates progress of downloading, fraction of done files if some file sizes are unknown
 	DownloadBytesPerSecond chan int64                 // downloaded bytes in last second
+	Events                 chan Event                 // progress and files of the batch in order, only if OrderedEvents is set
 	err                    error                      // error object
 	Cancel                 func()                     // cancel downloading, if this method is called.
 	logfunc                func(param ...interface{}) // logging function
 	State                  state                      // downloading state of filedownloader
+	mu                     sync.Mutex
+	remaining              []*Download // files not downloaded because of MaxTotalBytes
+	cancelBatch            func()      // cancel downloading without marking as cancelled by user
+	cancelled              int32       // 1 if Cancel was called, accessed atomically
+	outcome                Outcome
+	duplicates             map[*Download]*Download // duplicated download to the download actually fetched
+	results                chan<- Result           // receives result of each file when downloading by DownloadChan
+	resumed                chan struct{}           // closed by Resume, nil if not paused
+	pausedAt               time.Time
+	pausedTotal            time.Duration   // paused time before current pause
+	spaceErr               error           // set when free disk space became less than MinFreeBytes
+	cleanup                int32           // 1 if CancelAndCleanup was called, accessed atomically
+	finished               chan struct{}   // closed when the download has finished
+	unknownSize            bool            // some files have no Content-Length, progress value is not available
+	skipped                []*Download     // files saved completely by the previous run
+	localPaths             map[string]bool // saved paths of the batch, not used as temp file paths
+	stdoutMu               sync.Mutex      // held while downloading a file to stdout
+	client                 *http.Client
+	queue                  []*fileProgress     // files waiting for a download thread, in the order to start
+	inFlightReleased       chan struct{}       // notified when in flight bytes are released
+	ctxErr                 error               // timeout or cancel of the context given to the download
+	batch                  []*Download         // downloads of the first run, in the given order
+	fileResults            map[*Download]error // result of each download, updated by RetryFailed
+	fileRetries            map[*Download]int   // retries of each download, updated by RetryFailed
+	expectSize             bool                // verify TotalFilesSize by MultipleFileDownloadExpectingSize
+	expectedTotal          int64
+	suspended              int32                      // 1 if Suspend was called, accessed atomically
+	suspendErr             error                      // error of writing resume metadata by Suspend
+	throughput             *throughputSamples         // bytes per second of recent seconds for ThroughputPercentile
+	events                 chan<- Event               // dispatcher of Events while downloading, nil if OrderedEvents is not set
+	buffers                sync.Pool                  // copy buffers of Config.BufferSize shared by download goroutines
+	schemes                map[string]DownloadHandler // handlers of URL schemes by RegisterScheme
 }
 
 // Config filedownloader config
 type Config struct {
 	MaxDownloadThreads     int                        // limit of parallel downloading threads. Default value is 3
 	MaxRetry               int                        // retry count of file downloading, when download fails default is 0
-	DownloadTimeoutMinutes int                        // download timeout minutes, default is 60
-	RequiresDetailProgress bool                       // If true you can receive progress value from ProgressChan and downloadBytesPerSecond
+	DownloadTimeoutMinutes int                        // download timeout minutes of the whole batch, default is 60. BatchTimeout is used instead if set
+	RequiresDetailProgress bool                       // If true you can receive progress value from ProgressChan and downloadBytesPerSecond. ProgressChan receives fraction of done files if some file sizes are unknown
 	logfunc                func(param ...interface{}) // logging function
+	// PathFunc decides local file path from URL and response headers (ex. Content-Disposition).
+	// It is called only when LocalFilePath of the Download is empty.
+	PathFunc func(url string, resp *http.Response) (string, error)
+	// TempDir is a directory to put downloading temp(.part) files.
+	// If empty, temp file is created next to LocalFilePath.
+	TempDir string
+	// CompressOutput stores downloaded file compressed with CompressFormat.
+	// File extension of the format is added to LocalFilePath. ex. fuso.jpg -> fuso.jpg.gz
+	CompressOutput bool
+	CompressFormat CompressFormat // compression format of CompressOutput. Default is CompressGzip
+	// DecompressGzip stores gzip file decompressed, when Content-Type is gzip or URL has .gz extension.
+	// .gz extension of LocalFilePath is removed. ex. fuso.tar.gz -> fuso.tar
+	// Download.ExpectedSHA256 is of the decompressed file unless ChecksumBeforeDecompress is set.
+	DecompressGzip bool
+	// ChecksumBeforeDecompress verifies ExpectedSHA256 with the gzip file before DecompressGzip.
+	// Default is false, checksum is of the decompressed file.
+	// Checksum is always of the bytes before CompressOutput.
+	ChecksumBeforeDecompress bool
+	// OnResponse is called right after the response of each download arrived, before reading the body.
+	// Do not read or close response body in this function.
+	OnResponse func(d *Download, resp *http.Response)
+	// OnFileProgress is called every second for each downloading file with its downloaded bytes,
+	// whole size of the file and downloaded bytes in last second. Called once more when the file download ends.
+	// totalBytes is -1 if the size of the file is unknown.
+	OnFileProgress func(d *Download, downloadedBytes, totalBytes, bytesPerSecond int64)
+	// DisableAutoDecompress saves response body as it is even if the body is encoded by Content-Encoding.
+	DisableAutoDecompress bool
+	// ContentDecoders are decoders of Content-Encoding keyed by encoding name, ex. "br" or "zstd".
+	// gzip and deflate are decoded without setting decoders.
+	ContentDecoders map[string]ContentDecoder
+	// MaxTotalBytes stops launching new downloads when the batch downloaded this bytes in total. 0 means no limit.
+	// Files not downloaded are reported by Remaining().
+	MaxTotalBytes int64
+	// AbortAtMaxTotalBytes aborts downloading files too when MaxTotalBytes is reached.
+	// If false, downloading files are continued until they finish.
+	AbortAtMaxTotalBytes bool
+	// StartJitter delays start of each download by random duration up to this value,
+	// so that many downloads to the same host do not start at once.
+	StartJitter time.Duration
+	// FileSystem is where downloaded files are written. Default is the OS file system.
+	// Downloads are resumed only if it implements ResumableFileSystem.
+	FileSystem FileSystem
+	// RetryDelay is the wait before the first retry, doubled on each next retry up to 1 minute. Default is 1 second.
+	RetryDelay time.Duration
+	// OnRetry is called before waiting for each retry with the retry count from 1, the error and the delay before the retry.
+	OnRetry func(d *Download, attempt int, err error, nextDelay time.Duration)
+	// ResumeFromPartial resumes download from the temp file left by the previous run,
+	// if the server accepts range request and the remote file size and ETag are not changed.
+	// Temp file is kept when download failed for next resume. Default is false.
+	ResumeFromPartial bool
+	// BatchTimeout bounds the whole download including HEAD requests and retries.
+	// It takes precedence over DownloadTimeoutMinutes.
+	BatchTimeout time.Duration
+	// PerFileTimeout bounds each file download including its retries, independently of other files.
+	// A file which timed out fails with ErrFileTimeout, and other files are continued. 0 means no limit.
+	PerFileTimeout time.Duration
+	// StreamTransform converts the response body before it is written to the file, ex. decryption.
+	// It is applied after Content-Encoding is decoded and before DecompressGzip and checksum.
+	// Downloads are not resumed when it is set, since transform of the middle of the stream is unknown.
+	// Progress counts bytes from network. An error from the function or the returned reader fails the download.
+	StreamTransform func(r io.Reader) (io.Reader, error)
+	// MaxFilesPerSecond limits how many downloads start in a second, for servers limiting request rate.
+	// It works together with MaxDownloadThreads. 0 means no limit.
+	MaxFilesPerSecond float64
+	// UserAgent is set to User-Agent header of every request. Go default is used if empty.
+	// User-Agent in Download.Header takes precedence over it.
+	UserAgent string
+	// Accept is set to Accept header of the requests of downloads without Download.Accept. Not sent if empty.
+	Accept string
+	// FailFast stops downloading and pending files when a file failed after its retries, and the error is returned.
+	// Files already downloaded are kept.
+	FailFast bool
+	// URLRefresher returns the URL actually requested from Download.URL, called before every GET request including retries.
+	// It is for signed URLs which expire during long batches. 403 response is retried when it is set.
+	URLRefresher func(original string) (string, error)
+	// WriteChecksumManifest is a file path to write SHA-256 of the downloaded files after the batch, in sha256sum format.
+	// Checksums are of the saved files, computed while downloading. Files failed to download are not written.
+	WriteChecksumManifest string
+	// ComputeChecksum sets SHA-256 of each saved file to Result.SHA256, computed while downloading without reading
+	// the file again. It is of the bytes saved, so of the compressed file with CompressOutput. Default is false.
+	ComputeChecksum bool
+	// RequestInterceptor is called with every HEAD and GET request before it is sent, ex. to add headers.
+	// Request context has the values of the context given to the ...Context methods. Returning error fails the request.
+	RequestInterceptor func(r *http.Request) error
+	// MaxOpenFiles limits file descriptors used by downloads. 0 means no limit.
+	// A downloading file uses 2, the connection and the temp file, so downloads run in parallel up to
+	// MaxOpenFiles/2 even if MaxDownloadThreads is larger. HEAD requests are sent one by one before downloads,
+	// and their idle connections are closed when MaxOpenFiles is set. Files are opened only while downloading.
+	MaxOpenFiles int
+	// OnTotalSizeKnown is called when sizes of all files are known by HEAD requests, before downloads start.
+	// totalBytes is -1 if the size of some file is unknown. Duplicated downloads are not counted in fileCount.
+	OnTotalSizeKnown func(totalBytes int64, fileCount int)
+	// MinFreeBytes stops launching new downloads when free disk space of the download directory is less than this bytes,
+	// and the download fails with ErrInsufficientSpace. Checked only on the OS file system. 0 means no check.
+	MinFreeBytes int64
+	// AbortAtMinFreeBytes also aborts downloading files when free space becomes less than MinFreeBytes, checked every second.
+	AbortAtMinFreeBytes bool
+	// ValidateContentType compares the type detected from the body with Content-Type header, to find HTML error pages
+	// sent with 200 status. Download.ExpectedContentType is used instead of the header if set.
+	ValidateContentType bool
+	// RejectHTMLResponses fails a download with ErrHTMLResponse before writing the file when Content-Type of the response
+	// is text/html, ex. a captive portal or an error page. Download.AllowHTML or ExpectedContentType of text/html allows it.
+	RejectHTMLResponses bool
+	// SkipCompleted skips files saved completely by the previous run, whose local file has the size told by HEAD request
+	// and ExpectedSHA256 if set. Skipped files are counted as downloaded in progress and reported by Skipped().
+	// It is not applied when CompressOutput, DecompressGzip or StreamTransform is set, since the saved file differs from the remote one.
+	SkipCompleted bool
+	// ShouldDownload decides whether each file is downloaded after its HEAD request, ex. to skip a local file newer than
+	// a day. localExists and localSize are of the file at LocalFilePath. remote has Size -1 if the size is unknown.
+	// Returning false skips the file as SkipCompleted does, and an error fails the file. Not called for files skipped by
+	// SkipCompleted, files to StdoutPath and files whose path is decided by the response.
+	ShouldDownload func(d *Download, localExists bool, localSize int64, remote HeadInfo) (bool, error)
+	// PartSuffix is the suffix of temp files, default is .part.
+	// An existing file at the temp file path is not overwritten unless it is the temp file left with resume metadata
+	// by ResumeFromPartial. Random number is added to the temp file path in that case, also when a file of the batch is saved to the path.
+	PartSuffix string
+	// SpeedSmoothing is the algorithm to smooth values delivered on DownloadBytesPerSecond. Default is SmoothingRaw.
+	SpeedSmoothing SpeedSmoothing
+	// SpeedSmoothingWindow is the seconds averaged by SmoothingMovingAverage. Default is 5.
+	SpeedSmoothingWindow int
+	// SpeedSmoothingAlpha is the weight of the latest value in SmoothingExponential, from 0 to 1. Default is 0.3.
+	SpeedSmoothingAlpha float64
+	// ThroughputSampleWindow is the count of last seconds whose bytes per second are kept for ThroughputPercentile.
+	// Older seconds are dropped, so that memory of long downloads is bounded. Default is 300, 5 minutes.
+	ThroughputSampleWindow int
+	// PropagatePanics lets a panic in a download, ex. in a callback, crash the program.
+	// Default is false, the panic fails only the file with DownloadError of PanicError and other files are continued.
+	// Panic in OnFileProgress, OnTotalSizeKnown or MetricsRecorder is logged and the download is continued.
+	PropagatePanics bool
+	// ResponseHeaderTimeout bounds connecting to the server and waiting for response headers of each request,
+	// so that dead hosts fail fast. Reading the body is not bounded by it. 0 means Go default transport is used.
+	ResponseHeaderTimeout time.Duration
+	// SingleRequestMode sends a GET request with Range: bytes=0- instead of HEAD and GET requests, and the file size is
+	// told by Content-Range of 206 response. 200 response is downloaded as usual GET. Sizes are known as responses arrive,
+	// so ProgressChan receives values and OnTotalSizeKnown is called after responses of all files arrived.
+	// HEAD requests are still sent when ResumeFromPartial, SkipCompleted or ShouldDownload is set, which check files before download.
+	SingleRequestMode bool
+	// ErrorAggregator makes the error returned by the download from errors of the files, nil for succeeded files.
+	// Cancelled files are not included. Default is JoinedErrors, FirstError and CountError are also provided.
+	ErrorAggregator func(perFile map[*Download]error) error
+	// VerifyServerDigest verifies downloaded bytes with Digest (sha-512, sha-256, sha or md5) or Content-MD5 header
+	// if the response has it. The download fails with ErrDigestMismatch on mismatch and is retried up to MaxRetry.
+	// Resumed downloads and bodies decompressed by Go transport are not verified.
+	VerifyServerDigest bool
+	// MaxInFlightBytes delays starting a file while the sum of bytes remaining in downloading files and the size of the file
+	// exceeds it, together with MaxDownloadThreads. Sizes told by HEAD requests are used, files of unknown size are not counted.
+	// A file larger than it starts when no other file is downloading. 0 means no limit.
+	MaxInFlightBytes int64
+	// MaxTotalRetries limits retries of all files in the batch together with MaxRetry of each file.
+	// After the batch used it up, failed files are not retried and their errors have ErrRetryBudgetExhausted. 0 means no limit.
+	MaxTotalRetries int
+	// CASRoot is the directory of content-addressed storage. If set, each file is stored at the path of its SHA-256
+	// under it, ex. ab/cd/abcdef..., and LocalFilePath gets a hard link or copy of the stored file. LocalFilePath may be empty
+	// if PathFunc is not set. The downloaded file is dropped if the same file is already stored. Downloads are not resumed.
+	CASRoot string
+	// PinnedCertSHA256 are SHA-256 of the certificates or public keys (SPKI) of the servers, in hex or base64.
+	// If set, HEAD and GET requests fail with ErrCertificatePinMismatch when the leaf certificate of the server matches none of them.
+	// Certificates are also verified by the CAs as usual.
+	PinnedCertSHA256 []string
+	// DialTimeout bounds establishing a connection to the server, including DNS lookup.
+	// 0 means ResponseHeaderTimeout if it is set, otherwise Go default transport is used.
+	DialTimeout time.Duration
+	// KeepAlive is the interval of TCP keep-alive probes of the connections. 0 means 30 seconds, negative disables keep-alive.
+	KeepAlive time.Duration
+	// AllowInsecureRedirect follows redirects from HTTPS to HTTP. Default is false, such requests fail with ErrInsecureRedirect.
+	AllowInsecureRedirect bool
+	// ResolvePath decides the final local path of each download when the response headers arrive, with defaultPath of
+	// LocalFilePath or PathFunc. defaultPath is empty if both are empty. The file is moved to the result when the download
+	// completes, and the result is set to LocalFilePath only if it was empty. Returning an error fails the download.
+	// Not called for StdoutPath.
+	ResolvePath func(d *Download, resp *http.Response, defaultPath string) (string, error)
+	// AllowedWindows are daily time ranges when downloads may start, ex. off-peak 1am to 5am. Outside them, starting
+	// downloads waits for the next window within the batch timeout. Default is empty, downloads start any time.
+	AllowedWindows []TimeWindow
+	// SuspendOutsideWindows also stops reading downloading files outside AllowedWindows, as Pause does.
+	SuspendOutsideWindows bool
+	// ProgressBuffer is the buffer size of ProgressChan and DownloadBytesPerSecond. Default is 10.
+	ProgressBuffer int
+	// ProgressDropOnBackpressure drops the oldest values of ProgressChan and DownloadBytesPerSecond when the buffer is full,
+	// so that a stalled reader does not block downloading. Default is false, downloading waits for the reader.
+	ProgressDropOnBackpressure bool
+	// BufferSize is the size of buffers reading response bodies, which are reused by the downloads of the batch.
+	// Default is 32KB. It does not change the boundary of resumed files.
+	BufferSize int
+	// OrderedEvents delivers progress every second, start, retries and end of each file on Events in the order they
+	// happened, so that an event of a file is not seen before the progress including the file's earlier bytes, or the other way.
+	// Events is closed when the download ends, and it must be read as ProgressChan, downloading waits for the reader.
+	OrderedEvents bool
+	// Tracer starts a span of each file download with attributes url, size, bytes, retries and outcome,
+	// and events of retries and completion. Default is nil, downloads are not traced.
+	Tracer Tracer
+	// RenameCaseCollisions adds a number to the local file path of a download, ex. File-1.txt, when it is the same file
+	// as the path of an earlier download in the batch on a case-insensitive file system, ex. file.txt on macOS.
+	// Default is false, such downloads fail with ErrPathCollision without downloading. Only on the OS file system.
+	RenameCaseCollisions bool
+	// ExpectedSizeTolerance is the difference in bytes allowed between TotalFilesSize and the expected total
+	// of MultipleFileDownloadExpectingSize. Default is 0, sizes must match exactly.
+	ExpectedSizeTolerance int64
+	// MetricsRecorder receives downloaded bytes, download speed and results of the files directly from the download,
+	// without reading ProgressChan or DownloadBytesPerSecond. Default is nil, metrics are not recorded.
+	MetricsRecorder MetricsRecorder
+	// Lister lists files of the directory index baseURL for DownloadNewerThan, ex. to read a JSON index.
+	// Default reads baseURL as an HTML index.
+	Lister func(ctx context.Context, baseURL string) ([]RemoteEntry, error)
+	// MinSpeedBytesPerSecond aborts a download whose speed averaged over MinSpeedWindow is below it, ex. on a crawling mirror.
+	// The download fails with ErrTooSlow, which is retried up to MaxRetry. Default is 0, speed is not checked.
+	MinSpeedBytesPerSecond int64
+	// MinSpeedWindow is the time the speed of a download is averaged over for MinSpeedBytesPerSecond. Default is 30 seconds.
+	MinSpeedWindow time.Duration
 }
 
 // Download target url to download and local path to be downloaded
 type Download struct {
 	URL           string // downloading file URL
-	LocalFilePath string // local file path which URL file will be downloaded
+	LocalFilePath string // local file path which URL file will be downloaded. If empty, Config.PathFunc or ResolvePath decides it and the result is set here. StdoutPath writes to stdout.
+	// ExpectedSHA256 is hex encoded SHA-256 of the file. If set, downloaded file is verified and fails with ErrChecksumMismatch
+	// on mismatch. Mismatched file is downloaded again from start up to MaxRetry, since bytes may be broken in transit.
+	ExpectedSHA256 string
+	// Header is added to HEAD and GET requests of this download. Range and Accept-Encoding are decided by the downloader.
+	Header http.Header
+	// ExpectedContentType is the media type of the file like image/png or image/*. If set, type detected from
+	// the first 512 bytes of the body is compared with it, and the download fails with ErrContentTypeMismatch on mismatch.
+	ExpectedContentType string
+	// AdditionalPaths also receive the downloaded file by hard link, or copy if link is not possible, ex. versioned and latest.
+	// Paths are converted as LocalFilePath by CompressOutput and DecompressGzip. Not used for StdoutPath.
+	AdditionalPaths []string
+	// AllowHTML downloads an HTML page even if Config.RejectHTMLResponses is set.
+	AllowHTML bool
+	// Accept is set to Accept header of HEAD and GET requests, ex. application/octet-stream to avoid an HTML page of
+	// a content-negotiating endpoint. Default is Config.Accept. Accept in Header takes precedence over it.
+	Accept string
+	// Method is the HTTP method of the request, ex. POST to a report generation endpoint returning the file. Default is GET.
+	// Requests other than GET send Body, and they are not deduplicated, resumed or sent HEAD requests.
+	// Their sizes are told by the responses as SingleRequestMode.
+	Method string
+	// Body is sent with the request of Method, and sent again on retries.
+	Body []byte
+	// KnownSize is the size of the file used for progress and SkipCompleted instead of Content-Length of the server,
+	// for servers telling wrong size or no size. 0 means the size told by the server is used.
+	KnownSize int64
+	// MaxRetry is the retry count of the file instead of Config.MaxRetry, ex. more retries for a critical file
+	// and 0 for an optional one. Default is nil, Config.MaxRetry is used. Config.MaxTotalRetries still limits it.
+	MaxRetry *int
+	writer   io.Writer // written instead of stdout by DownloadToWriter
 }
 
 // ErrDownload error component of downloader
@@ -61,7 +341,10 @@ func New(config *Config) *FileDownloader {
 	if config.MaxDownloadThreads == 0 {
 		panic(`Check Configuration again. You can't download file if MaxDownloadThreads is 0`)
 	}
-	instance := &FileDownloader{conf: config}
+	if !isKnownSmoothing(config.SpeedSmoothing) {
+		panic(`Check Configuration again. Unknown SpeedSmoothing ` + string(config.SpeedSmoothing))
+	}
+	instance := &FileDownloader{conf: config, finished: make(chan struct{}), client: newHTTPClient(config), inFlightReleased: make(chan struct{}, 1)}
 	// set default logger if not configured log function is not set.
 	if config.logfunc == nil {
 		instance.logfunc = fdlLog
@@ -71,11 +354,18 @@ func New(config *Config) *FileDownloader {
 	}
 	// create progress channels
 	if instance.conf.RequiresDetailProgress {
-		progress := make(chan float64, 10)
-		speed := make(chan int64, 10)
+		progress := make(chan float64, instance.progressBuffer())
+		speed := make(chan int64, instance.progressBuffer())
 		instance.ProgressChan = progress
 		instance.DownloadBytesPerSecond = speed
 	}
+	if instance.conf.OrderedEvents {
+		instance.Events = make(chan Event, instance.progressBuffer())
+	}
+	instance.buffers.New = func() interface{} {
+		buf := make([]byte, instance.bufferSize())
+		return &buf
+	}
 	instance.State = StateReady
 	return instance
 }
@@ -90,121 +380,414 @@ func (m *FileDownloader) SimpleFileDownload(url, localFilePath string) error {
 	var list []*Download
 	list = append(list, &d)
 	// very simple single file download
-	m.downloadFiles(list)
+	m.downloadFiles(context.Background(), list)
 	return m.err
 }
 
 // MultipleFileDownload downloads multiple files at parallel in configured download threads.
 func (m *FileDownloader) MultipleFileDownload(downloads []*Download) error {
+	return m.MultipleFileDownloadContext(context.Background(), downloads)
+}
+
+// MultipleFileDownloadContext is MultipleFileDownload which stops downloading when ctx is done.
+func (m *FileDownloader) MultipleFileDownloadContext(ctx context.Context, downloads []*Download) error {
 	if m.State != StateReady {
 		panic(`filedownloader has already started or done`)
 	}
 	m.State = StateDownloading
-	m.downloadFiles(downloads)
+	m.downloadFiles(ctx, downloads)
 	return m.err
 }
 
-func (m *FileDownloader) downloadFiles(downloads []*Download) {
+func (m *FileDownloader) downloadFiles(parent context.Context, downloads []*Download) {
+	defer close(m.finished)
 	defer func() {
 		m.State = StateDone
 	}()
+	if m.conf.OrderedEvents {
+		events := make(chan Event)
+		m.events = events
+		dispatched := m.dispatchEvents(events)
+		// all events are delivered before the download ends
+		defer func() {
+			close(events)
+			m.events = nil
+			<-dispatched
+		}()
+	}
+	m.mu.Lock()
+	if m.batch == nil {
+		m.batch = downloads
+	}
+	m.mu.Unlock()
+	// collided path is not a duplicate, it would replace the file of the same URL on a case-insensitive file system
+	collisions := m.caseCollisions(downloads)
+	// same URL is downloaded only once
+	downloads = m.deduplicate(downloads, collisions)
+	m.setLocalPaths(downloads)
+	m.prepareCASRoot()
 	downloadFilesCnt := len(downloads)
 	m.logfunc(`Download Files: ` + strconv.Itoa(downloadFilesCnt))
 	// context for cancel and timeout
-	ctx, timeoutFunc := context.WithTimeout(context.Background(), time.Minute*time.Duration(m.conf.DownloadTimeoutMinutes))
+	ctx, timeoutFunc := context.WithTimeout(parent, m.batchTimeout())
 	defer timeoutFunc()
+	// download context, cancelled by Cancel or MaxTotalBytes
+	ctx3, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+	m.mu.Lock()
+	m.cancelBatch = cancelFunc
+	m.mu.Unlock()
+	m.Cancel = func() {
+		atomic.StoreInt32(&m.cancelled, 1)
+		cancelFunc()
+	}
+	// CancelAndCleanup may be called before the context is created
+	if atomic.LoadInt32(&m.cancelled) == 1 {
+		cancelFunc()
+	}
 	// if the url allows head access and returns Content-Length, we can calculate progress of downloading files.
 	var resumableUrls = make(map[string]*resumeInfo)
+	// files whose sizes are told by the responses
+	sizesPending := false
 	for _, d := range downloads {
-		size, resumable, err := getFileSizeAndResumable(d.URL)
-		if err != nil || size < 0 {
-			panic(`Could not get whole size of the downloading file. No progress value is available`)
+		// HEAD requests are bounded by the timeout and cancel, downloads of the rest fail soon as cancelled.
+		// sizes are told by the responses in SingleRequestMode and of the requests with a body.
+		if ctx3.Err() != nil || m.sizeFromResponse(d) {
+			if _, ok := resumableUrls[d.URL]; !ok || !d.hasBody() {
+				resumableUrls[d.URL] = &resumeInfo{contentLength: -1}
+			}
+			if ctx3.Err() == nil && d.KnownSize > 0 {
+				m.TotalFilesSize += d.KnownSize
+			} else if ctx3.Err() == nil {
+				sizesPending = true
+			}
+			continue
+		}
+		info, err := m.getResumeInfo(ctx3, d.URL, m.requestHeader(d))
+		// server may refuse HEAD, ex. 405. the file is downloaded by GET, which tells the error if it is missing.
+		var statusErr *DownloadError
+		if errors.As(err, &statusErr) && statusErr.StatusCode != 0 {
+			m.logfunc(`Could not get file size[`+d.URL+`]`, err)
+			info, err = &resumeInfo{contentLength: -1}, nil
+		}
+		// download refused by PinnedCertSHA256 or insecure redirect fails with the same error,
+		// and network errors are returned as the error of the file by GET request.
+		if err != nil {
+			m.logfunc(`Could not get file size[`+d.URL+`]`, err)
+			resumableUrls[d.URL] = &resumeInfo{contentLength: -1}
+			continue
 		}
-		m.TotalFilesSize += size
-		resumableUrls[d.URL] = &resumeInfo{isResumable: resumable, contentLength: size}
+		// server may send the body until closing connection without Content-Length.
+		if info.contentLength < 0 {
+			info.isResumable = false
+		}
+		switch {
+		case d.KnownSize > 0:
+			m.TotalFilesSize += d.KnownSize
+		case info.contentLength < 0:
+			m.logfunc(`File size is unknown, only download speed is reported[` + d.URL + `]`)
+			m.unknownSize = true
+		default:
+			m.TotalFilesSize += info.contentLength
+		}
+		resumableUrls[d.URL] = info
+	}
+	if ctx3.Err() == nil && !sizesPending {
+		m.totalSizeKnown(downloadFilesCnt)
+	}
+	// connections to many hosts are kept idle after HEAD requests
+	if m.conf.MaxOpenFiles > 0 {
+		m.client.CloseIdleConnections()
 	}
 	// count up downloaded bytes from download goroutines
-	var downloadedBytes = make(chan int)
+	var downloadedBytes = make(chan fileBytes)
 	defer close(downloadedBytes)
-	// observe progress
-	m.progressObserver(ctx, downloadedBytes)
+	files := make([]*fileProgress, downloadFilesCnt)
+	for i, d := range downloads {
+		total := resumableUrls[d.URL].contentLength
+		if d.hasBody() {
+			total = -1
+		}
+		if d.KnownSize > 0 {
+			total = d.KnownSize
+		}
+		files[i] = &fileProgress{index: i, download: d, localPath: d.LocalFilePath, total: total, sizePending: m.sizeFromResponse(d) && d.KnownSize <= 0, err: collisions[d]}
+	}
+	m.skipCompleted(files)
+	m.askShouldDownload(files, resumableUrls)
+	settleSkippedSizes(files)
+	// observe progress until all download goroutines end, they may send bytes even after timeout.
+	observerCtx, stopObserver := context.WithCancel(context.Background())
+	defer stopObserver()
 	m.logfunc(fmt.Sprintf("Total Download Bytes:: %d", m.TotalFilesSize))
+	observerDone := m.progressObserver(observerCtx, downloadedBytes, files)
 	// Limit maximum download goroutines since network resource is not inifinite.
-	dlCond := sync.NewCond(&sync.Mutex{})
-	currentThreadCnt := 0
+	threads := make(chan struct{}, m.downloadThreads())
 	var wg sync.WaitGroup
-	// download context
-	ctx2, timeoutFunc := context.WithTimeout(ctx, time.Minute*time.Duration(m.conf.DownloadTimeoutMinutes))
-	defer timeoutFunc()
-	ctx3, cancelFunc := context.WithCancel(ctx2)
-	defer cancelFunc()
-	m.Cancel = cancelFunc
+	var errMu sync.Mutex
+	// results of the files not cancelled, nil if succeeded
+	fileErrs := make(map[*Download]error)
+	m.failBeforeStart(files, fileErrs)
+	failed := false
+	pacer := newLaunchPacer(m.conf.MaxFilesPerSecond)
 	// Downlaoding Files
-	for i := 0; i < downloadFilesCnt; i++ {
-		url := downloads[i].URL
-		localPath := downloads[i].LocalFilePath
+	m.setQueue(files)
+	sizeErr := m.checkExpectedTotal(ctx3, files)
+	if sizeErr != nil {
+		m.logfunc(`Total size is not the expected size, files are not downloaded.`, sizeErr)
+		for _, f := range m.drainQueue() {
+			f.err = sizeErr
+			m.resolvePendingSize(downloadedBytes, f)
+			m.sendResult(f.download, ``, f.err)
+		}
+	}
+	for m.queued() > 0 {
+		// wait for a free thread
+		threads <- struct{}{}
+		// cancelled download fails soon in the goroutine, so the result of wait is not needed here.
+		m.waitResume(ctx3)
+		m.waitWindow(ctx3)
+		pacer.wait(ctx3)
+		// file to download is taken after waits, so that Prioritize while waiting is applied.
+		progress := m.dequeue()
+		if m.reachedMaxTotalBytes() {
+			m.logfunc(`Reached to MaxTotalBytes, rest of the files are not downloaded.`)
+			for _, f := range append([]*fileProgress{progress}, m.drainQueue()...) {
+				m.addRemaining(f.download)
+				f.err = ErrMaxTotalBytes
+				m.resolvePendingSize(downloadedBytes, f)
+				m.sendResult(f.download, ``, f.err)
+			}
+			break
+		}
+		if err := m.checkFreeSpace(m.downloadDir(progress.download)); err != nil {
+			m.logfunc(`Free disk space is short, rest of the files are not downloaded.`, err)
+			m.setSpaceErr(err)
+			for _, f := range append([]*fileProgress{progress}, m.drainQueue()...) {
+				f.err = err
+				m.resolvePendingSize(downloadedBytes, f)
+				m.sendResult(f.download, ``, f.err)
+			}
+			break
+		}
+		m.reserveInFlight(ctx3, progress)
+		d := progress.download
+		url := d.URL
 		resume, ok := resumableUrls[url]
-		useResume := resume.isResumable && ok
+		useResume := resume.isResumable && ok && m.conf.ResumeFromPartial
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			defer dlCond.Signal()
-			downloadFile(ctx3, url, localPath, downloadedBytes, useResume, resume.contentLength, m.logfunc)
+			defer func() { <-threads }()
+			atomic.StoreInt32(&progress.status, fileDownloading)
+			defer atomic.StoreInt32(&progress.status, fileDone)
+			m.emitEvent(Event{Type: EventFileStart, Download: d})
+			m.waitStartJitter(ctx3)
+			atomic.AddInt32(&m.active, 1)
+			defer atomic.AddInt32(&m.active, -1)
+			defer m.releaseInFlight(progress, progress.total)
+			fileCtx, cancelFile := m.fileContext(ctx3)
+			defer cancelFile()
+			fileCtx, span := m.startSpan(fileCtx, progress)
+			err := m.downloadRecovered(fileCtx, d, downloadedBytes, progress, useResume, resume)
+			err = fileTimeoutError(ctx3, fileCtx, d, err)
+			m.resolvePendingSize(downloadedBytes, progress)
+			var additional []string
+			if err == nil {
+				additional, err = m.linkAdditionalPaths(d, progress.localPath, progress.savedPath)
+				progress.copies = append(progress.copies, additional...)
+				// path decided by the response is told to the caller who gave no path
+				if d.LocalFilePath == `` {
+					d.LocalFilePath = progress.localPath
+				}
+			}
+			// errors of cancelled downloads are not failures of the file.
+			if err != nil && ctx3.Err() != nil {
+				if m.reachedMaxTotalBytes() {
+					m.addRemaining(d)
+				}
+			} else {
+				if err != nil {
+					m.logfunc(err)
+				}
+				errMu.Lock()
+				fileErrs[d] = err
+				if err != nil && !failed {
+					failed = true
+					if m.conf.FailFast {
+						m.logfunc(`FailFast is enabled, stop other downloads.`)
+						cancelFunc()
+					}
+				}
+				errMu.Unlock()
+			}
+			progress.err = err
+			endSpan(span, progress, err, ctx3.Err() != nil)
+			m.recordFileMetrics(err, ctx3.Err() != nil)
+			m.sendResultPaths(d, progress.savedPath, additional, progress.retries, progress.sha256, err)
 		}()
-		currentThreadCnt++
-		// stop for loop when reached to max threads.
-		dlCond.L.Lock()
-		if m.conf.MaxDownloadThreads < currentThreadCnt {
-			m.logfunc(`Cond locked. download goroutine reached to max`)
-			dlCond.Wait()
-			m.logfunc(`Cond released. goes to next file download if more.`)
-			currentThreadCnt--
-		}
-		dlCond.L.Unlock()
 	}
 	m.logfunc(`Wait group is waiting for download.`)
 	// wait for all download ends.
 	wg.Wait()
-	// at last get the context error
-	m.err = ctx.Err()
+	// let observer report the last progress
+	stopObserver()
+	<-observerDone
+	m.err = m.aggregateErrors(fileErrs)
+	// put downloaded files to the paths of duplicated downloads
+	if err := m.copyToDuplicates(files); err != nil && m.err == nil {
+		m.err = err
+	}
+	if m.conf.WriteChecksumManifest != `` {
+		if err := m.writeChecksumManifest(files); err != nil {
+			m.logfunc(`Could not write checksum manifest`, err)
+			if m.err == nil {
+				m.err = err
+			}
+		}
+	}
+	// at last get the context error, errors of failed files are kept with it
+	if err := ctx.Err(); err != nil {
+		m.ctxErr = err
+		m.err = joinErrors(m.err, err)
+	}
+	if atomic.LoadInt32(&m.cleanup) == 1 {
+		m.removePartFiles(files)
+	}
+	if atomic.LoadInt32(&m.suspended) == 1 {
+		m.suspendErr = m.writeSuspendedMeta(files, resumableUrls)
+	}
+	if err := m.getSpaceErr(); err != nil && m.err == nil {
+		m.err = err
+	}
+	if sizeErr != nil && m.err == nil {
+		m.err = sizeErr
+	}
+	if m.err == nil && len(m.Remaining()) > 0 {
+		m.err = ErrMaxTotalBytes
+	}
+	m.outcome = m.decideOutcome(ctx)
 	m.logfunc(`All Download Task Done.`)
 }
 
-func (m *FileDownloader) progressObserver(ctx context.Context, downloadedBytes <-chan int) {
+// observer goroutine runs until ctx is done, returned channel is closed when it finished.
+func (m *FileDownloader) progressObserver(ctx context.Context, downloadedBytes <-chan fileBytes, files []*fileProgress) <-chan struct{} {
+	done := make(chan struct{})
 	var totaloDownloadedBytes int64
+	// files whose sizes are told by responses in SingleRequestMode
+	pendingSizes := 0
+	// files skipped by SkipCompleted are already downloaded
+	for _, f := range files {
+		totaloDownloadedBytes += f.downloaded
+		if f.sizePending {
+			pendingSizes++
+		}
+	}
 	m.logfunc(`Total File Size from HTTP head Info::` + strconv.Itoa(int(m.TotalFilesSize)))
 	// every second, print how many bytes downloaded.
-	ticker := time.NewTicker(time.Second)
+	ticker := time.NewTicker(progressInterval)
 	go func() {
-		defer close(m.ProgressChan)
-		defer close(m.DownloadBytesPerSecond)
+		defer close(done)
 		defer ticker.Stop()
-		var lastProgress int64
+		// progress channels exist only when RequiresDetailProgress is true.
+		if m.conf.RequiresDetailProgress {
+			defer close(m.ProgressChan)
+			defer close(m.DownloadBytesPerSecond)
+		}
+		lastProgress := totaloDownloadedBytes
+		smoother := newSpeedSmoother(m.conf)
+		lastTick, lastPaused := time.Now(), m.pausedDuration()
+		// rate per interval of active time, paused time since last report is excluded.
+		// returns false if almost whole time was paused.
+		activeRate := func() (func(bytes int64) int64, bool) {
+			now, pausedTotal := time.Now(), m.pausedDuration()
+			paused := pausedTotal - lastPaused
+			active := now.Sub(lastTick) - paused
+			if paused > 0 && active < progressInterval/10 {
+				return func(bytes int64) int64 { return bytes }, false
+			}
+			lastTick, lastPaused = now, pausedTotal
+			if paused <= 0 {
+				return func(bytes int64) int64 { return bytes }, true
+			}
+			return func(bytes int64) int64 { return bytes * int64(progressInterval) / int64(active) }, true
+		}
 	LOOP:
 		for {
 			select {
 			case <-ticker.C:
-				sub := totaloDownloadedBytes - lastProgress
+				rate, ok := activeRate()
+				if !ok {
+					continue
+				}
+				sub := rate(totaloDownloadedBytes - lastProgress)
 				m.logfunc(fmt.Sprintf(`downloaded %d bytes per second, downloaded %d / %d`, sub, totaloDownloadedBytes, m.TotalFilesSize))
 				lastProgress = totaloDownloadedBytes
+				m.callRecovered(`MetricsRecorder`, func() { m.metrics().ObserveRate(sub) })
+				m.addThroughputSample(sub)
+				speed := smoother.add(sub)
+				// progress should be between 0.0 to 1.0.
+				p, available := -1.0, true
+				if !m.unknownSize && pendingSizes == 0 {
+					p = float64(totaloDownloadedBytes) / float64(m.TotalFilesSize)
+				} else if m.unknownSize {
+					// bytes of the batch are unknown, count files instead
+					p = doneFileFraction(files)
+				} else {
+					available = false
+				}
 				if m.conf.RequiresDetailProgress {
-					m.DownloadBytesPerSecond <- sub
-					// send progress value to channel. progress should be between 0.0 to 1.0.
-					p := float64(totaloDownloadedBytes) / float64(m.TotalFilesSize)
-					m.ProgressChan <- p
+					m.sendSpeed(speed)
+					// send progress value to channel.
+					if available {
+						m.sendProgress(p)
+					}
 				}
+				m.emitEvent(Event{Type: EventProgress, Progress: p, BytesPerSecond: speed})
+				m.reportFileProgress(files, rate)
+				m.checkFreeSpaceWhileDownloading(files)
+				m.abortSlowDownloads(files)
 			case t := <-downloadedBytes:
-				// m.logfunc(`Incomming bytes :` + strconv.Itoa(t))
-				totaloDownloadedBytes += int64(t)
+				if t.resized {
+					f := files[t.index]
+					if f.total >= 0 {
+						m.TotalFilesSize -= f.total
+					}
+					if t.size < 0 {
+						m.unknownSize = true
+					} else {
+						m.TotalFilesSize += t.size
+					}
+					f.total = t.size
+					continue
+				}
+				if t.sizeKnown {
+					f := files[t.index]
+					f.total, f.sizePending = t.size, false
+					if t.size < 0 {
+						m.unknownSize = true
+					} else {
+						m.TotalFilesSize += t.size
+					}
+					if pendingSizes--; pendingSizes == 0 {
+						m.totalSizeKnown(len(files))
+					}
+					continue
+				}
+				// m.logfunc(`Incomming bytes :` + strconv.Itoa(t.n))
+				totaloDownloadedBytes += int64(t.n)
+				m.callRecovered(`MetricsRecorder`, func() { m.metrics().AddBytes(int64(t.n)) })
+				files[t.index].downloaded += int64(t.n)
 			case <-ctx.Done():
+				rate, _ := activeRate()
+				m.reportFileProgress(files, rate)
 				m.logfunc(`Progress Observer Done.`)
 				break LOOP
-			default:
-				// noting to do
 			}
 		}
 		m.logfunc(`Filedownloader progress observer finished`)
 	}()
+	return done
 }
 
 func fdlLog(param ...interface{}) {
@@ -214,4 +797,6 @@ func fdlLog(param ...interface{}) {
 type resumeInfo struct {
 	isResumable   bool
 	contentLength int64
+	etag          string
+	header        http.Header // headers of HEAD response, nil if HEAD request was not sent
 }
@@ -1,33 +1,58 @@
 package filedownloader
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"os/user"
-	_ "strconv"
-	_ "sync"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/chixm/filedownloader/internal/testutil"
 )
 
 // filedownloader test
 
 func TestSimpleSingleDownload(t *testing.T) {
+	server := testutil.NewServer([]byte(`<html><body>fuso</body></html>`), testutil.Behavior{})
+	defer server.Close()
 	fdl := New(nil)
-	user, _ := user.Current()
-	err := fdl.SimpleFileDownload(`https://golang.org/pkg/net/http/`, user.HomeDir+`/fuso.html`)
+	err := fdl.SimpleFileDownload(server.URL+`/pkg/net/http/`, filepath.Join(t.TempDir(), `fuso.html`))
 	if err != nil {
 		t.Error(err)
 	}
 }
 
 func TestMultipleFilesDownload(t *testing.T) {
+	server := testutil.NewServer(bytes.Repeat([]byte(`ugin`), 10000), testutil.Behavior{})
+	defer server.Close()
 	fdl := New(nil)
-	user, _ := user.Current()
+	dir := t.TempDir()
 	// Download Progress Observer
 	var downloadFiles []*Download
-	downloadFiles = append(downloadFiles, &Download{URL: `https://files.hareruyamtg.com/img/goods/L/M21/EN/0001.jpg`, LocalFilePath: user.HomeDir + `/ugin.jpg`})
-	downloadFiles = append(downloadFiles, &Download{URL: `https://files.hareruyamtg.com/img/goods/L/ELD/EN/BRAWL0329.jpg`, LocalFilePath: user.HomeDir + `/korvold.jpg`})
+	downloadFiles = append(downloadFiles, &Download{URL: server.URL + `/M21/EN/0001.jpg`, LocalFilePath: filepath.Join(dir, `ugin.jpg`)})
+	downloadFiles = append(downloadFiles, &Download{URL: server.URL + `/ELD/EN/BRAWL0329.jpg`, LocalFilePath: filepath.Join(dir, `korvold.jpg`)})
 	err := fdl.MultipleFileDownload(downloadFiles)
 	if err != nil {
 		t.Error(err)
@@ -40,26 +65,34 @@ func TestFloatProgressCalc(t *testing.T) {
 }
 
 func TestExternalLogFunction(t *testing.T) {
+	server := testutil.NewServer([]byte(`<html><body>fuso</body></html>`), testutil.Behavior{})
+	defer server.Close()
 	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 3}
 	fileDownloader := New(&conf)
-	// downloading to use home
-	user, _ := user.Current()
-	fileDownloader.SimpleFileDownload(`https://golang.org/pkg/net/http/`, user.HomeDir+`/fuso.html`)
+	fileDownloader.SimpleFileDownload(server.URL+`/pkg/net/http/`, filepath.Join(t.TempDir(), `fuso.html`))
+}
+
+// server sending the content slowly, about 100KB per second
+func slowServer(size int) *testutil.Server {
+	return testutil.NewServer(bytes.Repeat([]byte(`f`), size), testutil.Behavior{ChunkSize: 1024, ChunkWait: 10 * time.Millisecond})
 }
 
 func TestCancelWhileDownloading(t *testing.T) {
-	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 3, MaxRetry: 3}
+	server := slowServer(10 * 1024 * 1024)
+	defer server.Close()
+	started := make(chan struct{}, 1)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 3, MaxRetry: 3,
+		OnResponse: func(d *Download, resp *http.Response) { started <- struct{}{} }}
 	fileDownloader := New(&conf)
-	// downloading to use home
-	user, _ := user.Current()
 	go func() {
-		// stops downloading after 100 seconds
-		time.Sleep(100 * time.Second)
+		// stops downloading 300 milliseconds after it started
+		<-started
+		time.Sleep(300 * time.Millisecond)
 		// wait and cancel
 		fileDownloader.Cancel()
 	}()
-	// test download file 512MB
-	err := fileDownloader.SimpleFileDownload(`http://ipv4.download.thinkbroadband.com/512MB.zip`, user.HomeDir+`/512.zip`)
+	// test download file 10MB
+	err := fileDownloader.SimpleFileDownload(server.URL+`/10MB.zip`, filepath.Join(t.TempDir(), `10.zip`))
 	if err != nil {
 		t.Error(err)
 	}
@@ -70,59 +103,72 @@ func TestCancelWhileDownloading(t *testing.T) {
 }
 
 func TestFileDownloadWithDetailedConfiguration(t *testing.T) {
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = 50 * time.Millisecond
+	server := slowServer(50 * 1024)
+	defer server.Close()
 	// default setting of RequiresDetailProgress is false, you need to set it true if you need download progress.
 	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 3, MaxRetry: 3, RequiresDetailProgress: true}
 	fileDownloader := New(&conf)
 
-	done := make(chan int)
+	done := make(chan struct{})
 	// if you set RequiresDetailProgress = true, you can receive progress from channel
 	go func() {
-	LOOP:
-		for {
+		defer close(done)
+		speeds, progresses := fileDownloader.DownloadBytesPerSecond, fileDownloader.ProgressChan
+		// channels are closed when the download ends
+		for speeds != nil || progresses != nil {
 			select {
-			case speed := <-fileDownloader.DownloadBytesPerSecond:
+			case speed, ok := <-speeds:
+				if !ok {
+					speeds = nil
+					continue
+				}
 				// DownloadBytesPerSecond Channel can receive how fast the download is running.
 				log.Println(fmt.Sprintf(`%d bytes/sec`, speed))
-			case progress := <-fileDownloader.ProgressChan:
+			case progress, ok := <-progresses:
+				if !ok {
+					progresses = nil
+					continue
+				}
 				// Progress Channel (ProgressChan) receives how much download has progressed.
 				log.Println(fmt.Sprintf(`%f percent has done`, progress*100)) // ex. 10.5 percent has done
-			case <-done:
-				break LOOP // escape from forever loop
 			}
 		}
 		log.Println(`end of Observe loop`)
 	}()
 
-	// downloading file to use home directory
-	user, _ := user.Current()
-	// test download file 512MB
-	err := fileDownloader.SimpleFileDownload(`http://ipv4.download.thinkbroadband.com/512MB.zip`, user.HomeDir+`/512.zip`)
+	// test download file 50KB
+	err := fileDownloader.SimpleFileDownload(server.URL+`/50KB.zip`, filepath.Join(t.TempDir(), `50.zip`))
 	if err != nil {
 		t.Error(err)
-		done <- 1
 	}
 	if fileDownloader.err != nil {
 		t.Error(fileDownloader.err)
 	}
-	done <- 0
+	<-done
 	t.Log(`Test Done`)
 }
 
 func TestMultiFileDownloadCancelWhileDownloading(t *testing.T) {
-	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 3, MaxRetry: 3}
+	server := slowServer(10 * 1024 * 1024)
+	defer server.Close()
+	started := make(chan struct{}, 2)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 3, MaxRetry: 3,
+		OnResponse: func(d *Download, resp *http.Response) { started <- struct{}{} }}
 	fileDownloader := New(&conf)
-	// downloading to use home
-	user, _ := user.Current()
+	dir := t.TempDir()
 	go func() {
-		// stops downloading after 100 seconds
-		time.Sleep(10 * time.Second)
+		// stops downloading 300 milliseconds after it started
+		<-started
+		time.Sleep(300 * time.Millisecond)
 		// wait and cancel
 		fileDownloader.Cancel()
 	}()
 	var downloadFiles []*Download
-	downloadFiles = append(downloadFiles, &Download{URL: "http://ipv4.download.thinkbroadband.com/512MB.zip", LocalFilePath: user.HomeDir + `/512.zip`})
-	downloadFiles = append(downloadFiles, &Download{URL: "http://ipv4.download.thinkbroadband.com/200MB.zip", LocalFilePath: user.HomeDir + `/200.zip`})
-	// test download file 512MB
+	downloadFiles = append(downloadFiles, &Download{URL: server.URL + `/10MB.zip`, LocalFilePath: filepath.Join(dir, `10.zip`)})
+	downloadFiles = append(downloadFiles, &Download{URL: server.URL + `/20MB.zip`, LocalFilePath: filepath.Join(dir, `20.zip`)})
+	// test download files of 10MB
 	err := fileDownloader.MultipleFileDownload(downloadFiles)
 	if err != nil {
 		t.Error(err)
@@ -138,11 +184,4029 @@ func myLogger(params ...interface{}) {
 }
 
 func TestFileExists(t *testing.T) {
-	user, _ := user.Current()
-	bytes, err := getFileStartOffset(user.HomeDir + `/512.zip`)
+	localPath := filepath.Join(t.TempDir(), `512.zip`)
+	if _, err := getFileStartOffset(localPath); err == nil {
+		t.Error(`missing file should fail`)
+	}
+	ioutil.WriteFile(localPath, []byte(`fuso`), 0644)
+	bytes, err := getFileStartOffset(localPath)
+	if err != nil || bytes != 4 {
+		t.Errorf(`expected 4 bytes but %d %v`, bytes, err)
+	}
+}
+
+func TestPathFuncDecidesLocalFilePath(t *testing.T) {
+	content := []byte(`file util for simple object`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Disposition`, `attachment; filename="fuso.txt"`)
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1,
+		PathFunc: func(url string, resp *http.Response) (string, error) {
+			_, params, err := mime.ParseMediaType(resp.Header.Get(`Content-Disposition`))
+			if err != nil {
+				return ``, err
+			}
+			return filepath.Join(dir, params[`filename`]), nil
+		}}
+	fileDownloader := New(&conf)
+	d := &Download{URL: server.URL}
+	if err := fileDownloader.MultipleFileDownload([]*Download{d}); err != nil {
+		t.Fatal(err)
+	}
+	if d.LocalFilePath != filepath.Join(dir, `fuso.txt`) {
+		t.Fatalf(`unexpected local path %s`, d.LocalFilePath)
+	}
+	b, err := ioutil.ReadFile(d.LocalFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf(`downloaded content mismatch: %s`, b)
+	}
+}
+
+func TestDownloadErrorHasStatusCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Length`, `9`)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`forbidden`))
+	}))
+	defer server.Close()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	fileDownloader := New(&conf)
+	err := fileDownloader.SimpleFileDownload(server.URL, filepath.Join(t.TempDir(), `forbidden.html`))
+	if !errors.Is(err, ErrDownload) {
+		t.Fatalf(`expected ErrDownload but got %v`, err)
+	}
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) {
+		t.Fatalf(`expected DownloadError but got %v`, err)
+	}
+	if downloadErr.StatusCode != http.StatusForbidden || downloadErr.URL != server.URL {
+		t.Errorf(`unexpected error content %+v`, downloadErr)
+	}
+}
+
+func TestDownloadThroughTempDir(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/broken` && r.Method == `GET` {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	tempDir := t.TempDir()
+	localDir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, TempDir: tempDir}
+	if err := New(&conf).SimpleFileDownload(server.URL+`/fuso`, filepath.Join(localDir, `fuso.bin`)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(localDir, `fuso.bin`))
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf(`downloaded file is not moved from temp dir: %v`, err)
+	}
+	if err := New(&conf).SimpleFileDownload(server.URL+`/broken`, filepath.Join(localDir, `broken.bin`)); err == nil {
+		t.Fatal(`expected error for broken url`)
+	}
+	files, _ := ioutil.ReadDir(tempDir)
+	if len(files) != 0 {
+		t.Errorf(`temp files are left: %d`, len(files))
+	}
+}
+
+func TestCompressOutput(t *testing.T) {
+	content := bytes.Repeat([]byte(`file util for simple object `), 512)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso.txt`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, CompressOutput: true}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(localPath + `.gz`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil || !bytes.Equal(b, content) {
+		t.Errorf(`compressed content mismatch: %v`, err)
+	}
+}
+
+func TestOnResponseHook(t *testing.T) {
+	content := []byte(`fuso`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Server`, `fuso-test`)
+		w.Header().Set(`Content-Length`, strconv.Itoa(len(content)))
+		w.Write(content)
+	}))
+	defer server.Close()
+	var serverName string
+	var status int
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1,
+		OnResponse: func(d *Download, resp *http.Response) {
+			serverName = resp.Header.Get(`Server`)
+			status = resp.StatusCode
+		}}
+	localPath := filepath.Join(t.TempDir(), `fuso.txt`)
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(err)
+	}
+	if serverName != `fuso-test` || status != http.StatusOK {
+		t.Errorf(`unexpected response observed %s %d`, serverName, status)
+	}
+	if b, _ := ioutil.ReadFile(localPath); !bytes.Equal(b, content) {
+		t.Errorf(`body was consumed by hook: %s`, b)
+	}
+}
+
+func TestResumeFromPartialAfterInterruption(t *testing.T) {
+	// use small buffer so that small test file is treated as resumable file.
+	defer func(size int) { copyBufferSize = size }(copyBufferSize)
+	copyBufferSize = 64
+	content := bytes.Repeat([]byte(`0123456789`), 20000)
+	var getCount int
+	var rangeHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`ETag`, `"fuso"`)
+		if r.Method == `GET` {
+			getCount++
+			if getCount == 1 {
+				// send half of the file and cut the connection
+				w.Header().Set(`Content-Length`, strconv.Itoa(len(content)))
+				w.Write(content[:len(content)/2])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			rangeHeader = r.Header.Get(`Range`)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso.bin`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, ResumeFromPartial: true}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err == nil {
+		t.Fatal(`expected error for interrupted download`)
+	}
+	if _, err := os.Stat(localPath + `.part`); err != nil {
+		t.Fatal(`partial file is not kept:`, err)
+	}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(err)
+	}
+	if rangeHeader == `` || strings.HasPrefix(rangeHeader, `bytes=0-`) {
+		t.Errorf(`download is not resumed, range header: %q`, rangeHeader)
+	}
+	b, err := ioutil.ReadFile(localPath)
+	if err != nil || !bytes.Equal(b, content) {
+		t.Errorf(`resumed file is broken: %v`, err)
+	}
+	if _, err := os.Stat(localPath + `.part`); !os.IsNotExist(err) {
+		t.Error(`partial file is left after download`)
+	}
+}
+
+func TestResumeRemoteFileChanged(t *testing.T) {
+	// use small buffer so that small test file is treated as resumable file.
+	defer func(size int) { copyBufferSize = size }(copyBufferSize)
+	copyBufferSize = 64
+	oldContent := bytes.Repeat([]byte(`0123456789`), 20000)
+	newContent := bytes.Repeat([]byte(`9876543210`), 25000)
+	var mu sync.Mutex
+	var getCount int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set(`ETag`, `"fuso"`)
+		// HEAD tells the old size, the file is changed before the resumed GET
+		if r.Method == `HEAD` {
+			w.Header().Set(`Accept-Ranges`, `bytes`)
+			w.Header().Set(`Content-Length`, strconv.Itoa(len(oldContent)))
+			return
+		}
+		getCount++
+		if getCount == 1 {
+			w.Header().Set(`Content-Length`, strconv.Itoa(len(oldContent)))
+			w.Write(oldContent[:len(oldContent)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(newContent))
+	}))
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso.bin`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, ResumeFromPartial: true}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err == nil {
+		t.Fatal(`expected error for interrupted download`)
+	}
+	fd := New(&conf)
+	if err := fd.SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(localPath); !bytes.Equal(b, newContent) {
+		t.Errorf(`changed file is not downloaded from start, %d bytes`, len(b))
+	}
+	if fd.TotalFilesSize != int64(len(newContent)) {
+		t.Errorf(`expected total size %d but %d`, len(newContent), fd.TotalFilesSize)
+	}
+	if getCount != 3 {
+		t.Errorf(`expected 3 GET requests but %d`, getCount)
+	}
+}
+
+func TestResumeServerIgnoringRange(t *testing.T) {
+	// use small buffer so that small test file is treated as resumable file.
+	defer func(size int) { copyBufferSize = size }(copyBufferSize)
+	copyBufferSize = 64
+	content := bytes.Repeat([]byte(`0123456789`), 20000)
+	var mu sync.Mutex
+	var getCount int
+	var rangeHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set(`ETag`, `"fuso"`)
+		w.Header().Set(`Accept-Ranges`, `bytes`)
+		w.Header().Set(`Content-Length`, strconv.Itoa(len(content)))
+		if r.Method == `HEAD` {
+			return
+		}
+		getCount++
+		if getCount == 1 {
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		// whole file with 200 for the ranged request
+		rangeHeader = r.Header.Get(`Range`)
+		w.Write(content)
+	}))
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso.bin`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, ResumeFromPartial: true}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err == nil {
+		t.Fatal(`expected error for interrupted download`)
+	}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(err)
+	}
+	if rangeHeader == `` || strings.HasPrefix(rangeHeader, `bytes=0-`) {
+		t.Errorf(`download is not resumed, range header: %q`, rangeHeader)
+	}
+	if b, _ := ioutil.ReadFile(localPath); !bytes.Equal(b, content) {
+		t.Errorf(`whole file is appended to the partial file, %d bytes`, len(b))
+	}
+	if getCount != 2 {
+		t.Errorf(`response of the whole file should be used, %d GET requests`, getCount)
+	}
+}
+
+func TestFileProgressCallback(t *testing.T) {
+	contents := map[string][]byte{`/ugin`: bytes.Repeat([]byte(`u`), 3000), `/korvold`: bytes.Repeat([]byte(`k`), 5000)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(contents[r.URL.Path]))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var mu sync.Mutex
+	lastBytes := make(map[string]int64)
+	var speedSum int64
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1,
+		OnFileProgress: func(d *Download, downloaded, total, bytesPerSecond int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			if downloaded > total {
+				t.Errorf(`downloaded %d is larger than total %d`, downloaded, total)
+			}
+			lastBytes[d.URL] = downloaded
+			speedSum += bytesPerSecond
+		}}
+	var downloads []*Download
+	for path := range contents {
+		downloads = append(downloads, &Download{URL: server.URL + path, LocalFilePath: filepath.Join(dir, path[1:])})
+	}
+	if err := New(&conf).MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range contents {
+		if lastBytes[server.URL+path] != int64(len(content)) {
+			t.Errorf(`last progress of %s is %d`, path, lastBytes[server.URL+path])
+		}
+	}
+	if speedSum != 8000 {
+		t.Errorf(`sum of per second bytes %d does not match to downloaded bytes`, speedSum)
+	}
+}
+
+func TestContentDecoders(t *testing.T) {
+	content := []byte(`file util for simple object`)
+	encoded := []byte(base64.StdEncoding.EncodeToString(content))
+	var acceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// pretend base64 is brotli
+		if r.Method == `GET` {
+			acceptEncoding = r.Header.Get(`Accept-Encoding`)
+		}
+		w.Header().Set(`Content-Encoding`, `br`)
+		w.Header().Set(`Content-Length`, strconv.Itoa(len(encoded)))
+		w.Write(encoded)
+	}))
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso.txt`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1,
+		ContentDecoders: map[string]ContentDecoder{`br`: func(r io.Reader) (io.Reader, error) {
+			return base64.NewDecoder(base64.StdEncoding, r), nil
+		}}}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(localPath); !bytes.Equal(b, content) {
+		t.Errorf(`body is not decoded: %s`, b)
+	}
+	if !strings.Contains(acceptEncoding, `br`) {
+		t.Errorf(`br is not in Accept-Encoding: %q`, acceptEncoding)
+	}
+	// without decoder, br body must not be saved as it is.
+	conf.ContentDecoders = nil
+	err := New(&conf).SimpleFileDownload(server.URL, localPath)
+	if !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Errorf(`expected ErrUnsupportedEncoding but got %v`, err)
+	}
+}
+
+func TestDisableAutoDecompress(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(bytes.Repeat([]byte(`fuso`), 1000))
+	zw.Close()
+	var acceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			acceptEncoding = r.Header.Get(`Accept-Encoding`)
+		}
+		// pre-compressed file is always sent encoded
+		w.Header().Set(`Content-Encoding`, `gzip`)
+		w.Header().Set(`Content-Length`, strconv.Itoa(gz.Len()))
+		w.Write(gz.Bytes())
+	}))
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso.gz`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, DisableAutoDecompress: true}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(localPath); !bytes.Equal(b, gz.Bytes()) {
+		t.Errorf(`gzip stream is not saved as it is: %d bytes`, len(b))
+	}
+	if acceptEncoding != `identity` {
+		t.Errorf(`unexpected Accept-Encoding %q`, acceptEncoding)
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 10000)
+	var total int
+	r := NewProgressReader(bytes.NewReader(content), func(n int) { total += n })
+	b, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatal(`content is changed by ProgressReader`, err)
+	}
+	if total != len(content) {
+		t.Errorf(`reported %d bytes but read %d bytes`, total, len(content))
+	}
+}
+
+func TestMaxTotalBytes(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 50000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	newDownloads := func() []*Download {
+		var downloads []*Download
+		for i := 0; i < 3; i++ {
+			downloads = append(downloads, &Download{URL: fmt.Sprintf(`%s/%d`, server.URL, i), LocalFilePath: filepath.Join(dir, strconv.Itoa(i))})
+		}
+		return downloads
+	}
+	// second file exceeds the limit then third file is not downloaded
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxTotalBytes: int64(len(content)) + 1}
+	fileDownloader := New(&conf)
+	downloads := newDownloads()
+	if err := fileDownloader.MultipleFileDownload(downloads); err != ErrMaxTotalBytes {
+		t.Fatalf(`expected ErrMaxTotalBytes but got %v`, err)
+	}
+	remaining := fileDownloader.Remaining()
+	if len(remaining) != 1 || remaining[0] != downloads[2] {
+		t.Errorf(`unexpected remaining files %v`, remaining)
+	}
+	if _, err := os.Stat(downloads[1].LocalFilePath); err != nil {
+		t.Error(`downloading file should finish`, err)
+	}
+	// abort first file
+	conf = Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxTotalBytes: 1000, AbortAtMaxTotalBytes: true}
+	fileDownloader = New(&conf)
+	downloads = newDownloads()
+	if err := fileDownloader.MultipleFileDownload(downloads); err != ErrMaxTotalBytes {
+		t.Fatalf(`expected ErrMaxTotalBytes but got %v`, err)
+	}
+	if remaining := fileDownloader.Remaining(); len(remaining) != 3 {
+		t.Errorf(`all files should remain but %d files`, len(remaining))
+	}
+}
+
+func TestSleepContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	start := time.Now()
+	if sleepContext(ctx, time.Hour) {
+		t.Error(`sleep should be cancelled`)
+	}
+	if time.Since(start) > time.Second {
+		t.Error(`cancel does not stop sleep`)
+	}
+}
+
+func TestStartJitter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var downloads []*Download
+	for i := 0; i < 3; i++ {
+		downloads = append(downloads, &Download{URL: server.URL, LocalFilePath: filepath.Join(dir, strconv.Itoa(i))})
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 3, DownloadTimeoutMinutes: 1, StartJitter: 50 * time.Millisecond}
+	if err := New(&conf).MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range downloads {
+		if _, err := os.Stat(d.LocalFilePath); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/broken` && r.Method == `GET` {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	fileDownloader := New(&conf)
+	if fileDownloader.Outcome() != `` {
+		t.Errorf(`outcome before download should be empty`)
+	}
+	fileDownloader.SimpleFileDownload(server.URL, filepath.Join(dir, `fuso`))
+	if fileDownloader.Outcome() != OutcomeCompleted {
+		t.Errorf(`expected completed but %s`, fileDownloader.Outcome())
+	}
+	fileDownloader = New(&conf)
+	fileDownloader.SimpleFileDownload(server.URL+`/broken`, filepath.Join(dir, `broken`))
+	if fileDownloader.Outcome() != OutcomeFailed {
+		t.Errorf(`expected failed but %s`, fileDownloader.Outcome())
+	}
+}
+
+func TestDownloadWithoutContentLength(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 20000)
+	// old server sends body until it closes connection
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.0 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n")
+		if r.Method == `GET` {
+			buf.Write(content)
+		}
+		buf.Flush()
+	}))
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso.bin`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, RequiresDetailProgress: true}
+	fileDownloader := New(&conf)
+	if err := fileDownloader.SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(localPath); !bytes.Equal(b, content) {
+		t.Errorf(`downloaded file is broken, %d bytes`, len(b))
+	}
+	if _, err := os.Stat(localPath + `.part`); !os.IsNotExist(err) {
+		t.Error(`partial file is left`)
+	}
+	if fileDownloader.TotalFilesSize != 0 {
+		t.Errorf(`unknown size should not be counted %d`, fileDownloader.TotalFilesSize)
+	}
+}
+
+func TestFileFractionProgressOfUnknownSize(t *testing.T) {
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = 20 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/known` {
+			w.Write([]byte(`fuso`))
+			return
+		}
+		// slow body without Content-Length
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.0 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n")
+		buf.Flush()
+		if r.Method == `GET` {
+			for i := 0; i < 10; i++ {
+				buf.WriteString(`fuso`)
+				buf.Flush()
+				time.Sleep(30 * time.Millisecond)
+			}
+		}
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, RequiresDetailProgress: true}
+	fileDownloader := New(&conf)
+	var values []float64
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		for p := range fileDownloader.ProgressChan {
+			values = append(values, p)
+		}
+	}()
+	go func() {
+		for range fileDownloader.DownloadBytesPerSecond {
+		}
+	}()
+	err := fileDownloader.MultipleFileDownload([]*Download{
+		{URL: server.URL + `/known`, LocalFilePath: filepath.Join(dir, `known`)},
+		{URL: server.URL + `/unknown`, LocalFilePath: filepath.Join(dir, `unknown`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	half := false
+	for _, p := range values {
+		if p != 0 && p != 0.5 && p != 1 {
+			t.Errorf(`progress should be fraction of files but %f`, p)
+		}
+		half = half || p == 0.5
+	}
+	if !half {
+		t.Errorf(`one of two files done is not reported %v`, values)
+	}
+}
+
+// FileSystem on memory for test
+type memFileSystem struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+type memFile struct {
+	bytes.Buffer
+	fs   *memFileSystem
+	name string
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.fs.files[f.name] = f.Bytes()
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0644 }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+func (fs *memFileSystem) Create(name string) (io.WriteCloser, error) {
+	return &memFile{fs: fs, name: name}, nil
+}
+
+func (fs *memFileSystem) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	b, ok := fs.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return memFileInfo{name: name, size: int64(len(b))}, nil
+}
+
+func (fs *memFileSystem) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	b, ok := fs.files[oldpath]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = b
+	return nil
+}
+
+func (fs *memFileSystem) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.files, name)
+	return nil
+}
+
+func TestDownloadToCustomFileSystem(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	fs := &memFileSystem{files: make(map[string][]byte)}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, FileSystem: fs, ResumeFromPartial: true}
+	if err := New(&conf).SimpleFileDownload(server.URL, `/memory/fuso.bin`); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.files) != 1 || !bytes.Equal(fs.files[`/memory/fuso.bin`], content) {
+		t.Errorf(`unexpected files in memory %d`, len(fs.files))
+	}
+	if _, err := os.Stat(`/memory/fuso.bin`); !os.IsNotExist(err) {
+		t.Error(`file is written to os file system`)
+	}
+}
+
+func TestDecompressGzip(t *testing.T) {
+	content := bytes.Repeat([]byte(`file util for simple object `), 512)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(content)
+	zw.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `application/gzip`)
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(gz.Bytes()))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, DecompressGzip: true}
+	if err := New(&conf).SimpleFileDownload(server.URL+`/fuso.txt.gz`, filepath.Join(dir, `fuso.txt.gz`)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, `fuso.txt`))
+	if err != nil || !bytes.Equal(b, content) {
+		t.Errorf(`file is not decompressed: %v`, err)
+	}
+	// checksum is of the decompressed file, or of the gzip file with ChecksumBeforeDecompress
+	plainSum, gzSum := sha256.Sum256(content), sha256.Sum256(gz.Bytes())
+	for _, before := range []bool{false, true} {
+		conf.ChecksumBeforeDecompress = before
+		expected, other := hex.EncodeToString(plainSum[:]), hex.EncodeToString(gzSum[:])
+		if before {
+			expected, other = other, expected
+		}
+		download := func(sum string) error {
+			return New(&conf).MultipleFileDownload([]*Download{{URL: server.URL + `/fuso.txt.gz`, LocalFilePath: filepath.Join(dir, `fuso.txt.gz`), ExpectedSHA256: sum}})
+		}
+		if err := download(expected); err != nil {
+			t.Errorf(`checksum should match with ChecksumBeforeDecompress %v: %v`, before, err)
+		}
+		if err := download(other); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf(`checksum should not match with ChecksumBeforeDecompress %v: %v`, before, err)
+		}
+	}
+}
+
+func TestRetryWithOnRetry(t *testing.T) {
+	var getCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` && atomic.AddInt32(&getCount, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	var attempts []int
+	var delays []time.Duration
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 3, RetryDelay: 10 * time.Millisecond,
+		OnRetry: func(d *Download, attempt int, err error, nextDelay time.Duration) {
+			var downloadErr *DownloadError
+			if !errors.As(err, &downloadErr) || downloadErr.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf(`unexpected retry error %v`, err)
+			}
+			attempts = append(attempts, attempt)
+			delays = append(delays, nextDelay)
+		}}
+	if err := New(&conf).SimpleFileDownload(server.URL, filepath.Join(t.TempDir(), `fuso`)); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(attempts) != `[1 2]` || fmt.Sprint(delays) != `[10ms 20ms]` {
+		t.Errorf(`unexpected retries %v %v`, attempts, delays)
+	}
+	// client errors are not retried
+	atomic.StoreInt32(&getCount, 0)
+	attempts = nil
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Length`, `0`)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+	if err := New(&conf).SimpleFileDownload(forbidden.URL, filepath.Join(t.TempDir(), `forbidden`)); err == nil {
+		t.Fatal(`expected error`)
+	}
+	if len(attempts) != 0 {
+		t.Errorf(`403 should not be retried %v`, attempts)
+	}
+}
+
+func TestDownloadFromManifest(t *testing.T) {
+	content := []byte(`file util for simple object`)
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	tsv := "# fuso manifest\n\n" +
+		server.URL + "/ugin\t" + filepath.Join(dir, `ugin`) + "\t" + checksum + "\n" +
+		server.URL + "/korvold\t" + filepath.Join(dir, `korvold`) + "\n"
+	manifestPath := filepath.Join(dir, `manifest.tsv`)
+	ioutil.WriteFile(manifestPath, []byte(tsv), 0644)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1}
+	if err := New(&conf).DownloadFromManifest(context.Background(), manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`ugin`, `korvold`} {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, name)); !bytes.Equal(b, content) {
+			t.Errorf(`%s is not downloaded`, name)
+		}
+	}
+	// json manifest with wrong checksum
+	entries := []map[string]string{{`url`: server.URL, `localPath`: filepath.Join(dir, `wrong`), `sha256`: strings.Repeat(`0`, 64)}}
+	b, _ := json.Marshal(entries)
+	manifestPath = filepath.Join(dir, `manifest.json`)
+	ioutil.WriteFile(manifestPath, b, 0644)
+	if err := New(&conf).DownloadFromManifest(context.Background(), manifestPath); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf(`expected checksum mismatch but %v`, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, `wrong`)); !os.IsNotExist(err) {
+		t.Error(`file with wrong checksum should not be saved`)
+	}
+	// invalid line
+	ioutil.WriteFile(manifestPath, []byte("# comment\n"+server.URL+"\n"), 0644)
+	err := New(&conf).DownloadFromManifest(context.Background(), manifestPath)
+	var manifestErr *ManifestError
+	if !errors.As(err, &manifestErr) || manifestErr.Line != 2 {
+		t.Errorf(`expected error at line 2 but %v`, err)
+	}
+}
+
+func TestDeduplicateDownloads(t *testing.T) {
+	var getCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			atomic.AddInt32(&getCount, 1)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	first := &Download{URL: server.URL, LocalFilePath: filepath.Join(dir, `latest`)}
+	same := &Download{URL: server.URL, LocalFilePath: filepath.Join(dir, `latest`)}
+	other := &Download{URL: server.URL, LocalFilePath: filepath.Join(dir, `v1`)}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1}
+	fileDownloader := New(&conf)
+	if err := fileDownloader.MultipleFileDownload([]*Download{first, same, other}); err != nil {
+		t.Fatal(err)
+	}
+	if getCount != 1 {
+		t.Errorf(`same url is downloaded %d times`, getCount)
+	}
+	for _, path := range []string{`latest`, `v1`} {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, path)); string(b) != `fuso` {
+			t.Errorf(`%s has wrong content %s`, path, b)
+		}
+	}
+	duplicates := fileDownloader.Duplicates()
+	if len(duplicates) != 2 || duplicates[same] != first || duplicates[other] != first {
+		t.Errorf(`unexpected dedup report %v`, duplicates)
+	}
+	// other headers or checksums of the same URL are other downloads
+	atomic.StoreInt32(&getCount, 0)
+	sum := sha256.Sum256([]byte(`fuso`))
+	fileDownloader = New(&conf)
+	err := fileDownloader.MultipleFileDownload([]*Download{
+		{URL: server.URL, LocalFilePath: filepath.Join(dir, `plain`)},
+		{URL: server.URL, LocalFilePath: filepath.Join(dir, `header`), Header: http.Header{`Authorization`: {`Bearer fuso`}}},
+		{URL: server.URL, LocalFilePath: filepath.Join(dir, `accept`), Accept: `application/octet-stream`},
+		{URL: server.URL, LocalFilePath: filepath.Join(dir, `verified`), ExpectedSHA256: hex.EncodeToString(sum[:])},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&getCount); n != 4 {
+		t.Errorf(`downloads of other requests are merged, downloaded %d times`, n)
+	}
+	if duplicates := fileDownloader.Duplicates(); len(duplicates) != 0 {
+		t.Errorf(`unexpected dedup report %v`, duplicates)
+	}
+}
+
+func TestBatchAndPerFileTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/slow` && r.Method == `GET` {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, PerFileTimeout: 200 * time.Millisecond}
+	fileDownloader := New(&conf)
+	err := fileDownloader.MultipleFileDownload([]*Download{
+		{URL: server.URL + `/slow`, LocalFilePath: filepath.Join(dir, `slow`)},
+		{URL: server.URL + `/fast`, LocalFilePath: filepath.Join(dir, `fast`)},
+	})
+	if !errors.Is(err, ErrFileTimeout) {
+		t.Errorf(`expected file timeout but %v`, err)
+	}
+	if fileDownloader.Outcome() != OutcomeFailed {
+		t.Errorf(`expected failed but %s`, fileDownloader.Outcome())
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `fast`)); string(b) != `fuso` {
+		t.Errorf(`other file should be downloaded but %s`, b)
+	}
+	conf = Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, BatchTimeout: 200 * time.Millisecond}
+	fileDownloader = New(&conf)
+	fileDownloader.SimpleFileDownload(server.URL+`/slow`, filepath.Join(dir, `slow`))
+	if fileDownloader.Outcome() != OutcomeTimedOut {
+		t.Errorf(`expected timedout but %s`, fileDownloader.Outcome())
+	}
+}
+
+// xor every byte, stands for decryption
+type xorReader struct {
+	r   io.Reader
+	key byte
+}
+
+func (x *xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= x.key
+	}
+	return n, err
+}
+
+func TestStreamTransform(t *testing.T) {
+	content := []byte(`fuso`)
+	encrypted := make([]byte, len(content))
+	for i := range content {
+		encrypted[i] = content[i] ^ 0x5a
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(encrypted))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var progressBytes int64
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1,
+		StreamTransform: func(r io.Reader) (io.Reader, error) {
+			return &xorReader{r: r, key: 0x5a}, nil
+		},
+		OnFileProgress: func(d *Download, downloadedBytes, totalBytes, bytesPerSecond int64) {
+			atomic.StoreInt64(&progressBytes, downloadedBytes)
+		},
+	}
+	if err := New(&conf).SimpleFileDownload(server.URL, filepath.Join(dir, `fuso`)); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `fuso`)); !bytes.Equal(b, content) {
+		t.Errorf(`file is not transformed %s`, b)
+	}
+	if atomic.LoadInt64(&progressBytes) != int64(len(encrypted)) {
+		t.Errorf(`progress should count network bytes but %d`, progressBytes)
+	}
+	errTransform := errors.New(`wrong key`)
+	conf.StreamTransform = func(r io.Reader) (io.Reader, error) {
+		return nil, errTransform
+	}
+	err := New(&conf).SimpleFileDownload(server.URL, filepath.Join(dir, `failed`))
+	if !errors.Is(err, errTransform) {
+		t.Errorf(`transform error should fail the download but %v`, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, `failed`)); !os.IsNotExist(err) {
+		t.Errorf(`failed file should not exist`)
+	}
+}
+
+func TestMaxFilesPerSecond(t *testing.T) {
+	var mu sync.Mutex
+	var starts []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			mu.Lock()
+			starts = append(starts, time.Now())
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var downloads []*Download
+	for i := 0; i < 3; i++ {
+		downloads = append(downloads, &Download{URL: server.URL + `/` + strconv.Itoa(i), LocalFilePath: filepath.Join(dir, strconv.Itoa(i))})
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 3, DownloadTimeoutMinutes: 1, MaxFilesPerSecond: 10}
+	if err := New(&conf).MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	if len(starts) != 3 {
+		t.Fatalf(`expected 3 requests but %d`, len(starts))
+	}
+	// 200ms for 3 files at 10 files per second, with some margin
+	if elapsed := starts[2].Sub(starts[0]); elapsed < 150*time.Millisecond {
+		t.Errorf(`downloads started too fast in %v`, elapsed)
+	}
+}
+
+func TestDownloadChan(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/large` && r.Method == `GET` {
+			// large file finishes after the small file is received
+			<-release
+		}
+		if r.URL.Path == `/broken` && r.Method == `GET` {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	large := &Download{URL: server.URL + `/large`, LocalFilePath: filepath.Join(dir, `large`)}
+	small := &Download{URL: server.URL + `/small`, LocalFilePath: filepath.Join(dir, `small`)}
+	broken := &Download{URL: server.URL + `/broken`, LocalFilePath: filepath.Join(dir, `broken`)}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 3, DownloadTimeoutMinutes: 1}
+	results := New(&conf).DownloadChan([]*Download{large, small, broken})
+	received := make(map[*Download]Result)
+	for len(received) < 2 {
+		r := <-results
+		received[r.Download] = r
+	}
+	if _, ok := received[large]; ok {
+		t.Errorf(`large file should not be finished yet`)
+	}
+	close(release)
+	for r := range results {
+		received[r.Download] = r
+	}
+	if len(received) != 3 {
+		t.Fatalf(`expected 3 results but %d`, len(received))
+	}
+	if r := received[small]; r.Err != nil || r.Path != small.LocalFilePath {
+		t.Errorf(`unexpected result of small file %+v`, r)
+	}
+	if r := received[large]; r.Err != nil || r.Path != large.LocalFilePath {
+		t.Errorf(`unexpected result of large file %+v`, r)
+	}
+	var downloadErr *DownloadError
+	if r := received[broken]; !errors.As(r.Err, &downloadErr) || downloadErr.StatusCode != http.StatusNotFound || r.Path != `` {
+		t.Errorf(`unexpected result of broken file %+v`, r)
+	}
+}
+
+func TestUserAgentAndDownloadHeader(t *testing.T) {
+	var mu sync.Mutex
+	agents := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents[r.URL.Path] = append(agents[r.URL.Path], r.Method+` `+r.UserAgent()+` `+r.Header.Get(`X-Fuso`))
+		mu.Unlock()
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	header := http.Header{}
+	header.Set(`User-Agent`, `custom/2.0`)
+	header.Set(`X-Fuso`, `neko`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, UserAgent: `fuso/1.0`}
+	err := New(&conf).MultipleFileDownload([]*Download{
+		{URL: server.URL + `/global`, LocalFilePath: filepath.Join(dir, `global`)},
+		{URL: server.URL + `/override`, LocalFilePath: filepath.Join(dir, `override`), Header: header},
+	})
 	if err != nil {
-		t.Log(err)
-		return
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		`/global`:   {`HEAD fuso/1.0 `, `GET fuso/1.0 `},
+		`/override`: {`HEAD custom/2.0 neko`, `GET custom/2.0 neko`},
+	}
+	for path, requests := range expected {
+		if strings.Join(agents[path], `,`) != strings.Join(requests, `,`) {
+			t.Errorf(`unexpected requests to %s: %v`, path, agents[path])
+		}
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			switch r.URL.Path {
+			case `/broken`:
+				w.WriteHeader(http.StatusNotFound)
+				return
+			case `/slow`:
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+				return
+			}
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, FailFast: true}
+	fileDownloader := New(&conf)
+	start := time.Now()
+	err := fileDownloader.MultipleFileDownload([]*Download{
+		{URL: server.URL + `/slow`, LocalFilePath: filepath.Join(dir, `slow`)},
+		{URL: server.URL + `/broken`, LocalFilePath: filepath.Join(dir, `broken`)},
+		{URL: server.URL + `/pending`, LocalFilePath: filepath.Join(dir, `pending`)},
+	})
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || downloadErr.StatusCode != http.StatusNotFound {
+		t.Errorf(`expected the first error but %v`, err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf(`other downloads were not stopped, took %v`, elapsed)
+	}
+	for _, name := range []string{`slow`, `pending`} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf(`%s should not be downloaded`, name)
+		}
+	}
+	if fileDownloader.Outcome() != OutcomeFailed {
+		t.Errorf(`expected failed but %s`, fileDownloader.Outcome())
+	}
+}
+
+func TestCheckResumable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/plain` {
+			w.Header().Set(`Content-Length`, `4`)
+			w.Write([]byte(`fuso`))
+			return
+		}
+		if r.URL.Path == `/missing` {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	fileDownloader := New(&Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1})
+	size, resumable, err := fileDownloader.CheckResumable(context.Background(), server.URL)
+	if err != nil || size != 4 || !resumable {
+		t.Errorf(`expected resumable 4 bytes but %d %v %v`, size, resumable, err)
+	}
+	size, resumable, err = fileDownloader.CheckResumable(context.Background(), server.URL+`/plain`)
+	if err != nil || size != 4 || resumable {
+		t.Errorf(`expected not resumable 4 bytes but %d %v %v`, size, resumable, err)
+	}
+	var downloadErr *DownloadError
+	if _, _, err := fileDownloader.CheckResumable(context.Background(), server.URL+`/missing`); !errors.As(err, &downloadErr) || downloadErr.StatusCode != http.StatusNotFound {
+		t.Errorf(`expected 404 error but %v`, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := fileDownloader.CheckResumable(ctx, server.URL); !errors.Is(err, context.Canceled) {
+		t.Errorf(`expected cancel error but %v`, err)
+	}
+}
+
+func TestHeadNotAllowed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `HEAD` {
+			http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+			return
+		}
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(`file should be downloaded by GET`, err)
+	}
+	if b, _ := ioutil.ReadFile(localPath); string(b) != `fuso` {
+		t.Errorf(`unexpected content %s`, b)
+	}
+}
+
+func TestUnreachableServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// nothing listens on the address
+	server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	var downloadErr *DownloadError
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); !errors.As(err, &downloadErr) {
+		t.Errorf(`expected DownloadError but %v`, err)
+	}
+}
+
+func TestURLRefresher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only the second signature is valid
+		if r.Method == `GET` && r.URL.Query().Get(`sig`) != `2` {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var originals []string
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 1, RetryDelay: time.Millisecond,
+		URLRefresher: func(original string) (string, error) {
+			originals = append(originals, original)
+			return original + `?sig=` + strconv.Itoa(len(originals)), nil
+		},
+	}
+	if err := New(&conf).SimpleFileDownload(server.URL+`/fuso`, filepath.Join(dir, `fuso`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(originals) != 2 || originals[0] != server.URL+`/fuso` || originals[1] != server.URL+`/fuso` {
+		t.Errorf(`refresher should get original URL before each request but %v`, originals)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `fuso`)); string(b) != `fuso` {
+		t.Errorf(`unexpected content %s`, b)
+	}
+}
+
+func TestPauseExcludedFromRate(t *testing.T) {
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = 100 * time.Millisecond
+	chunk := bytes.Repeat([]byte(`f`), 50)
+	chunks := 100
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Length`, strconv.Itoa(len(chunk)*chunks))
+		if r.Method != `GET` {
+			return
+		}
+		// 5000 bytes per second
+		for i := 0; i < chunks; i++ {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var mu sync.Mutex
+	var rates []int64
+	var lastBytes int64
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1,
+		OnFileProgress: func(d *Download, downloaded, total, bytesPerSecond int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			if downloaded < total {
+				rates = append(rates, bytesPerSecond)
+			}
+			lastBytes = downloaded
+		}}
+	fileDownloader := New(&conf)
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		fileDownloader.Pause()
+		// several ticks
+		time.Sleep(500 * time.Millisecond)
+		if !fileDownloader.Paused() {
+			t.Errorf(`should be paused`)
+		}
+		fileDownloader.Resume()
+	}()
+	if err := fileDownloader.SimpleFileDownload(server.URL, filepath.Join(dir, `fuso`)); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if lastBytes != int64(len(chunk)*chunks) {
+		t.Errorf(`cumulative bytes %d is wrong`, lastBytes)
+	}
+	if len(rates) == 0 {
+		t.Fatal(`no progress reported`)
+	}
+	for _, rate := range rates {
+		// paused ticks would be reported as 0 bytes
+		if rate == 0 {
+			t.Errorf(`paused time is counted in the rate %v`, rates)
+			break
+		}
+	}
+}
+
+func TestWriteChecksumManifest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/broken` && r.Method == `GET` {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`+r.URL.Path))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, `SHA256SUMS`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, WriteChecksumManifest: manifest}
+	New(&conf).MultipleFileDownload([]*Download{
+		{URL: server.URL + `/ugin`, LocalFilePath: filepath.Join(dir, `ugin`)},
+		{URL: server.URL + `/broken`, LocalFilePath: filepath.Join(dir, `broken`)},
+		{URL: server.URL + `/korvold`, LocalFilePath: filepath.Join(dir, `korvold`)},
+		{URL: server.URL + `/korvold`, LocalFilePath: filepath.Join(dir, `korvold2`)},
+	})
+	b, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected string
+	for _, name := range []string{`ugin`, `korvold`, `korvold2`} {
+		content, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		sum := sha256.Sum256(content)
+		expected += hex.EncodeToString(sum[:]) + `  ` + filepath.Join(dir, name) + "\n"
+	}
+	if string(b) != expected {
+		t.Errorf("unexpected manifest\n%s\nexpected\n%s", b, expected)
+	}
+}
+
+type testContextKey struct{}
+
+func TestContextValuesInHooks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`X-Got-Trace`, r.Header.Get(`X-Trace`))
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var mu sync.Mutex
+	var seen []string
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1,
+		RequestInterceptor: func(r *http.Request) error {
+			trace, _ := r.Context().Value(testContextKey{}).(string)
+			r.Header.Set(`X-Trace`, trace)
+			mu.Lock()
+			seen = append(seen, r.Method+` `+trace)
+			mu.Unlock()
+			return nil
+		},
+		OnResponse: func(d *Download, resp *http.Response) {
+			trace, _ := resp.Request.Context().Value(testContextKey{}).(string)
+			mu.Lock()
+			seen = append(seen, `response `+trace+` `+resp.Header.Get(`X-Got-Trace`))
+			mu.Unlock()
+		},
+	}
+	ctx := context.WithValue(context.Background(), testContextKey{}, `trace-1`)
+	err := New(&conf).MultipleFileDownloadContext(ctx, []*Download{{URL: server.URL, LocalFilePath: filepath.Join(dir, `fuso`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(seen, `,`) != `HEAD trace-1,GET trace-1,response trace-1 trace-1` {
+		t.Errorf(`context values are not passed to hooks %v`, seen)
+	}
+	errDenied := errors.New(`denied`)
+	conf.RequestInterceptor = func(r *http.Request) error {
+		if r.Method == `GET` {
+			return errDenied
+		}
+		return nil
+	}
+	if err := New(&conf).SimpleFileDownload(server.URL, filepath.Join(dir, `denied`)); !errors.Is(err, errDenied) {
+		t.Errorf(`interceptor error should fail the download but %v`, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, `denied*`)); len(files) != 0 {
+		t.Errorf(`temp file is left %v`, files)
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	var running, maxRunning int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var downloads []*Download
+	for i := 0; i < 6; i++ {
+		downloads = append(downloads, &Download{URL: server.URL + `/` + strconv.Itoa(i), LocalFilePath: filepath.Join(dir, strconv.Itoa(i))})
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 6, DownloadTimeoutMinutes: 1, MaxOpenFiles: 4}
+	if err := New(&conf).MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	if maxRunning > 2 {
+		t.Errorf(`%d files were downloaded at once over MaxOpenFiles`, maxRunning)
+	}
+}
+
+func TestOnTotalSizeKnown(t *testing.T) {
+	var getCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			atomic.AddInt32(&getCount, 1)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`+r.URL.Path))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	called := 0
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1,
+		OnTotalSizeKnown: func(totalBytes int64, fileCount int) {
+			called++
+			if atomic.LoadInt32(&getCount) != 0 {
+				t.Errorf(`called after download started`)
+			}
+			if totalBytes != 21 || fileCount != 2 {
+				t.Errorf(`unexpected total %d bytes of %d files`, totalBytes, fileCount)
+			}
+		}}
+	err := New(&conf).MultipleFileDownload([]*Download{
+		{URL: server.URL + `/ugin`, LocalFilePath: filepath.Join(dir, `ugin`)},
+		{URL: server.URL + `/korvold`, LocalFilePath: filepath.Join(dir, `korvold`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if called != 1 {
+		t.Errorf(`called %d times`, called)
+	}
+}
+
+func TestMinFreeBytes(t *testing.T) {
+	if free, err := freeBytes(t.TempDir()); err != nil && err != errFreeSpaceUnsupported || err == nil && free <= 0 {
+		t.Errorf(`could not get free space %d %v`, free, err)
+	}
+	defer func(f func(string) (int64, error)) { diskFreeBytes = f }(diskFreeBytes)
+	var free int64 = 1000
+	diskFreeBytes = func(dir string) (int64, error) {
+		return atomic.LoadInt64(&free), nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var downloads []*Download
+	for i := 0; i < 3; i++ {
+		downloads = append(downloads, &Download{URL: server.URL + `/` + strconv.Itoa(i), LocalFilePath: filepath.Join(dir, strconv.Itoa(i))})
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MinFreeBytes: 100,
+		OnResponse: func(d *Download, resp *http.Response) {
+			// disk becomes full by other process
+			atomic.StoreInt64(&free, 10)
+		}}
+	fileDownloader := New(&conf)
+	err := fileDownloader.MultipleFileDownload(downloads)
+	if !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf(`expected insufficient space but %v`, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `0`)); string(b) != `fuso` {
+		t.Errorf(`first file should be downloaded but %s`, b)
+	}
+	for _, name := range []string{`1`, `2`} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf(`%s should not be downloaded`, name)
+		}
+	}
+	if fileDownloader.Outcome() != OutcomeFailed {
+		t.Errorf(`expected failed but %s`, fileDownloader.Outcome())
+	}
+}
+
+func TestCancelAndCleanup(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 10000)
+	sent := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/hang` && r.Method == `GET` {
+			w.Header().Set(`Content-Length`, strconv.Itoa(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			sent <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	download := func(cancel func(fileDownloader *FileDownloader, dir string)) string {
+		dir := t.TempDir()
+		conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+		fileDownloader := New(&conf)
+		go func() {
+			<-sent
+			// wait for the sent bytes to be written
+			time.Sleep(100 * time.Millisecond)
+			cancel(fileDownloader, dir)
+		}()
+		fileDownloader.MultipleFileDownload([]*Download{
+			{URL: server.URL + `/done`, LocalFilePath: filepath.Join(dir, `done`)},
+			{URL: server.URL + `/hang`, LocalFilePath: filepath.Join(dir, `hang`)},
+		})
+		if fileDownloader.Outcome() != OutcomeCancelled {
+			t.Errorf(`expected cancelled but %s`, fileDownloader.Outcome())
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, `done`)); !bytes.Equal(b, content) {
+			t.Errorf(`completed file should be kept`)
+		}
+		return dir
+	}
+	dir := download(func(fileDownloader *FileDownloader, dir string) { fileDownloader.Cancel() })
+	if _, err := os.Stat(filepath.Join(dir, `hang.part`)); err != nil {
+		t.Errorf(`Cancel should keep partial file: %v`, err)
+	}
+	// cancel of the context given to the download
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sentCtx := make(chan struct{})
+	go func() {
+		<-sent
+		close(sentCtx)
+		cancel()
+	}()
+	fileDownloader := New(&Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1})
+	fileDownloader.MultipleFileDownloadContext(ctx, []*Download{{URL: server.URL + `/hang`, LocalFilePath: filepath.Join(t.TempDir(), `hang`)}})
+	<-sentCtx
+	if fileDownloader.Outcome() != OutcomeCancelled {
+		t.Errorf(`expected cancelled by context but %s`, fileDownloader.Outcome())
+	}
+	cleaned := make(chan string, 1)
+	download(func(fileDownloader *FileDownloader, dir string) {
+		fileDownloader.CancelAndCleanup()
+		// partial files are removed when CancelAndCleanup returns
+		files, _ := filepath.Glob(filepath.Join(dir, `*.part`))
+		cleaned <- strings.Join(files, `,`)
+	})
+	if files := <-cleaned; files != `` {
+		t.Errorf(`partial files are left %s`, files)
+	}
+}
+
+func TestValidateContentType(t *testing.T) {
+	png := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), bytes.Repeat([]byte{0}, 100)...)
+	login := []byte(`<!DOCTYPE html><html><body>please login</body></html>`)
+	svg := []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`)
+	docx := append([]byte("PK\x03\x04"), bytes.Repeat([]byte{0}, 100)...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `image/png`)
+		if strings.HasPrefix(r.URL.Path, `/generic`) {
+			w.Header().Set(`Content-Type`, `application/octet-stream`)
+		}
+		switch r.URL.Path {
+		case `/svg`:
+			w.Header().Set(`Content-Type`, `image/svg+xml`)
+			http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(svg))
+			return
+		case `/xml`:
+			w.Header().Set(`Content-Type`, `application/xml`)
+			http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(svg))
+			return
+		case `/docx`:
+			w.Header().Set(`Content-Type`, `application/vnd.openxmlformats-officedocument.wordprocessingml.document`)
+			http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(docx))
+			return
+		case `/jar`:
+			w.Header().Set(`Content-Type`, `application/java-archive`)
+			http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(docx))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, `/login`) {
+			http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(login))
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(png))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, ValidateContentType: true}
+	if err := New(&conf).SimpleFileDownload(server.URL+`/ugin.png`, filepath.Join(dir, `ugin.png`)); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `ugin.png`)); !bytes.Equal(b, png) {
+		t.Errorf(`sniffed file is broken`)
+	}
+	err := New(&conf).SimpleFileDownload(server.URL+`/login`, filepath.Join(dir, `login.png`))
+	if !errors.Is(err, ErrContentTypeMismatch) {
+		t.Errorf(`expected content type mismatch but %v`, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, `login.png`)); !os.IsNotExist(err) {
+		t.Errorf(`mismatched file should not be saved`)
+	}
+	// binary file served as generic binary type
+	if err := New(&conf).SimpleFileDownload(server.URL+`/generic/ugin.png`, filepath.Join(dir, `generic.png`)); err != nil {
+		t.Errorf(`octet-stream should match binary file %v`, err)
+	}
+	err = New(&conf).SimpleFileDownload(server.URL+`/generic/login`, filepath.Join(dir, `generic.bin`))
+	if !errors.Is(err, ErrContentTypeMismatch) {
+		t.Errorf(`octet-stream should not match HTML page but %v`, err)
+	}
+	// XML documents and zip containers are detected by the generic types
+	for _, name := range []string{`svg`, `xml`, `docx`, `jar`} {
+		if err := New(&conf).SimpleFileDownload(server.URL+`/`+name, filepath.Join(dir, name)); err != nil {
+			t.Errorf(`%s should match its content %v`, name, err)
+		}
+	}
+	conf.ValidateContentType = false
+	err = New(&conf).MultipleFileDownload([]*Download{{URL: server.URL, LocalFilePath: filepath.Join(dir, `any.png`), ExpectedContentType: `image/*`}})
+	if err != nil {
+		t.Errorf(`wildcard type should match %v`, err)
+	}
+	err = New(&conf).MultipleFileDownload([]*Download{{URL: server.URL, LocalFilePath: filepath.Join(dir, `fuso.html`), ExpectedContentType: `text/html; charset=utf-8`}})
+	if !errors.Is(err, ErrContentTypeMismatch) {
+		t.Errorf(`expected content type mismatch but %v`, err)
+	}
+}
+
+func TestBatchTimeoutBoundsHeadRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `HEAD` {
+			// slow host never answers size
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	totalKnown := false
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, BatchTimeout: 200 * time.Millisecond,
+		OnTotalSizeKnown: func(totalBytes int64, fileCount int) { totalKnown = true }}
+	fileDownloader := New(&conf)
+	start := time.Now()
+	err := fileDownloader.MultipleFileDownload([]*Download{
+		{URL: server.URL + `/a`, LocalFilePath: filepath.Join(dir, `a`)},
+		{URL: server.URL + `/b`, LocalFilePath: filepath.Join(dir, `b`)},
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf(`expected timeout but %v`, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf(`HEAD requests were not bounded by BatchTimeout %s`, elapsed)
+	}
+	if fileDownloader.Outcome() != OutcomeTimedOut {
+		t.Errorf(`expected timed out but %s`, fileDownloader.Outcome())
+	}
+	if totalKnown {
+		t.Errorf(`OnTotalSizeKnown should not be called when sizes are not known`)
+	}
+}
+
+func TestSkipCompleted(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			atomic.AddInt32(&gets, 1)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, `done`), content, 0644)
+	ioutil.WriteFile(filepath.Join(dir, `half`), content[:100], 0644)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, SkipCompleted: true}
+	fileDownloader := New(&conf)
+	done := &Download{URL: server.URL + `/done`, LocalFilePath: filepath.Join(dir, `done`)}
+	half := &Download{URL: server.URL + `/half`, LocalFilePath: filepath.Join(dir, `half`)}
+	skipped := make(map[*Download]bool)
+	for result := range fileDownloader.DownloadChan([]*Download{done, half}) {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		skipped[result.Download] = result.Skipped
+	}
+	if !skipped[done] || skipped[half] {
+		t.Errorf(`only the complete file should be skipped %v`, skipped)
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf(`expected 1 GET request but %d`, n)
+	}
+	if s := fileDownloader.Skipped(); len(s) != 1 || s[0] != done {
+		t.Errorf(`unexpected skipped files %v`, s)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `half`)); !bytes.Equal(b, content) {
+		t.Errorf(`incomplete file should be downloaded again`)
+	}
+	// file of wrong checksum is downloaded again
+	atomic.StoreInt32(&gets, 0)
+	ioutil.WriteFile(filepath.Join(dir, `broken`), bytes.Repeat([]byte(`xxxx`), 1000), 0644)
+	sum := sha256.Sum256(content)
+	broken := &Download{URL: server.URL + `/broken`, LocalFilePath: filepath.Join(dir, `broken`), ExpectedSHA256: hex.EncodeToString(sum[:])}
+	if err := New(&conf).MultipleFileDownload([]*Download{broken}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf(`file of wrong checksum should be downloaded again`)
+	}
+}
+
+func TestPartSuffix(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	// real file which has the temp file path
+	real := []byte(`not a temp file`)
+	ioutil.WriteFile(filepath.Join(dir, `fuso.bin.tmp`), real, 0644)
+	var partPaths []string
+	var mu sync.Mutex
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, PartSuffix: `.tmp`,
+		OnResponse: func(d *Download, resp *http.Response) {
+			files, _ := filepath.Glob(filepath.Join(dir, `*.tmp`))
+			mu.Lock()
+			partPaths = append(partPaths, files...)
+			mu.Unlock()
+		}}
+	err := New(&conf).MultipleFileDownload([]*Download{
+		{URL: server.URL + `/a`, LocalFilePath: filepath.Join(dir, `fuso.bin`)},
+		// temp file of fuso must not be this file
+		{URL: server.URL + `/b`, LocalFilePath: filepath.Join(dir, `ugin.bin.tmp`)},
+		{URL: server.URL + `/c`, LocalFilePath: filepath.Join(dir, `ugin.bin`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`fuso.bin`, `ugin.bin.tmp`, `ugin.bin`} {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, name)); !bytes.Equal(b, content) {
+			t.Errorf(`%s is broken`, name)
+		}
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `fuso.bin.tmp`)); !bytes.Equal(b, real) {
+		t.Errorf(`existing file is overwritten by temp file`)
+	}
+	if len(partPaths) == 0 {
+		t.Errorf(`temp files do not have PartSuffix`)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, `*.part`)); len(files) > 0 {
+		t.Errorf(`.part file is created %v`, files)
+	}
+}
+
+func TestSpeedSmoothing(t *testing.T) {
+	speeds := []int64{100, 300, 200, 0}
+	expected := map[SpeedSmoothing][]int64{
+		SmoothingRaw:           {100, 300, 200, 0},
+		SmoothingMovingAverage: {100, 200, 250, 100},
+		SmoothingExponential:   {100, 200, 200, 100},
+	}
+	for smoothing, values := range expected {
+		smoother := newSpeedSmoother(&Config{SpeedSmoothing: smoothing, SpeedSmoothingWindow: 2, SpeedSmoothingAlpha: 0.5})
+		for i, speed := range speeds {
+			if v := smoother.add(speed); v != values[i] {
+				t.Errorf(`%s: expected %d but %d at %d`, smoothing, values[i], v, i)
+			}
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf(`unknown smoothing should not be accepted`)
+		}
+	}()
+	New(&Config{MaxDownloadThreads: 1, SpeedSmoothing: `median`})
+}
+
+func TestPanicFailsOnlyTheFile(t *testing.T) {
+	content := []byte(`fuso`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, MaxRetry: 2, RetryDelay: time.Millisecond,
+		OnResponse: func(d *Download, resp *http.Response) {
+			if strings.HasSuffix(d.URL, `/bad`) {
+				panic(`bad callback`)
+			}
+		}}
+	err := New(&conf).MultipleFileDownload([]*Download{
+		{URL: server.URL + `/bad`, LocalFilePath: filepath.Join(dir, `bad`)},
+		{URL: server.URL + `/good`, LocalFilePath: filepath.Join(dir, `good`)},
+	})
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) || panicErr.Value != `bad callback` || len(panicErr.Stack) == 0 {
+		t.Fatalf(`expected panic error but %v`, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `good`)); !bytes.Equal(b, content) {
+		t.Errorf(`other file should be downloaded`)
+	}
+	// panic in a callback of the progress observer does not crash the program
+	var calls int32
+	conf = Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1,
+		OnFileProgress: func(d *Download, downloadedBytes, totalBytes, bytesPerSecond int64) {
+			atomic.AddInt32(&calls, 1)
+			panic(`bad progress`)
+		},
+		OnTotalSizeKnown: func(totalBytes int64, fileCount int) { panic(`bad total`) },
+	}
+	if err := New(&conf).SimpleFileDownload(server.URL+`/progress`, filepath.Join(dir, `progress`)); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&calls) == 0 {
+		t.Error(`OnFileProgress is not called`)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `progress`)); !bytes.Equal(b, content) {
+		t.Errorf(`file should be downloaded with panicking callbacks`)
+	}
+}
+
+func TestActiveDownloads(t *testing.T) {
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			arrived.Done()
+			<-release
+		}
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1}
+	fileDownloader := New(&conf)
+	if n := fileDownloader.ActiveDownloads(); n != 0 {
+		t.Errorf(`expected no active downloads before start but %d`, n)
+	}
+	go func() {
+		arrived.Wait()
+		if n := fileDownloader.ActiveDownloads(); n != 2 {
+			t.Errorf(`expected 2 active downloads but %d`, n)
+		}
+		close(release)
+	}()
+	var downloads []*Download
+	for _, name := range []string{`a`, `b`} {
+		downloads = append(downloads, &Download{URL: server.URL + `/` + name, LocalFilePath: filepath.Join(dir, name)})
+	}
+	if err := fileDownloader.MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	if n := fileDownloader.ActiveDownloads(); n != 0 {
+		t.Errorf(`expected no active downloads after done but %d`, n)
+	}
+}
+
+func TestDownloadToStdout(t *testing.T) {
+	fuso := bytes.Repeat([]byte(`fuso`), 50000)
+	ugin := bytes.Repeat([]byte(`ugin`), 50000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/ugin` {
+			http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(ugin))
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(fuso))
+	}))
+	defer server.Close()
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1}
+	fileDownloader := New(&conf)
+	var paths []string
+	for result := range fileDownloader.DownloadChan([]*Download{
+		{URL: server.URL + `/fuso`, LocalFilePath: StdoutPath},
+		{URL: server.URL + `/ugin`, LocalFilePath: StdoutPath},
+	}) {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		paths = append(paths, result.Path)
+	}
+	// files are not mixed
+	b := out.Bytes()
+	if !bytes.Equal(b, append(append([]byte{}, fuso...), ugin...)) && !bytes.Equal(b, append(append([]byte{}, ugin...), fuso...)) {
+		t.Errorf(`stdout has broken files %d bytes`, len(b))
+	}
+	if len(paths) != 2 || paths[0] != StdoutPath || paths[1] != StdoutPath {
+		t.Errorf(`unexpected result paths %v`, paths)
+	}
+	if files, _ := filepath.Glob(`-*`); len(files) > 0 {
+		t.Errorf(`files are created for stdout %v`, files)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `HEAD` {
+			return
+		}
+		if r.URL.Path == `/dead` {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		// slow but steady body
+		for i := 0; i < 5; i++ {
+			w.Write([]byte(`fuso`))
+			w.(http.Flusher).Flush()
+			time.Sleep(60 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, ResponseHeaderTimeout: 100 * time.Millisecond}
+	if err := New(&conf).SimpleFileDownload(server.URL+`/steady`, filepath.Join(dir, `steady`)); err != nil {
+		t.Errorf(`body longer than ResponseHeaderTimeout should be downloaded %v`, err)
+	}
+	start := time.Now()
+	if err := New(&conf).SimpleFileDownload(server.URL+`/dead`, filepath.Join(dir, `dead`)); err == nil {
+		t.Errorf(`expected timeout of response headers`)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf(`dead host did not fail fast %s`, elapsed)
+	}
+}
+
+func TestDialTimeoutAndKeepAlive(t *testing.T) {
+	if d := newDialer(&Config{}); d != nil {
+		t.Errorf(`default dialer should be used without settings`)
+	}
+	d := newDialer(&Config{DialTimeout: time.Second, KeepAlive: -1})
+	if d == nil || d.Timeout != time.Second || d.KeepAlive != -1 {
+		t.Errorf(`unexpected dialer %+v`, d)
+	}
+	// ResponseHeaderTimeout also bounds dialing unless DialTimeout is set
+	d = newDialer(&Config{ResponseHeaderTimeout: 2 * time.Second})
+	if d == nil || d.Timeout != 2*time.Second || d.KeepAlive != 30*time.Second {
+		t.Errorf(`unexpected dialer %+v`, d)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, DialTimeout: time.Second, KeepAlive: 10 * time.Second}
+	if err := New(&conf).SimpleFileDownload(server.URL, filepath.Join(t.TempDir(), `fuso`)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSingleRequestMode(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	var heads, gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `HEAD` {
+			atomic.AddInt32(&heads, 1)
+		} else {
+			atomic.AddInt32(&gets, 1)
+		}
+		if r.URL.Path == `/norange` {
+			r.Header.Del(`Range`)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var totalBytes int64
+	var fileCount int
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, SingleRequestMode: true,
+		OnTotalSizeKnown: func(total int64, count int) { totalBytes, fileCount = total, count }}
+	fileDownloader := New(&conf)
+	err := fileDownloader.MultipleFileDownload([]*Download{
+		{URL: server.URL + `/range`, LocalFilePath: filepath.Join(dir, `range`)},
+		{URL: server.URL + `/norange`, LocalFilePath: filepath.Join(dir, `norange`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`range`, `norange`} {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, name)); !bytes.Equal(b, content) {
+			t.Errorf(`%s is broken`, name)
+		}
+	}
+	if h, g := atomic.LoadInt32(&heads), atomic.LoadInt32(&gets); h != 0 || g != 2 {
+		t.Errorf(`expected only 2 GET requests but %d HEAD and %d GET`, h, g)
+	}
+	if fileDownloader.TotalFilesSize != int64(2*len(content)) || totalBytes != int64(2*len(content)) || fileCount != 2 {
+		t.Errorf(`sizes are not told by responses %d %d %d`, fileDownloader.TotalFilesSize, totalBytes, fileCount)
+	}
+}
+
+func TestErrorAggregator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, `/missing`) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	download := func(aggregator func(map[*Download]error) error) error {
+		dir := t.TempDir()
+		conf := Config{logfunc: myLogger, MaxDownloadThreads: 3, DownloadTimeoutMinutes: 1, ErrorAggregator: aggregator}
+		return New(&conf).MultipleFileDownload([]*Download{
+			{URL: server.URL + `/missing1`, LocalFilePath: filepath.Join(dir, `missing1`)},
+			{URL: server.URL + `/fuso`, LocalFilePath: filepath.Join(dir, `fuso`)},
+			{URL: server.URL + `/missing2`, LocalFilePath: filepath.Join(dir, `missing2`)},
+		})
+	}
+	err := download(nil)
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || downloadErr.StatusCode != http.StatusNotFound {
+		t.Errorf(`joined error should have DownloadError %v`, err)
+	}
+	if err == nil || !strings.Contains(err.Error(), `/missing1`) || !strings.Contains(err.Error(), `/missing2`) {
+		t.Errorf(`errors of all files should be joined %v`, err)
+	}
+	if err := download(FirstError); err == nil || !strings.Contains(err.Error(), `/missing1`) || strings.Contains(err.Error(), `/missing2`) {
+		t.Errorf(`expected only the first error %v`, err)
+	}
+	if err := download(CountError); !errors.Is(err, ErrDownload) || !strings.Contains(err.Error(), `2 of 3 files failed`) {
+		t.Errorf(`expected count of failed files %v`, err)
+	}
+	var perFile map[*Download]error
+	download(func(errs map[*Download]error) error {
+		perFile = errs
+		return nil
+	})
+	if len(perFile) != 3 {
+		t.Errorf(`aggregator should receive results of all files %v`, perFile)
+	}
+}
+
+func TestJoinedErrorIsAs(t *testing.T) {
+	err := joinErrors(&DownloadError{URL: `http://localhost/fuso`, StatusCode: http.StatusNotFound}, fmt.Errorf(`ugin: %w`, ErrChecksumMismatch))
+	// Is and As methods are used by errors package before Go 1.20, which does not unwrap []error
+	joined := err.(*joinedError)
+	if !joined.Is(ErrChecksumMismatch) || joined.Is(ErrDigestMismatch) {
+		t.Errorf(`Is should find wrapped sentinel only`)
+	}
+	var downloadErr *DownloadError
+	if !joined.As(&downloadErr) || downloadErr.StatusCode != http.StatusNotFound {
+		t.Errorf(`As should find DownloadError`)
+	}
+	var fsErr *FileSystemError
+	if joined.As(&fsErr) {
+		t.Errorf(`As should not find FileSystemError`)
+	}
+}
+
+func TestPrioritize(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			mu.Lock()
+			order = append(order, r.URL.Path)
+			mu.Unlock()
+			if r.URL.Path == `/a` {
+				close(started)
+				<-release
+			}
+		}
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var downloads []*Download
+	for _, name := range []string{`a`, `b`, `c`, `d`} {
+		downloads = append(downloads, &Download{URL: server.URL + `/` + name, LocalFilePath: filepath.Join(dir, name)})
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	fileDownloader := New(&conf)
+	go func() {
+		<-started
+		fileDownloader.Prioritize(downloads[3])
+		// downloading file is not moved
+		fileDownloader.Prioritize(downloads[0])
+		close(release)
+	}()
+	if err := fileDownloader.MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(order, ``) != `/a/d/b/c` {
+		t.Errorf(`prioritized file is not downloaded next %v`, order)
+	}
+}
+
+func TestVerifyServerDigest(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	md5sum := md5.Sum(content)
+	sha256sum := sha256.Sum256(content)
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := content
+		switch r.URL.Path {
+		case `/md5`:
+			w.Header().Set(`Content-MD5`, base64.StdEncoding.EncodeToString(md5sum[:]))
+		case `/flaky`:
+			w.Header().Set(`Digest`, `sha-256=`+base64.StdEncoding.EncodeToString(sha256sum[:]))
+			// first body is broken
+			if r.Method == `GET` && atomic.AddInt32(&gets, 1) == 1 {
+				body = bytes.Repeat([]byte(`xxxx`), 1000)
+			}
+		case `/broken`:
+			w.Header().Set(`Digest`, `md5=`+base64.StdEncoding.EncodeToString(md5sum[:]))
+			body = bytes.Repeat([]byte(`xxxx`), 1000)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(body))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, VerifyServerDigest: true, MaxRetry: 1, RetryDelay: time.Millisecond}
+	for _, name := range []string{`md5`, `flaky`} {
+		if err := New(&conf).SimpleFileDownload(server.URL+`/`+name, filepath.Join(dir, name)); err != nil {
+			t.Errorf(`%s: %v`, name, err)
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, name)); !bytes.Equal(b, content) {
+			t.Errorf(`%s is broken`, name)
+		}
+	}
+	if n := atomic.LoadInt32(&gets); n != 2 {
+		t.Errorf(`broken download should be retried, %d requests`, n)
+	}
+	err := New(&conf).SimpleFileDownload(server.URL+`/broken`, filepath.Join(dir, `broken`))
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf(`expected digest mismatch but %v`, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, `broken`)); !os.IsNotExist(err) {
+		t.Errorf(`broken file should not be saved`)
+	}
+}
+
+func TestMaxInFlightBytes(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 250)
+	var waiting, maxWaiting int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			n := atomic.AddInt32(&waiting, 1)
+			for m := atomic.LoadInt32(&maxWaiting); n > m && !atomic.CompareAndSwapInt32(&maxWaiting, m, n); m = atomic.LoadInt32(&maxWaiting) {
+			}
+			time.Sleep(50 * time.Millisecond)
+			// bytes of the file are in flight until they are sent
+			atomic.AddInt32(&waiting, -1)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var downloads []*Download
+	for _, name := range []string{`a`, `b`, `c`} {
+		downloads = append(downloads, &Download{URL: server.URL + `/` + name, LocalFilePath: filepath.Join(dir, name)})
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 3, DownloadTimeoutMinutes: 1, MaxInFlightBytes: int64(len(content)) * 3 / 2}
+	if err := New(&conf).MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&maxWaiting); n != 1 {
+		t.Errorf(`files exceeding MaxInFlightBytes are downloaded at once %d`, n)
+	}
+	for _, d := range downloads {
+		if b, _ := ioutil.ReadFile(d.LocalFilePath); !bytes.Equal(b, content) {
+			t.Errorf(`%s is broken`, d.LocalFilePath)
+		}
+	}
+}
+
+func TestResumeAfterCutConnection(t *testing.T) {
+	// use small buffer so that small test file is treated as resumable file.
+	defer func(size int) { copyBufferSize = size }(copyBufferSize)
+	copyBufferSize = 64
+	content := bytes.Repeat([]byte(`fuso`), 100000)
+	server := testutil.NewServer(content, testutil.Behavior{FailTimes: 1, FailAt: int64(len(content) / 2)})
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso.bin`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, ResumeFromPartial: true}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err == nil {
+		t.Fatal(`expected error of the cut connection`)
+	}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(err)
+	}
+	ranges := server.Ranges()
+	if len(ranges) != 2 || ranges[0] != `` || !strings.HasPrefix(ranges[1], `bytes=`) || strings.HasPrefix(ranges[1], `bytes=0-`) {
+		t.Errorf(`download is not resumed %q`, ranges)
+	}
+	if b, _ := ioutil.ReadFile(localPath); !bytes.Equal(b, content) {
+		t.Errorf(`resumed file is broken`)
+	}
+}
+
+func TestRetryCutConnection(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 100000)
+	server := testutil.NewServer(content, testutil.Behavior{FailTimes: 2, FailAt: int64(len(content) / 2)})
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso.bin`)
+	retries := 0
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 3, RetryDelay: time.Millisecond,
+		OnRetry: func(d *Download, attempt int, err error, nextDelay time.Duration) { retries++ },
+	}
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(`cut connection should be retried`, err)
+	}
+	if retries != 2 || server.Requests(`GET`) != 3 {
+		t.Errorf(`expected 2 retries and 3 requests but %d %d`, retries, server.Requests(`GET`))
+	}
+	if b, _ := ioutil.ReadFile(localPath); !bytes.Equal(b, content) {
+		t.Errorf(`retried file is broken`)
+	}
+}
+
+func TestNoPartFileLeftByConnectionError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != `GET` {
+			w.Header().Set(`Content-Length`, `4`)
+			return
+		}
+		// connection is closed without response
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 2, RetryDelay: time.Millisecond}
+	if err := New(&conf).SimpleFileDownload(server.URL+`/fuso`, filepath.Join(dir, `out`)); err == nil {
+		t.Fatal(`download should fail`)
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		for _, name := range names {
+			t.Error(`temp file is left`, name.Name())
+		}
+	}
+}
+
+func TestRetryFlakyServer(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	flaky := testutil.NewServer(content, testutil.Behavior{FailTimes: 2})
+	defer flaky.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso.bin`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 2, RetryDelay: time.Millisecond}
+	if err := New(&conf).SimpleFileDownload(flaky.URL, localPath); err != nil {
+		t.Errorf(`flaky download should succeed by retry %v`, err)
+	}
+	if n := flaky.Requests(`GET`); n != 3 {
+		t.Errorf(`expected 3 requests but %d`, n)
+	}
+	if b, _ := ioutil.ReadFile(localPath); !bytes.Equal(b, content) {
+		t.Errorf(`retried file is broken`)
+	}
+	broken := testutil.NewServer(content, testutil.Behavior{FailTimes: -1})
+	defer broken.Close()
+	conf.MaxRetry = 1
+	err := New(&conf).SimpleFileDownload(broken.URL, filepath.Join(t.TempDir(), `fuso.bin`))
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || downloadErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf(`expected 503 after retries but %v`, err)
+	}
+	if n := broken.Requests(`GET`); n != 2 {
+		t.Errorf(`expected 2 requests but %d`, n)
+	}
+}
+
+func TestPerFileTimeoutOfSlowServer(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	slow := testutil.NewServer(content, testutil.Behavior{ChunkSize: 100, ChunkWait: 100 * time.Millisecond})
+	defer slow.Close()
+	late := testutil.NewServer(content, testutil.Behavior{Latency: 5 * time.Second})
+	defer late.Close()
+	fast := testutil.NewServer(content, testutil.Behavior{})
+	defer fast.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 3, DownloadTimeoutMinutes: 1, PerFileTimeout: 300 * time.Millisecond}
+	fileDownloader := New(&conf)
+	var failed []string
+	for result := range fileDownloader.DownloadChan([]*Download{
+		{URL: slow.URL, LocalFilePath: filepath.Join(dir, `slow`)},
+		{URL: late.URL, LocalFilePath: filepath.Join(dir, `late`)},
+		{URL: fast.URL, LocalFilePath: filepath.Join(dir, `fast`)},
+	}) {
+		if errors.Is(result.Err, ErrFileTimeout) {
+			failed = append(failed, filepath.Base(result.Download.LocalFilePath))
+		} else if result.Err != nil {
+			t.Errorf(`unexpected error %v`, result.Err)
+		}
+	}
+	sort.Strings(failed)
+	if strings.Join(failed, `,`) != `late,slow` {
+		t.Errorf(`expected timeout of slow servers but %v`, failed)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `fast`)); !bytes.Equal(b, content) {
+		t.Errorf(`fast file is broken`)
+	}
+}
+
+func TestFailuresKeptWithContextError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == `/missing`:
+			http.NotFound(w, r)
+		case r.URL.Path == `/hang` && r.Method == `GET`:
+			<-r.Context().Done()
+		default:
+			w.Write([]byte(`fuso`))
+		}
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, BatchTimeout: 300 * time.Millisecond}
+	fileDownloader := New(&conf)
+	err := fileDownloader.MultipleFileDownload([]*Download{
+		{URL: server.URL + `/missing`, LocalFilePath: filepath.Join(dir, `missing`)},
+		{URL: server.URL + `/hang`, LocalFilePath: filepath.Join(dir, `hang`)},
+	})
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || downloadErr.StatusCode != http.StatusNotFound {
+		t.Errorf(`failure of the file is lost %v`, err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || fileDownloader.ContextError() != context.DeadlineExceeded {
+		t.Errorf(`timeout is not reported %v, %v`, err, fileDownloader.ContextError())
+	}
+	fileDownloader = New(&conf)
+	err = fileDownloader.MultipleFileDownload([]*Download{{URL: server.URL + `/missing`, LocalFilePath: filepath.Join(dir, `missing`)}})
+	if !errors.As(err, &downloadErr) || fileDownloader.ContextError() != nil {
+		t.Errorf(`expected only failure of the file %v, %v`, err, fileDownloader.ContextError())
+	}
+}
+
+func TestReadRanges(t *testing.T) {
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	for _, behavior := range []testutil.Behavior{{}, {NoRange: true}} {
+		server := testutil.NewServer(content, behavior)
+		var reads []*RangeRead
+		for _, r := range [][2]int64{{0, 10}, {10, 5}, {100, 20}, {110, 20}, {500, 4}} {
+			reads = append(reads, &RangeRead{Offset: r[0], Length: r[1], Dest: &bytes.Buffer{}})
+		}
+		if err := New(&Config{MaxDownloadThreads: 1, logfunc: myLogger}).ReadRanges(context.Background(), server.URL, reads); err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range reads {
+			if b := r.Dest.(*bytes.Buffer).Bytes(); !bytes.Equal(b, content[r.Offset:r.Offset+r.Length]) {
+				t.Errorf(`range %d-%d is broken %v`, r.Offset, r.Length, b)
+			}
+		}
+		if n := server.Requests(`GET`); n != 1 {
+			t.Errorf(`ranges should be read by a request but %d`, n)
+		}
+		if ranges := server.Ranges(); ranges[0] != `bytes=0-14,100-129,500-503` {
+			t.Errorf(`ranges are not merged %s`, ranges[0])
+		}
+		server.Close()
+	}
+	failing := testutil.NewServer(content, testutil.Behavior{FailTimes: -1})
+	defer failing.Close()
+	reads := []*RangeRead{{Offset: 0, Length: 10, Dest: &bytes.Buffer{}}}
+	var downloadErr *DownloadError
+	err := New(&Config{MaxDownloadThreads: 1, logfunc: myLogger}).ReadRanges(context.Background(), failing.URL, reads)
+	if !errors.As(err, &downloadErr) || downloadErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf(`expected 503 error but %v`, err)
+	}
+	// request is sent by the handler of the scheme
+	fileDownloader := New(&Config{MaxDownloadThreads: 1, logfunc: myLogger})
+	fileDownloader.RegisterScheme(`mem`, memHandler{`mem://bucket/fuso`: string(content)})
+	reads = []*RangeRead{{Offset: 100, Length: 10, Dest: &bytes.Buffer{}}}
+	if err := fileDownloader.ReadRanges(context.Background(), `mem://bucket/fuso`, reads); err != nil {
+		t.Fatal(err)
+	}
+	if b := reads[0].Dest.(*bytes.Buffer).Bytes(); !bytes.Equal(b, content[100:110]) {
+		t.Errorf(`range of the handler is broken %v`, b)
+	}
+}
+
+func TestMaxTotalRetries(t *testing.T) {
+	server := testutil.NewServer([]byte(`fuso`), testutil.Behavior{FailTimes: -1})
+	defer server.Close()
+	dir := t.TempDir()
+	var downloads []*Download
+	for _, name := range []string{`a`, `b`, `c`} {
+		downloads = append(downloads, &Download{URL: server.URL + `/` + name, LocalFilePath: filepath.Join(dir, name)})
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 2, RetryDelay: time.Millisecond, MaxTotalRetries: 3}
+	err := New(&conf).MultipleFileDownload(downloads)
+	if !errors.Is(err, ErrRetryBudgetExhausted) {
+		t.Errorf(`expected exhausted retry budget but %v`, err)
+	}
+	// 3 first requests and 3 retries of the batch
+	if n := server.Requests(`GET`); n != 6 {
+		t.Errorf(`expected 6 requests but %d`, n)
+	}
+}
+
+func TestDownloadMaxRetry(t *testing.T) {
+	server := testutil.NewServer([]byte(`fuso`), testutil.Behavior{FailTimes: -1})
+	defer server.Close()
+	dir := t.TempDir()
+	three, zero := 3, 0
+	downloads := []*Download{
+		{URL: server.URL + `/a`, LocalFilePath: filepath.Join(dir, `a`), MaxRetry: &three},
+		{URL: server.URL + `/b`, LocalFilePath: filepath.Join(dir, `b`), MaxRetry: &zero},
+		{URL: server.URL + `/c`, LocalFilePath: filepath.Join(dir, `c`)},
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 1, RetryDelay: time.Millisecond}
+	fileDownloader := New(&conf)
+	if err := fileDownloader.MultipleFileDownload(downloads); err == nil {
+		t.Fatal(`download should fail`)
+	}
+	counts := fileDownloader.RetryCounts()
+	for d, expected := range map[*Download]int{downloads[0]: 3, downloads[1]: 0, downloads[2]: 1} {
+		if counts[d] != expected {
+			t.Errorf(`expected %d retries of %s but %d`, expected, d.URL, counts[d])
+		}
+	}
+	// MaxTotalRetries limits retries of the file too
+	conf.MaxTotalRetries = 2
+	fileDownloader = New(&conf)
+	fileDownloader.MultipleFileDownload(downloads[:1])
+	if n := fileDownloader.RetryCounts()[downloads[0]]; n != 2 {
+		t.Errorf(`expected 2 retries but %d`, n)
+	}
+}
+
+func TestContentAddressedStorage(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	server := testutil.NewServer(content, testutil.Behavior{})
+	defer server.Close()
+	dir := t.TempDir()
+	casRoot := filepath.Join(dir, `cas`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, CASRoot: casRoot}
+	fileDownloader := New(&conf)
+	paths := make(map[string]string)
+	for result := range fileDownloader.DownloadChan([]*Download{
+		{URL: server.URL + `/a`, LocalFilePath: filepath.Join(dir, `fuso.bin`)},
+		{URL: server.URL + `/b`},
+	}) {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		paths[result.Download.URL] = result.Path
+	}
+	sum := sha256.Sum256(content)
+	hexSum := hex.EncodeToString(sum[:])
+	stored := filepath.Join(casRoot, hexSum[:2], hexSum[2:4], hexSum)
+	if b, _ := ioutil.ReadFile(stored); !bytes.Equal(b, content) {
+		t.Errorf(`file is not stored at %s`, stored)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `fuso.bin`)); !bytes.Equal(b, content) {
+		t.Errorf(`local file path does not have the stored file`)
+	}
+	if paths[server.URL+`/a`] != filepath.Join(dir, `fuso.bin`) || paths[server.URL+`/b`] != stored {
+		t.Errorf(`unexpected saved paths %v`, paths)
+	}
+	// same file is stored once, temp files are not left
+	var files []string
+	filepath.Walk(casRoot, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) != 1 {
+		t.Errorf(`expected only the stored file but %v`, files)
+	}
+}
+
+func TestPinnedCertSHA256(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	// trust the test server by the default transport
+	defer func(transport http.RoundTripper) { http.DefaultTransport = transport }(http.DefaultTransport)
+	http.DefaultTransport = server.Client().Transport
+	certSum := sha256.Sum256(server.Certificate().Raw)
+	spkiSum := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	dir := t.TempDir()
+	for _, pin := range []string{hex.EncodeToString(certSum[:]), base64.StdEncoding.EncodeToString(spkiSum[:])} {
+		conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, PinnedCertSHA256: []string{pin}}
+		if err := New(&conf).SimpleFileDownload(server.URL, filepath.Join(dir, `fuso`)); err != nil {
+			t.Errorf(`pinned certificate should be accepted %v`, err)
+		}
+	}
+	other := sha256.Sum256([]byte(`other`))
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 2, PinnedCertSHA256: []string{hex.EncodeToString(other[:])}}
+	err := New(&conf).SimpleFileDownload(server.URL, filepath.Join(dir, `other`))
+	if !errors.Is(err, ErrCertificatePinMismatch) {
+		t.Errorf(`expected pin mismatch but %v`, err)
+	}
+}
+
+func TestVerifyOnly(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			atomic.AddInt32(&gets, 1)
+		}
+		if r.URL.Path == `/gone` {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	sum := sha256.Sum256(content)
+	downloads := map[string]*Download{
+		`good`:     {URL: server.URL + `/good`, LocalFilePath: filepath.Join(dir, `good`), ExpectedSHA256: hex.EncodeToString(sum[:])},
+		`short`:    {URL: server.URL + `/short`, LocalFilePath: filepath.Join(dir, `short`)},
+		`broken`:   {URL: server.URL + `/broken`, LocalFilePath: filepath.Join(dir, `broken`), ExpectedSHA256: hex.EncodeToString(sum[:])},
+		`missing`:  {URL: server.URL + `/missing`, LocalFilePath: filepath.Join(dir, `missing`)},
+		`unsigned`: {URL: server.URL + `/unsigned`, LocalFilePath: filepath.Join(dir, `unsigned`)},
+		`gone`:     {URL: server.URL + `/gone`, LocalFilePath: filepath.Join(dir, `gone`)},
+	}
+	ioutil.WriteFile(downloads[`good`].LocalFilePath, content, 0644)
+	ioutil.WriteFile(downloads[`short`].LocalFilePath, content[:100], 0644)
+	ioutil.WriteFile(downloads[`broken`].LocalFilePath, bytes.ToUpper(content), 0644)
+	ioutil.WriteFile(downloads[`unsigned`].LocalFilePath, content, 0644)
+	ioutil.WriteFile(downloads[`gone`].LocalFilePath, content, 0644)
+	var list []*Download
+	for _, d := range downloads {
+		list = append(list, d)
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	results := New(&conf).VerifyOnly(list)
+	if len(results) != len(list) {
+		t.Fatalf(`expected %d results but %d`, len(list), len(results))
+	}
+	if err := results[downloads[`good`]]; err != nil {
+		t.Errorf(`good file should be verified %v`, err)
+	}
+	if err := results[downloads[`unsigned`]]; err != nil {
+		t.Errorf(`file of the remote size should be verified %v`, err)
+	}
+	var downloadErr *DownloadError
+	if err := results[downloads[`gone`]]; !errors.As(err, &downloadErr) || downloadErr.StatusCode != http.StatusNotFound {
+		t.Errorf(`expected 404 error but %v`, err)
+	}
+	if err := results[downloads[`short`]]; !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf(`expected size mismatch but %v`, err)
+	}
+	if err := results[downloads[`broken`]]; !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf(`expected checksum mismatch but %v`, err)
+	}
+	if err := results[downloads[`missing`]]; !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf(`expected missing file but %v`, err)
+	}
+	if n := atomic.LoadInt32(&gets); n != 0 {
+		t.Errorf(`files should not be downloaded, %d GET requests`, n)
+	}
+}
+
+func TestRetryChecksumMismatch(t *testing.T) {
+	// use small buffer so that small test file is treated as resumable file.
+	defer func(size int) { copyBufferSize = size }(copyBufferSize)
+	copyBufferSize = 64
+	content := bytes.Repeat([]byte(`fuso`), 10000)
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := content
+		if r.Method == `GET` {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get(`Range`))
+			// proxy breaks the first transfer
+			if len(ranges) == 1 {
+				body = bytes.ToUpper(content)
+			}
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(body))
+	}))
+	defer server.Close()
+	sum := sha256.Sum256(content)
+	d := &Download{URL: server.URL, LocalFilePath: filepath.Join(t.TempDir(), `fuso.bin`), ExpectedSHA256: hex.EncodeToString(sum[:])}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 1, RetryDelay: time.Millisecond, ResumeFromPartial: true}
+	if err := New(&conf).MultipleFileDownload([]*Download{d}); err != nil {
+		t.Fatalf(`broken transfer should be retried %v`, err)
+	}
+	if b, _ := ioutil.ReadFile(d.LocalFilePath); !bytes.Equal(b, content) {
+		t.Errorf(`retried file is broken`)
+	}
+	if len(ranges) != 2 || strings.HasPrefix(ranges[1], `bytes=`) && !strings.HasPrefix(ranges[1], `bytes=0-`) {
+		t.Errorf(`retry should download whole file %q`, ranges)
+	}
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(bytes.ToUpper(content)))
+	}))
+	defer broken.Close()
+	conf.MaxRetry = 0
+	d = &Download{URL: broken.URL, LocalFilePath: filepath.Join(t.TempDir(), `fuso.bin`), ExpectedSHA256: hex.EncodeToString(sum[:])}
+	if err := New(&conf).MultipleFileDownload([]*Download{d}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf(`expected checksum mismatch but %v`, err)
+	}
+}
+
+func TestProgressDropOnBackpressure(t *testing.T) {
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = 10 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Length`, `40`)
+		if r.Method == `HEAD` {
+			return
+		}
+		for i := 0; i < 10; i++ {
+			w.Write([]byte(`fuso`))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, RequiresDetailProgress: true,
+		ProgressBuffer: 2, ProgressDropOnBackpressure: true}
+	fileDownloader := New(&conf)
+	if cap(fileDownloader.ProgressChan) != 2 || cap(fileDownloader.DownloadBytesPerSecond) != 2 {
+		t.Errorf(`unexpected buffer size %d`, cap(fileDownloader.ProgressChan))
+	}
+	// nobody reads the channels while downloading
+	if err := fileDownloader.SimpleFileDownload(server.URL, filepath.Join(t.TempDir(), `fuso`)); err != nil {
+		t.Fatal(err)
+	}
+	var values []float64
+	for p := range fileDownloader.ProgressChan {
+		values = append(values, p)
+	}
+	if len(values) == 0 || len(values) > 2 {
+		t.Fatalf(`unexpected progress values %v`, values)
+	}
+	// oldest values are dropped
+	if last := values[len(values)-1]; last < 0.5 {
+		t.Errorf(`latest progress is not kept %v`, values)
+	}
+}
+
+func TestRecommendThreads(t *testing.T) {
+	defer func(size int64) { calibrationProbeBytes = size }(calibrationProbeBytes)
+	calibrationProbeBytes = 4096
+	content := bytes.Repeat([]byte(`fuso`), 2048)
+	// server handles only 2 requests at a time
+	slots := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/missing` {
+			http.NotFound(w, r)
+			return
+		}
+		slots <- struct{}{}
+		defer func() { <-slots }()
+		time.Sleep(50 * time.Millisecond)
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	fileDownloader := New(&conf)
+	threads, err := fileDownloader.RecommendThreads(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if threads != 2 {
+		t.Errorf(`expected 2 threads but %d`, threads)
+	}
+	if _, err := fileDownloader.RecommendThreads(context.Background(), server.URL+`/missing`); !errors.Is(err, ErrDownload) {
+		t.Errorf(`expected download error but %v`, err)
+	}
+}
+
+func TestAdditionalPaths(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			atomic.AddInt32(&gets, 1)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	d := &Download{URL: server.URL, LocalFilePath: filepath.Join(dir, `fuso-1.0.bin`),
+		AdditionalPaths: []string{filepath.Join(dir, `fuso-latest.bin`), filepath.Join(dir, `fuso-stable.bin`)}}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	var results []Result
+	for r := range New(&conf).DownloadChan([]*Download{d}) {
+		results = append(results, r)
+	}
+	if len(results) != 1 || results[0].Err != nil {
+		t.Fatalf(`unexpected results %+v`, results)
+	}
+	if strings.Join(results[0].AdditionalPaths, `,`) != strings.Join(d.AdditionalPaths, `,`) {
+		t.Errorf(`created paths are not reported %q`, results[0].AdditionalPaths)
+	}
+	saved, _ := os.Stat(d.LocalFilePath)
+	for _, path := range d.AdditionalPaths {
+		if b, _ := ioutil.ReadFile(path); !bytes.Equal(b, content) {
+			t.Errorf(`%s does not have the downloaded file`, path)
+		}
+		if info, err := os.Stat(path); err != nil || !os.SameFile(saved, info) {
+			t.Errorf(`%s is not linked to the downloaded file`, path)
+		}
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf(`file should be downloaded once but %d`, n)
+	}
+}
+
+type testSpan struct {
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	events     []string
+	errs       []error
+	ended      bool
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *testSpan) AddEvent(name string, attributes map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, name)
+}
+
+func (s *testSpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, err)
+}
+
+func (s *testSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+}
+
+type recordingTracer struct {
+	start func(span *testSpan)
+}
+
+func (tr *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &testSpan{attributes: map[string]interface{}{`parent`: ctx.Value(parentKey{})}}
+	tr.start(span)
+	return ctx, span
+}
+
+type parentKey struct{}
+
+func TestTracer(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	flaky := testutil.NewServer(content, testutil.Behavior{FailTimes: 1})
+	defer flaky.Close()
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	var mu sync.Mutex
+	var spans []*testSpan
+	tracer := &recordingTracer{start: func(span *testSpan) {
+		mu.Lock()
+		defer mu.Unlock()
+		spans = append(spans, span)
+	}}
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 1, RetryDelay: time.Millisecond, Tracer: tracer}
+	ctx := context.WithValue(context.Background(), parentKey{}, `batch`)
+	err := New(&conf).MultipleFileDownloadContext(ctx, []*Download{
+		{URL: flaky.URL, LocalFilePath: filepath.Join(dir, `fuso`)},
+		{URL: missing.URL, LocalFilePath: filepath.Join(dir, `missing`)},
+	})
+	if err == nil {
+		t.Fatal(`expected error of missing file`)
+	}
+	if len(spans) != 2 {
+		t.Fatalf(`expected 2 spans but %d`, len(spans))
+	}
+	for _, span := range spans {
+		if !span.ended || span.attributes[`parent`] != `batch` {
+			t.Errorf(`unexpected span %+v`, span)
+		}
+		switch span.attributes[`url`] {
+		case flaky.URL:
+			if span.attributes[`outcome`] != `succeeded` || span.attributes[`retries`] != 1 || span.attributes[`bytes`] != int64(len(content)) ||
+				strings.Join(span.events, `,`) != `retry,completed` {
+				t.Errorf(`unexpected span of retried file %+v`, span)
+			}
+		default:
+			if span.attributes[`outcome`] != `failed` || len(span.errs) != 1 {
+				t.Errorf(`unexpected span of failed file %+v`, span)
+			}
+		}
+	}
+}
+
+func TestRetryFailed(t *testing.T) {
+	var mu sync.Mutex
+	gets := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			mu.Lock()
+			gets[r.URL.Path]++
+			n := gets[r.URL.Path]
+			mu.Unlock()
+			// flaky file fails in the first run
+			if r.URL.Path == `/flaky` && n == 1 {
+				http.Error(w, `not yet`, http.StatusNotFound)
+				return
+			}
+		}
+		http.ServeContent(w, r, ``, time.Time{}, strings.NewReader(r.URL.Path))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	good := &Download{URL: server.URL + `/good`, LocalFilePath: filepath.Join(dir, `good`)}
+	flaky := &Download{URL: server.URL + `/flaky`, LocalFilePath: filepath.Join(dir, `flaky`)}
+	copied := &Download{URL: server.URL + `/flaky`, LocalFilePath: filepath.Join(dir, `copied`)}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, RequiresDetailProgress: true}
+	fileDownloader := New(&conf)
+	if err := fileDownloader.MultipleFileDownload([]*Download{good, flaky, copied}); err == nil {
+		t.Fatal(`expected error of flaky file`)
+	}
+	results := fileDownloader.Results()
+	if len(results) != 3 || results[good] != nil || results[flaky] == nil || results[copied] == nil {
+		t.Fatalf(`unexpected results of first run %v`, results)
+	}
+	if err := fileDownloader.RetryFailed(); err != nil {
+		t.Fatalf(`retry should succeed %v`, err)
+	}
+	results = fileDownloader.Results()
+	if len(results) != 3 || results[good] != nil || results[flaky] != nil || results[copied] != nil {
+		t.Errorf(`results are not updated %v`, results)
+	}
+	for _, d := range []*Download{good, flaky, copied} {
+		if b, _ := ioutil.ReadFile(d.LocalFilePath); d.URL != server.URL+string(b) {
+			t.Errorf(`%s is not downloaded`, d.LocalFilePath)
+		}
+	}
+	if gets[`/good`] != 1 || gets[`/flaky`] != 2 {
+		t.Errorf(`only failed file should be downloaded again %v`, gets)
+	}
+	if fileDownloader.Outcome() != OutcomeCompleted {
+		t.Errorf(`unexpected outcome %s`, fileDownloader.Outcome())
+	}
+	if err := fileDownloader.RetryFailed(); err != nil {
+		t.Errorf(`nothing to retry %v`, err)
+	}
+}
+
+func TestInsecureRedirect(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`fuso`))
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.RedirectHandler(plain.URL, http.StatusFound))
+	defer secure.Close()
+	// trust the test server by the default transport
+	defer func(transport http.RoundTripper) { http.DefaultTransport = transport }(http.DefaultTransport)
+	http.DefaultTransport = secure.Client().Transport
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 2}
+	if err := New(&conf).SimpleFileDownload(secure.URL, filepath.Join(dir, `refused`)); !errors.Is(err, ErrInsecureRedirect) {
+		t.Errorf(`expected insecure redirect but %v`, err)
+	}
+	conf.AllowInsecureRedirect = true
+	if err := New(&conf).SimpleFileDownload(secure.URL, filepath.Join(dir, `allowed`)); err != nil {
+		t.Errorf(`redirect should be allowed %v`, err)
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	var cut int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `image/png`)
+		if r.URL.Path == `/named` {
+			w.Header().Set(`Content-Disposition`, `attachment; filename="fuso.png"`)
+		}
+		// first GET of typed file is cut after the path is resolved
+		if r.URL.Path == `/typed` && r.Method == `GET` && atomic.AddInt32(&cut, 1) == 1 {
+			w.Header().Set(`Content-Length`, `100`)
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var mu sync.Mutex
+	defaults := make(map[string]string)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, MaxRetry: 1, RetryDelay: time.Millisecond,
+		ResolvePath: func(d *Download, resp *http.Response, defaultPath string) (string, error) {
+			mu.Lock()
+			defaults[d.URL] = defaultPath
+			mu.Unlock()
+			if d.URL == server.URL+`/refused` {
+				return ``, errors.New(`refused`)
+			}
+			if _, params, err := mime.ParseMediaType(resp.Header.Get(`Content-Disposition`)); err == nil {
+				return filepath.Join(dir, params[`filename`]), nil
+			}
+			exts, _ := mime.ExtensionsByType(resp.Header.Get(`Content-Type`))
+			return defaultPath + exts[0], nil
+		}}
+	named := &Download{URL: server.URL + `/named`}
+	typed := &Download{URL: server.URL + `/typed`, LocalFilePath: filepath.Join(dir, `typed`)}
+	refused := &Download{URL: server.URL + `/refused`, LocalFilePath: filepath.Join(dir, `refused`)}
+	err := New(&conf).MultipleFileDownload([]*Download{named, typed, refused})
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || downloadErr.URL != refused.URL {
+		t.Errorf(`expected error of refused file but %v`, err)
+	}
+	if defaults[named.URL] != `` || defaults[typed.URL] != filepath.Join(dir, `typed`) {
+		t.Errorf(`unexpected default paths %v`, defaults)
+	}
+	// resolved path is set only to the download without a path, retried download is resolved from the same default
+	if named.LocalFilePath != filepath.Join(dir, `fuso.png`) || typed.LocalFilePath != filepath.Join(dir, `typed`) {
+		t.Errorf(`unexpected local paths %s %s`, named.LocalFilePath, typed.LocalFilePath)
+	}
+	for path, d := range map[string]*Download{`fuso.png`: named, `typed.png`: typed} {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, path)); d.URL != server.URL+string(b) {
+			t.Errorf(`%s is not downloaded`, path)
+		}
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf(`temp files are left %d`, len(files))
+	}
+}
+
+func TestAllowedWindows(t *testing.T) {
+	window := TimeWindow{Start: 23 * time.Hour, End: 2 * time.Hour}
+	at := func(hour, minute int) time.Time { return time.Date(2021, 1, 1, hour, minute, 0, 0, time.Local) }
+	if !window.contains(at(23, 30)) || !window.contains(at(1, 0)) || window.contains(at(2, 0)) || window.contains(at(12, 0)) {
+		t.Errorf(`window crossing midnight is not checked`)
+	}
+	if d := window.until(at(22, 0)); d != time.Hour {
+		t.Errorf(`expected 1h until the window but %s`, d)
+	}
+	if d := (TimeWindow{Start: time.Hour, End: 5 * time.Hour}).until(at(6, 0)); d != 19*time.Hour {
+		t.Errorf(`expected 19h until the window of next day but %s`, d)
+	}
+	// fake clock
+	defer func(now func() time.Time, interval time.Duration) { timeNow, windowCheckInterval = now, interval }(timeNow, windowCheckInterval)
+	windowCheckInterval = 10 * time.Millisecond
+	var clock atomic.Value
+	clock.Store(at(0, 30))
+	timeNow = func() time.Time { return clock.Load().(time.Time) }
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1,
+		AllowedWindows: []TimeWindow{{Start: time.Hour, End: 5 * time.Hour}}}
+	done := make(chan error)
+	go func() {
+		done <- New(&conf).SimpleFileDownload(server.URL, filepath.Join(t.TempDir(), `fuso`))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&gets); n != 0 {
+		t.Errorf(`download started out of the window`)
+	}
+	clock.Store(at(1, 30))
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`download did not start in the window`)
+	}
+}
+
+func TestResumeState(t *testing.T) {
+	dir := t.TempDir()
+	saved := &Download{URL: `http://localhost/saved`, LocalFilePath: filepath.Join(dir, `saved`)}
+	partial := &Download{URL: `http://localhost/partial`, LocalFilePath: filepath.Join(dir, `partial`)}
+	foreign := &Download{URL: `http://localhost/foreign`, LocalFilePath: filepath.Join(dir, `foreign`)}
+	missing := &Download{URL: `http://localhost/missing`, LocalFilePath: filepath.Join(dir, `missing`)}
+	ioutil.WriteFile(saved.LocalFilePath, make([]byte, 300), 0644)
+	ioutil.WriteFile(partial.LocalFilePath+`.part`, make([]byte, 200), 0644)
+	ioutil.WriteFile(partial.LocalFilePath+`.part.meta`, []byte(`{"contentLength":1000,"etag":""}`), 0644)
+	// temp file not made by the downloader
+	ioutil.WriteFile(foreign.LocalFilePath+`.part`, make([]byte, 100), 0644)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, ResumeFromPartial: true}
+	state := New(&conf).ResumeState([]*Download{saved, partial, foreign, missing})
+	if state[saved] != 300 || state[partial] != 200 || state[foreign] != 0 || state[missing] != 0 || len(state) != 4 {
+		t.Errorf(`unexpected resume state %v`, state)
+	}
+}
+
+func TestDownloadAndExtract(t *testing.T) {
+	var tarGz, zipped, unsafe bytes.Buffer
+	gz := gzip.NewWriter(&tarGz)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: `fuso/`, Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: `fuso/ugin.txt`, Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte(`ugin`))
+	tw.Close()
+	gz.Close()
+	zw := zip.NewWriter(&zipped)
+	w, _ := zw.Create(`fuso/korvold.txt`)
+	w.Write([]byte(`korvold`))
+	zw.Close()
+	tw = tar.NewWriter(&unsafe)
+	tw.WriteHeader(&tar.Header{Name: `../escaped.txt`, Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte(`fuso`))
+	tw.Close()
+	archives := map[string][]byte{`/fuso.tar.gz`: tarGz.Bytes(), `/fuso.zip`: zipped.Bytes(), `/unsafe.tar`: unsafe.Bytes()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(archives[r.URL.Path]))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	if err := New(&conf).DownloadAndExtract(context.Background(), server.URL+`/fuso.tar.gz`, filepath.Join(dir, `targz`)); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `targz`, `fuso`, `ugin.txt`)); string(b) != `ugin` {
+		t.Errorf(`tar.gz is not extracted %q`, b)
+	}
+	if err := New(&conf).DownloadAndExtract(context.Background(), server.URL+`/fuso.zip`, filepath.Join(dir, `zip`)); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `zip`, `fuso`, `korvold.txt`)); string(b) != `korvold` {
+		t.Errorf(`zip is not extracted %q`, b)
+	}
+	err := New(&conf).DownloadAndExtract(context.Background(), server.URL+`/unsafe.tar`, filepath.Join(dir, `unsafe`))
+	if !errors.Is(err, ErrUnsafeArchivePath) {
+		t.Errorf(`expected unsafe path but %v`, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, `escaped.txt`)); !os.IsNotExist(err) {
+		t.Errorf(`entry escaped from the destination`)
+	}
+	// nothing is left on failure
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf(`files are left on failure %d`, len(files))
+	}
+}
+
+func TestKnownSize(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 20000)
+	// generated file without Content-Length
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.0 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n")
+		if r.Method == `GET` {
+			buf.Write(content)
+		}
+		buf.Flush()
+	}))
+	defer server.Close()
+	var total int64
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1,
+		OnTotalSizeKnown: func(totalBytes int64, fileCount int) { total = totalBytes }}
+	fileDownloader := New(&conf)
+	d := &Download{URL: server.URL, LocalFilePath: filepath.Join(t.TempDir(), `fuso.bin`), KnownSize: int64(len(content))}
+	if err := fileDownloader.MultipleFileDownload([]*Download{d}); err != nil {
+		t.Fatal(err)
+	}
+	if total != int64(len(content)) || fileDownloader.TotalFilesSize != int64(len(content)) {
+		t.Errorf(`known size is not used for progress %d %d`, total, fileDownloader.TotalFilesSize)
+	}
+}
+
+// file system whose disk is full
+type fullDiskFileSystem struct {
+	osFileSystem
+}
+
+type fullDiskFile struct {
+	io.WriteCloser
+}
+
+func (f fullDiskFile) Write(p []byte) (int, error) {
+	return 0, errors.New(`no space left on device`)
+}
+
+func (fs fullDiskFileSystem) Create(name string) (io.WriteCloser, error) {
+	w, err := fs.osFileSystem.Create(name)
+	return fullDiskFile{w}, err
+}
+
+func TestFileSystemError(t *testing.T) {
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 2, RetryDelay: time.Millisecond,
+		FileSystem: fullDiskFileSystem{}}
+	err := New(&conf).SimpleFileDownload(server.URL, filepath.Join(t.TempDir(), `fuso`))
+	var fsErr *FileSystemError
+	if !errors.As(err, &fsErr) {
+		t.Errorf(`expected file system error but %v`, err)
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf(`file system error should not be retried, %d requests`, n)
+	}
+	broken := testutil.NewServer([]byte(`fuso`), testutil.Behavior{FailTimes: -1})
+	defer broken.Close()
+	conf = Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	if err := New(&conf).SimpleFileDownload(broken.URL, filepath.Join(t.TempDir(), `fuso`)); err == nil || errors.As(err, &fsErr) {
+		t.Errorf(`expected network error but %v`, err)
+	}
+}
+
+func TestRemoteFile(t *testing.T) {
+	defer func(size int64) { remoteBlockSize = size }(remoteBlockSize)
+	remoteBlockSize = 512
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: `large.bin`, Method: zip.Store})
+	w.Write(bytes.Repeat([]byte(`fuso`), 100000))
+	w, _ = zw.Create(`ugin.txt`)
+	w.Write([]byte(`ugin`))
+	zw.Close()
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			atomic.AddInt32(&gets, 1)
+		}
+		if r.URL.Path == `/missing.zip` {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(zipped.Bytes()))
+	}))
+	defer server.Close()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	var downloadErr *DownloadError
+	if _, err := New(&conf).OpenRemote(context.Background(), server.URL+`/missing.zip`); !errors.As(err, &downloadErr) || downloadErr.StatusCode != http.StatusNotFound {
+		t.Errorf(`expected 404 error but %v`, err)
+	}
+	remote, err := New(&conf).OpenRemote(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.Size() != int64(zipped.Len()) {
+		t.Errorf(`expected size %d but %d`, zipped.Len(), remote.Size())
+	}
+	zr, err := zip.NewReader(remote, remote.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if f.Name != `ugin.txt` {
+			continue
+		}
+		r, _ := f.Open()
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(b) != `ugin` {
+			t.Errorf(`unexpected member %q`, b)
+		}
+	}
+	// only blocks of the central directory and the member are fetched
+	if len(remote.blocks)*int(remoteBlockSize) > zipped.Len()/10 {
+		t.Errorf(`too many blocks are fetched %d`, len(remote.blocks))
+	}
+	requests := atomic.LoadInt32(&gets)
+	b := make([]byte, 4)
+	if _, err := remote.ReadAt(b, remote.Size()-4); err != nil || atomic.LoadInt32(&gets) != requests {
+		t.Errorf(`cached block should be read without request %v`, err)
+	}
+	if n, err := remote.ReadAt(b, remote.Size()-2); n != 2 || err != io.EOF {
+		t.Errorf(`expected EOF at the end %d %v`, n, err)
+	}
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`fuso`))
+	}))
+	defer plain.Close()
+	if _, err := New(&conf).OpenRemote(context.Background(), plain.URL); !errors.Is(err, ErrRangeNotSupported) {
+		t.Errorf(`expected range not supported but %v`, err)
+	}
+}
+
+func TestExpectingSize(t *testing.T) {
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			atomic.AddInt32(&gets, 1)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(bytes.Repeat([]byte(`fuso`), 1000)))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	downloads := func() []*Download {
+		return []*Download{
+			{URL: server.URL + `/1`, LocalFilePath: filepath.Join(dir, `1.bin`)},
+			{URL: server.URL + `/2`, LocalFilePath: filepath.Join(dir, `2.bin`)},
+		}
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1}
+	err := New(&conf).MultipleFileDownloadExpectingSize(downloads(), 7000)
+	if !errors.Is(err, ErrTotalSizeMismatch) {
+		t.Errorf(`expected size mismatch but %v`, err)
+	}
+	if atomic.LoadInt32(&gets) != 0 {
+		t.Errorf(`files should not be downloaded on mismatch`)
+	}
+	conf.ExpectedSizeTolerance = 1000
+	if err := New(&conf).MultipleFileDownloadExpectingSize(downloads(), 7000); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&gets) != 2 {
+		t.Errorf(`expected 2 downloads but %d`, gets)
+	}
+}
+
+type countingMetrics struct {
+	bytes, rates, done, errors int64
+}
+
+func (c *countingMetrics) AddBytes(n int64)                 { atomic.AddInt64(&c.bytes, n) }
+func (c *countingMetrics) ObserveRate(bytesPerSecond int64) { atomic.AddInt64(&c.rates, 1) }
+func (c *countingMetrics) IncFilesDone()                    { atomic.AddInt64(&c.done, 1) }
+func (c *countingMetrics) IncErrors()                       { atomic.AddInt64(&c.errors, 1) }
+
+func TestMetricsRecorder(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 10000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/missing` {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set(`Content-Length`, strconv.Itoa(len(content)))
+		if r.Method == `GET` {
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			time.Sleep(1200 * time.Millisecond)
+			w.Write(content[len(content)/2:])
+		}
+	}))
+	defer server.Close()
+	metrics := &countingMetrics{}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 3, DownloadTimeoutMinutes: 1, MetricsRecorder: metrics}
+	dir := t.TempDir()
+	downloads := []*Download{
+		{URL: server.URL + `/1`, LocalFilePath: filepath.Join(dir, `1.bin`)},
+		{URL: server.URL + `/2`, LocalFilePath: filepath.Join(dir, `2.bin`)},
+		{URL: server.URL + `/missing`, LocalFilePath: filepath.Join(dir, `3.bin`)},
+	}
+	New(&conf).MultipleFileDownload(downloads)
+	if metrics.bytes != int64(len(content))*2 {
+		t.Errorf(`expected %d bytes but %d`, len(content)*2, metrics.bytes)
+	}
+	if metrics.done != 2 || metrics.errors != 1 {
+		t.Errorf(`expected 2 files done and 1 error but %d %d`, metrics.done, metrics.errors)
+	}
+	if metrics.rates == 0 {
+		t.Errorf(`rate is not observed`)
+	}
+}
+
+func TestDownloadNewerThan(t *testing.T) {
+	served := t.TempDir()
+	cutoff := time.Now().Add(-time.Hour)
+	for name, modTime := range map[string]time.Time{`old.txt`: cutoff.Add(-time.Hour), `new.txt`: cutoff.Add(time.Minute)} {
+		path := filepath.Join(served, name)
+		ioutil.WriteFile(path, []byte(name), 0644)
+		os.Chtimes(path, modTime, modTime)
+	}
+	os.Mkdir(filepath.Join(served, `sub`), 0755)
+	mux := http.NewServeMux()
+	mux.Handle(`/files/`, http.StripPrefix(`/files/`, http.FileServer(http.Dir(served))))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	dest := t.TempDir()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1}
+	// redirected to /files/
+	if err := New(&conf).DownloadNewerThan(context.Background(), server.URL+`/files`, dest, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := ioutil.ReadDir(dest)
+	if len(names) != 1 || names[0].Name() != `new.txt` {
+		t.Errorf(`only new file should be downloaded %v`, names)
+	}
+	conf.Lister = func(ctx context.Context, baseURL string) ([]RemoteEntry, error) {
+		return []RemoteEntry{{Name: `../new.txt`, URL: baseURL + `/new.txt`, Size: -1, ModTime: time.Now()}}, nil
+	}
+	if err := New(&conf).DownloadNewerThan(context.Background(), server.URL+`/files`, dest, cutoff); !errors.Is(err, ErrUnsafeEntryName) {
+		t.Errorf(`expected unsafe name but %v`, err)
+	}
+}
+
+func TestSuspend(t *testing.T) {
+	defer func(size int) { copyBufferSize = size }(copyBufferSize)
+	copyBufferSize = 64
+	content := bytes.Repeat([]byte(`0123456789`), 20000)
+	var gets int32
+	var rangeHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`ETag`, `"fuso"`)
+		if r.Method == `GET` {
+			if atomic.AddInt32(&gets, 1) == 1 {
+				// send half of the file and stall until suspended
+				w.Header().Set(`Content-Length`, strconv.Itoa(len(content)))
+				w.Write(content[:len(content)/2])
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				return
+			}
+			rangeHeader = r.Header.Get(`Range`)
+		}
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), `fuso.bin`)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	fileDownloader := New(&conf)
+	go fileDownloader.SimpleFileDownload(server.URL, localPath)
+	for i := 0; ; i++ {
+		if info, err := os.Stat(localPath + `.part`); err == nil && info.Size() == int64(len(content)/2) {
+			break
+		}
+		if i == 100 {
+			t.Fatal(`download did not start`)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := fileDownloader.Suspend(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(localPath + `.part` + resumeMetaSuffix); err != nil {
+		t.Fatal(`resume metadata is not written:`, err)
+	}
+	conf.ResumeFromPartial = true
+	if err := New(&conf).SimpleFileDownload(server.URL, localPath); err != nil {
+		t.Fatal(err)
+	}
+	if rangeHeader == `` || strings.HasPrefix(rangeHeader, `bytes=0-`) {
+		t.Errorf(`download is not resumed, range header: %q`, rangeHeader)
+	}
+	if b, _ := ioutil.ReadFile(localPath); !bytes.Equal(b, content) {
+		t.Errorf(`resumed file is broken`)
+	}
+}
+
+func TestDownloadMethodAndBody(t *testing.T) {
+	var heads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `HEAD` {
+			atomic.AddInt32(&heads, 1)
+		}
+		if r.Method != `POST` {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == `/fail` {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(`report of ` + string(body)))
+	}))
+	defer server.Close()
+	var total int64
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1,
+		OnTotalSizeKnown: func(totalBytes int64, fileCount int) { total = totalBytes }}
+	dir := t.TempDir()
+	downloads := []*Download{
+		{URL: server.URL, LocalFilePath: filepath.Join(dir, `fuso.txt`), Method: `POST`, Body: []byte(`fuso`)},
+		{URL: server.URL, LocalFilePath: filepath.Join(dir, `ugin.txt`), Method: `POST`, Body: []byte(`ugin`)},
+	}
+	if err := New(&conf).MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`fuso`, `ugin`} {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, name+`.txt`)); string(b) != `report of `+name {
+			t.Errorf(`unexpected file %q`, b)
+		}
+	}
+	if atomic.LoadInt32(&heads) != 0 {
+		t.Errorf(`HEAD request should not be sent`)
+	}
+	if total != int64(len(`report of fuso`)*2) {
+		t.Errorf(`size should be told by the responses %d`, total)
+	}
+	// failed POST does not hide the size of the batch
+	total = -1
+	downloads = []*Download{
+		{URL: server.URL + `/fail`, LocalFilePath: filepath.Join(dir, `fail.txt`), Method: `POST`, Body: []byte(`fail`)},
+		{URL: server.URL, LocalFilePath: filepath.Join(dir, `ugin.txt`), Method: `POST`, Body: []byte(`ugin`)},
+	}
+	if err := New(&conf).MultipleFileDownload(downloads); err == nil {
+		t.Error(`failed POST should fail the batch`)
+	}
+	if total != int64(len(`report of ugin`)) {
+		t.Errorf(`size should be known without the failed file %d`, total)
+	}
+}
+
+func TestPendingSizeOfFailedFile(t *testing.T) {
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = 20 * time.Millisecond
+	content := bytes.Repeat([]byte(`f`), 30*1024)
+	server := testutil.NewServer(content, testutil.Behavior{ChunkSize: 1024, ChunkWait: 10 * time.Millisecond})
+	defer server.Close()
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	dir := t.TempDir()
+	var totalBytes int64 = -1
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, SingleRequestMode: true, RequiresDetailProgress: true,
+		OnTotalSizeKnown: func(total int64, count int) { atomic.StoreInt64(&totalBytes, total) }}
+	fileDownloader := New(&conf)
+	var progresses int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range fileDownloader.ProgressChan {
+			atomic.AddInt32(&progresses, 1)
+		}
+	}()
+	go func() {
+		for range fileDownloader.DownloadBytesPerSecond {
+		}
+	}()
+	err := fileDownloader.MultipleFileDownload([]*Download{
+		{URL: missing.URL + `/missing`, LocalFilePath: filepath.Join(dir, `missing`)},
+		{URL: server.URL + `/fuso`, LocalFilePath: filepath.Join(dir, `fuso`)},
+	})
+	<-done
+	if err == nil {
+		t.Error(`missing file should fail`)
+	}
+	if n := atomic.LoadInt32(&progresses); n == 0 {
+		t.Error(`progress should be reported when a file failed`)
+	}
+	if total := atomic.LoadInt64(&totalBytes); total != int64(len(content)) {
+		t.Errorf(`expected total size %d but %d`, len(content), total)
+	}
+}
+
+func TestCaseCollisions(t *testing.T) {
+	defer func(f func(string) bool) { isCaseInsensitiveDir = f }(isCaseInsensitiveDir)
+	isCaseInsensitiveDir = func(dir string) bool { return true }
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	downloads := func() []*Download {
+		return []*Download{
+			{URL: server.URL + `/upper`, LocalFilePath: filepath.Join(dir, `File.txt`)},
+			{URL: server.URL + `/lower`, LocalFilePath: filepath.Join(dir, `file.txt`)},
+		}
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1}
+	collided := downloads()
+	if err := New(&conf).MultipleFileDownload(collided); !errors.Is(err, ErrPathCollision) {
+		t.Errorf(`expected path collision but %v`, err)
+	}
+	if b, _ := ioutil.ReadFile(collided[0].LocalFilePath); string(b) != `/upper` {
+		t.Errorf(`first download should be saved %q`, b)
+	}
+	conf.RenameCaseCollisions = true
+	renamed := downloads()
+	if err := New(&conf).MultipleFileDownload(renamed); err != nil {
+		t.Fatal(err)
+	}
+	if renamed[1].LocalFilePath != filepath.Join(dir, `file-1.txt`) {
+		t.Errorf(`collided path is not renamed %s`, renamed[1].LocalFilePath)
+	}
+	if b, _ := ioutil.ReadFile(renamed[1].LocalFilePath); string(b) != `/lower` {
+		t.Errorf(`renamed download is not saved %q`, b)
+	}
+	// same URL to the collided path is not a duplicate linked over the first file
+	conf.RenameCaseCollisions = false
+	sameURL := []*Download{
+		{URL: server.URL + `/same`, LocalFilePath: filepath.Join(dir, `Same.txt`)},
+		{URL: server.URL + `/same`, LocalFilePath: filepath.Join(dir, `same.txt`)},
+	}
+	if err := New(&conf).MultipleFileDownload(sameURL); !errors.Is(err, ErrPathCollision) {
+		t.Errorf(`expected path collision of the same URL but %v`, err)
+	}
+	if b, _ := ioutil.ReadFile(sameURL[0].LocalFilePath); string(b) != `/same` {
+		t.Errorf(`first download of the URL should be saved %q`, b)
+	}
+	if !caseInsensitiveDir(dir) && caseInsensitiveDir(filepath.Join(dir, `missing`)) {
+		t.Errorf(`missing directory should be checked by its parent`)
+	}
+}
+
+// writer taking time for each write
+type slowWriter struct {
+	bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(100 * time.Millisecond)
+	return w.Buffer.Write(p)
+}
+
+func TestDownloadToWriter(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	var mu sync.Mutex
+	var downloaded, total int64
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, RequiresDetailProgress: true,
+		OnFileProgress: func(d *Download, downloadedBytes, totalBytes, bytesPerSecond int64) {
+			mu.Lock()
+			downloaded, total = downloadedBytes, totalBytes
+			mu.Unlock()
+		}}
+	fileDownloader := New(&conf)
+	var progress float64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for p := range fileDownloader.ProgressChan {
+			progress = p
+		}
+	}()
+	go func() {
+		for range fileDownloader.DownloadBytesPerSecond {
+		}
+	}()
+	w := &slowWriter{}
+	if err := fileDownloader.DownloadToWriter(context.Background(), server.URL, w); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if !bytes.Equal(w.Bytes(), content) {
+		t.Errorf(`file is not written to the writer`)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if downloaded != int64(len(content)) || total != int64(len(content)) {
+		t.Errorf(`progress of the writer is not reported %d / %d`, downloaded, total)
+	}
+	if progress <= 0 {
+		t.Errorf(`progress is not sent`)
+	}
+}
+
+func TestDownloadNewerThanMissingEntries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/gone.txt` {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1,
+		Lister: func(ctx context.Context, baseURL string) ([]RemoteEntry, error) {
+			return []RemoteEntry{
+				{Name: `fuso.txt`, URL: baseURL + `/fuso.txt`, Size: 4, ModTime: time.Now()},
+				{Name: `gone.txt`, URL: baseURL + `/gone.txt`, Size: 4, ModTime: time.Now()},
+			}, nil
+		}}
+	err := New(&conf).DownloadNewerThan(context.Background(), server.URL, t.TempDir(), time.Now().Add(-time.Hour))
+	if !errors.Is(err, ErrMissingEntries) || !strings.Contains(err.Error(), `1 of 2 files, gone.txt`) {
+		t.Errorf(`expected missing gone.txt but %v`, err)
+	}
+}
+
+func TestAcceptHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(`Accept`) == `application/octet-stream` {
+			w.Write([]byte(`fuso`))
+			return
+		}
+		w.Write([]byte(`<html>` + r.Header.Get(`Accept`) + `</html>`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	downloads := []*Download{
+		{URL: server.URL + `/default`, LocalFilePath: filepath.Join(dir, `default`)},
+		{URL: server.URL + `/accept`, LocalFilePath: filepath.Join(dir, `accept`), Accept: `text/plain`},
+		{URL: server.URL + `/header`, LocalFilePath: filepath.Join(dir, `header`), Accept: `text/plain`, Header: http.Header{`Accept`: {`image/png`}}},
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, Accept: `application/octet-stream`}
+	if err := New(&conf).MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{`default`: `fuso`, `accept`: `<html>text/plain</html>`, `header`: `<html>image/png</html>`} {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(b) != expected {
+			t.Errorf(`unexpected file of %s %q`, name, b)
+		}
+	}
+	if downloads[2].Header.Get(`Accept`) != `image/png` || downloads[1].Header != nil {
+		t.Errorf(`header of the download is modified`)
+	}
+}
+
+func TestThroughputPercentile(t *testing.T) {
+	samples := newThroughputSamples(3)
+	if samples.percentile(50) != 0 {
+		t.Errorf(`percentile without samples should be 0`)
+	}
+	for _, v := range []int64{100, 400, 200, 300} {
+		samples.add(v)
+	}
+	// 100 is dropped from the window
+	if samples.percentile(0) != 200 || samples.percentile(50) != 300 || samples.percentile(100) != 400 {
+		t.Errorf(`unexpected percentiles %d %d %d`, samples.percentile(0), samples.percentile(50), samples.percentile(100))
+	}
+	if len(samples.values) != 3 {
+		t.Errorf(`samples grow over the window %d`, len(samples.values))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Length`, `8`)
+		if r.Method == `GET` {
+			w.Write([]byte(`fuso`))
+			w.(http.Flusher).Flush()
+			time.Sleep(1200 * time.Millisecond)
+			w.Write([]byte(`ugin`))
+		}
+	}))
+	defer server.Close()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, ThroughputSampleWindow: 10}
+	fileDownloader := New(&conf)
+	if err := fileDownloader.SimpleFileDownload(server.URL, filepath.Join(t.TempDir(), `fuso.txt`)); err != nil {
+		t.Fatal(err)
+	}
+	if fileDownloader.ThroughputPercentile(100) != 4 {
+		t.Errorf(`expected 4 bytes per second at most but %d`, fileDownloader.ThroughputPercentile(100))
+	}
+}
+
+func TestShouldDownload(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, modTime, strings.NewReader(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	existing := &Download{URL: server.URL + `/existing`, LocalFilePath: filepath.Join(dir, `existing`)}
+	missing := &Download{URL: server.URL + `/missing`, LocalFilePath: filepath.Join(dir, `missing`)}
+	failing := &Download{URL: server.URL + `/failing`, LocalFilePath: filepath.Join(dir, `failing`)}
+	ioutil.WriteFile(existing.LocalFilePath, []byte(`old`), 0644)
+	var mu sync.Mutex
+	remotes := make(map[*Download]HeadInfo)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1,
+		ShouldDownload: func(d *Download, localExists bool, localSize int64, remote HeadInfo) (bool, error) {
+			mu.Lock()
+			remotes[d] = remote
+			mu.Unlock()
+			if d == failing {
+				return false, errors.New(`rejected`)
+			}
+			return !localExists || localSize != remote.Size, nil
+		}}
+	fileDownloader := New(&conf)
+	err := fileDownloader.MultipleFileDownload([]*Download{existing, missing, failing})
+	if err == nil || !strings.Contains(err.Error(), `rejected`) {
+		t.Errorf(`expected rejected file but %v`, err)
+	}
+	if b, _ := ioutil.ReadFile(existing.LocalFilePath); string(b) != `fuso` {
+		t.Errorf(`file of different size should be downloaded %q`, b)
+	}
+	if b, _ := ioutil.ReadFile(missing.LocalFilePath); string(b) != `fuso` {
+		t.Errorf(`missing file should be downloaded %q`, b)
+	}
+	if _, err := os.Stat(failing.LocalFilePath); !os.IsNotExist(err) {
+		t.Errorf(`failed file should not be downloaded`)
+	}
+	if remote := remotes[missing]; remote.Size != 4 || !remote.LastModified.Equal(modTime) || !remote.Resumable {
+		t.Errorf(`unexpected remote info %+v`, remote)
+	}
+	// downloaded files are skipped next time
+	fileDownloader = New(&conf)
+	if err := fileDownloader.MultipleFileDownload([]*Download{existing, missing}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fileDownloader.Skipped()) != 2 {
+		t.Errorf(`expected 2 skipped files but %d`, len(fileDownloader.Skipped()))
+	}
+}
+
+// file system refusing rename across directories, as network file systems mounted in the directory
+type mountedFileSystem struct {
+	osFileSystem
+	refuseAll bool // rename is refused also in the directory
+}
+
+func (fs mountedFileSystem) Rename(oldpath, newpath string) error {
+	if fs.refuseAll || filepath.Dir(oldpath) != filepath.Dir(newpath) {
+		return &os.LinkError{Op: `rename`, Old: oldpath, New: newpath, Err: os.ErrPermission}
+	}
+	return fs.osFileSystem.Rename(oldpath, newpath)
+}
+
+func TestFinalizeByCopy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	for _, refuseAll := range []bool{false, true} {
+		tempDir, dir := t.TempDir(), t.TempDir()
+		var mu sync.Mutex
+		var logs []string
+		conf := Config{MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, TempDir: tempDir, FileSystem: mountedFileSystem{refuseAll: refuseAll},
+			logfunc: func(param ...interface{}) {
+				mu.Lock()
+				logs = append(logs, fmt.Sprint(param...))
+				mu.Unlock()
+			}}
+		localPath := filepath.Join(dir, `fuso.bin`)
+		if err := New(&conf).SimpleFileDownload(server.URL, localPath); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadFile(localPath); string(b) != `fuso` {
+			t.Errorf(`file is not copied %q`, b)
+		}
+		temps, _ := ioutil.ReadDir(tempDir)
+		saved, _ := ioutil.ReadDir(dir)
+		if len(temps) != 0 || len(saved) != 1 {
+			t.Errorf(`temp files are left %d %d`, len(temps), len(saved))
+		}
+		strategy := `copied and renamed`
+		if refuseAll {
+			strategy = `directly`
+		}
+		if !strings.Contains(strings.Join(logs, "\n"), strategy) {
+			t.Errorf(`finalize strategy is not logged %v`, refuseAll)
+		}
+	}
+}
+
+func TestRetryCounts(t *testing.T) {
+	var flakyGets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/flaky` && r.Method == `GET` && atomic.AddInt32(&flakyGets, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	flaky := &Download{URL: server.URL + `/flaky`, LocalFilePath: filepath.Join(dir, `flaky`)}
+	healthy := &Download{URL: server.URL + `/healthy`, LocalFilePath: filepath.Join(dir, `healthy`)}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, MaxRetry: 3, RetryDelay: time.Millisecond}
+	fileDownloader := New(&conf)
+	results := make(map[*Download]int)
+	for result := range fileDownloader.DownloadChan([]*Download{flaky, healthy}) {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		results[result.Download] = result.RetryCount
+	}
+	if results[flaky] != 2 || results[healthy] != 0 {
+		t.Errorf(`unexpected retry counts in results %v`, results)
+	}
+	if counts := fileDownloader.RetryCounts(); counts[flaky] != 2 || counts[healthy] != 0 || len(counts) != 2 {
+		t.Errorf(`unexpected retry counts %v`, counts)
+	}
+	if fileDownloader.TotalRetries() != 2 {
+		t.Errorf(`expected 2 retries of the batch but %d`, fileDownloader.TotalRetries())
+	}
+}
+
+func TestOrderedEvents(t *testing.T) {
+	var flakyGets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == `/flaky` && r.Method == `GET` && atomic.AddInt32(&flakyGets, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set(`Content-Length`, `8`)
+		if r.Method == `GET` {
+			w.Write([]byte(`fuso`))
+			w.(http.Flusher).Flush()
+			time.Sleep(1200 * time.Millisecond)
+			w.Write([]byte(`ugin`))
+		}
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	flaky := &Download{URL: server.URL + `/flaky`, LocalFilePath: filepath.Join(dir, `flaky`)}
+	healthy := &Download{URL: server.URL + `/healthy`, LocalFilePath: filepath.Join(dir, `healthy`)}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, MaxRetry: 1, RetryDelay: time.Millisecond, OrderedEvents: true}
+	fileDownloader := New(&conf)
+	var events []Event
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range fileDownloader.Events {
+			events = append(events, e)
+		}
+	}()
+	if err := fileDownloader.MultipleFileDownload([]*Download{flaky, healthy}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	var flakyTypes []string
+	progress, doneFiles := 0, 0
+	for _, e := range events {
+		switch {
+		case e.Type == EventProgress:
+			progress++
+		case e.Download == flaky:
+			flakyTypes = append(flakyTypes, string(e.Type))
+		}
+		if e.Type == EventFileDone {
+			doneFiles++
+			if e.Err != nil || e.Path != e.Download.LocalFilePath {
+				t.Errorf(`unexpected done event %+v`, e)
+			}
+		}
+	}
+	if strings.Join(flakyTypes, `,`) != `start,retry,done` {
+		t.Errorf(`unexpected events of the file %v`, flakyTypes)
+	}
+	if progress == 0 || doneFiles != 2 {
+		t.Errorf(`expected progress events and 2 done events but %d %d`, progress, doneFiles)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, BufferSize: 7}
+	fileDownloader := New(&conf)
+	if buf := fileDownloader.getBuffer(); len(*buf) != 7 {
+		t.Errorf(`expected buffer of 7 bytes but %d`, len(*buf))
+	}
+	dir := t.TempDir()
+	var downloads []*Download
+	for i := 0; i < 5; i++ {
+		downloads = append(downloads, &Download{URL: server.URL + `/` + strconv.Itoa(i), LocalFilePath: filepath.Join(dir, strconv.Itoa(i))})
+	}
+	if err := fileDownloader.MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range downloads {
+		if b, _ := ioutil.ReadFile(d.LocalFilePath); !bytes.Equal(b, content) {
+			t.Errorf(`file is broken by shared buffers %s`, d.LocalFilePath)
+		}
+	}
+}
+
+func BenchmarkManySmallFiles(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	dir := b.TempDir()
+	var downloads []*Download
+	for i := 0; i < 50; i++ {
+		downloads = append(downloads, &Download{URL: server.URL + `/` + strconv.Itoa(i), LocalFilePath: filepath.Join(dir, strconv.Itoa(i))})
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		conf := Config{logfunc: func(param ...interface{}) {}, MaxDownloadThreads: 8, DownloadTimeoutMinutes: 1}
+		if err := New(&conf).MultipleFileDownload(downloads); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRejectHTMLResponses(t *testing.T) {
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == `GET` {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Header().Set(`Content-Type`, `text/html; charset=utf-8`)
+		w.Write([]byte(`<html>login</html>`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	portal := &Download{URL: server.URL + `/fuso.zip`, LocalFilePath: filepath.Join(dir, `fuso.zip`)}
+	page := &Download{URL: server.URL + `/index.html`, LocalFilePath: filepath.Join(dir, `index.html`), AllowHTML: true}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, MaxRetry: 2, RejectHTMLResponses: true}
+	err := New(&conf).MultipleFileDownload([]*Download{portal, page})
+	if !errors.Is(err, ErrHTMLResponse) {
+		t.Errorf(`expected HTML response error but %v`, err)
+	}
+	if _, err := os.Stat(portal.LocalFilePath); !os.IsNotExist(err) {
+		t.Errorf(`HTML page should not be saved`)
+	}
+	if b, _ := ioutil.ReadFile(page.LocalFilePath); string(b) != `<html>login</html>` {
+		t.Errorf(`allowed HTML should be saved %q`, b)
+	}
+	if atomic.LoadInt32(&gets) != 2 {
+		t.Errorf(`HTML response should not be retried %d`, gets)
+	}
+}
+
+// handler of mem:// URLs serving the files in memory
+type memHandler map[string]string
+
+func (h memHandler) Size(ctx context.Context, url string) (int64, error) {
+	return int64(len(h[url])), nil
+}
+
+func (h memHandler) Open(ctx context.Context, url string) (io.ReadCloser, error) {
+	content, ok := h[url]
+	if !ok {
+		return nil, errors.New(`not found ` + url)
+	}
+	return ioutil.NopCloser(strings.NewReader(content)), nil
+}
+
+func TestRegisterScheme(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	downloads := []*Download{
+		{URL: server.URL + `/fuso`, LocalFilePath: filepath.Join(dir, `fuso`)},
+		{URL: `mem://bucket/ugin`, LocalFilePath: filepath.Join(dir, `ugin`)},
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1}
+	fileDownloader := New(&conf)
+	fileDownloader.RegisterScheme(`mem`, memHandler{`mem://bucket/ugin`: `ugin!`})
+	if err := fileDownloader.MultipleFileDownload(downloads); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{`fuso`: `fuso`, `ugin`: `ugin!`} {
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(b) != expected {
+			t.Errorf(`unexpected file %s %q`, name, b)
+		}
+	}
+	if fileDownloader.TotalFilesSize != 9 {
+		t.Errorf(`size of the handler is not counted %d`, fileDownloader.TotalFilesSize)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, `sub`), 0755)
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1}
+	fileDownloader := New(&conf)
+	valid := []*Download{
+		{URL: `http://localhost/fuso`, LocalFilePath: filepath.Join(dir, `fuso`)},
+		{URL: `https://localhost/ugin`, LocalFilePath: filepath.Join(dir, `sub`, `ugin`)},
+	}
+	if err := fileDownloader.Validate(valid); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 1 {
+		t.Errorf(`files are left by Validate %v`, names)
+	}
+	invalid := []*Download{
+		{URL: `ftp://localhost/fuso`, LocalFilePath: filepath.Join(dir, `fuso`)},
+		{URL: `http://localhost/ugin`, LocalFilePath: filepath.Join(dir, `sub`)},
+		{URL: `http://localhost/emrakul`, LocalFilePath: filepath.Join(dir, `missing`, `emrakul`)},
+		{URL: `http:///kozilek`, LocalFilePath: filepath.Join(dir, `kozilek`)},
+	}
+	err := fileDownloader.Validate(invalid)
+	if !errors.Is(err, ErrInvalidDownload) {
+		t.Fatal(`invalid downloads are not reported`, err)
+	}
+	for _, d := range invalid {
+		if !strings.Contains(err.Error(), d.URL) {
+			t.Errorf(`%s is not reported in %v`, d.URL, err)
+		}
+	}
+	fileDownloader.RegisterScheme(`ftp`, memHandler{})
+	if err := fileDownloader.Validate(invalid[:1]); err != nil {
+		t.Error(`registered scheme is not valid`, err)
+	}
+}
+
+func TestMinSpeed(t *testing.T) {
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = 20 * time.Millisecond
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Length`, `4`)
+		if r.Method != `GET` {
+			return
+		}
+		// first response crawls
+		if atomic.AddInt32(&gets, 1) == 1 {
+			w.Write([]byte(`f`))
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte(`fuso`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	var retryErr error
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, MaxRetry: 1, RetryDelay: time.Millisecond,
+		MinSpeedBytesPerSecond: 100, MinSpeedWindow: 100 * time.Millisecond,
+		OnRetry: func(d *Download, attempt int, err error, nextDelay time.Duration) { retryErr = err },
+	}
+	started := time.Now()
+	if err := New(&conf).SimpleFileDownload(server.URL+`/fuso`, filepath.Join(dir, `fuso`)); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(retryErr, ErrTooSlow) {
+		t.Error(`slow download is not retried`, retryErr)
+	}
+	if time.Since(started) > 3*time.Second {
+		t.Error(`slow download is not aborted`)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, `fuso`)); string(b) != `fuso` {
+		t.Errorf(`unexpected content %s`, b)
+	}
+	atomic.StoreInt32(&gets, 0)
+	conf.MaxRetry = 0
+	if err := New(&conf).SimpleFileDownload(server.URL+`/fuso`, filepath.Join(dir, `ugin`)); !errors.Is(err, ErrTooSlow) {
+		t.Error(`slow download should fail with ErrTooSlow`, err)
+	}
+	if parts, _ := filepath.Glob(filepath.Join(dir, `*.part`)); len(parts) != 0 {
+		t.Error(`temp files of aborted downloads are left`, parts)
+	}
+}
+
+func TestComputeChecksum(t *testing.T) {
+	content := bytes.Repeat([]byte(`fuso`), 1000)
+	server := testutil.NewServer(content, testutil.Behavior{})
+	defer server.Close()
+	dir := t.TempDir()
+	sum := sha256.Sum256(content)
+	expected := hex.EncodeToString(sum[:])
+	for _, compute := range []bool{true, false} {
+		conf := Config{logfunc: myLogger, MaxDownloadThreads: 2, DownloadTimeoutMinutes: 1, ComputeChecksum: compute, SkipCompleted: true}
+		// second run skips the files saved by the first run
+		for result := range New(&conf).DownloadChan([]*Download{
+			{URL: server.URL + `/a`, LocalFilePath: filepath.Join(dir, `a`)},
+			{URL: server.URL + `/b`, LocalFilePath: filepath.Join(dir, `b`)},
+		}) {
+			if result.Err != nil {
+				t.Fatal(result.Err)
+			}
+			if compute && result.SHA256 != expected {
+				t.Errorf(`unexpected checksum of %s %q`, result.Download.URL, result.SHA256)
+			}
+			if !compute && result.SHA256 != `` {
+				t.Errorf(`checksum is computed without ComputeChecksum %q`, result.SHA256)
+			}
+		}
+	}
+	conf := Config{logfunc: myLogger, MaxDownloadThreads: 1, DownloadTimeoutMinutes: 1, ComputeChecksum: true, SkipCompleted: true}
+	for result := range New(&conf).DownloadChan([]*Download{{URL: server.URL + `/a`, LocalFilePath: filepath.Join(dir, `a`)}}) {
+		if !result.Skipped || result.SHA256 != expected {
+			t.Errorf(`skipped file should have the checksum %v %q`, result.Skipped, result.SHA256)
+		}
 	}
-	t.Log(bytes)
 }
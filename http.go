@@ -1,7 +1,11 @@
 package filedownloader
 
 import (
+	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"net/http"
 )
@@ -11,86 +15,456 @@ import (
 const acceptRangeHeader = "Accept-Ranges"
 
 // getting url's head information, mostly for getting file size from Content-Length.
-func getHead(url string) (*http.Response, error) {
-	resp, err := http.Head(url)
+func (m *FileDownloader) getHead(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	r, err := m.newRequest(ctx, `HEAD`, url, header)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.do(r)
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
-// get content-length from header
-func getFileSizeAndResumable(url string) (int64, bool, error) {
-	resp, err := getHead(url)
+// get content-length from header, size is -1 if unknown.
+func (m *FileDownloader) getFileSizeAndResumable(ctx context.Context, url string) (int64, bool, error) {
+	info, err := m.getResumeInfo(ctx, url, nil)
 	if err != nil {
 		return 0, false, err
 	}
+	return info.contentLength, info.isResumable, nil
+}
+
+// get head information used to resume the file
+func (m *FileDownloader) getResumeInfo(ctx context.Context, url string, header http.Header) (*resumeInfo, error) {
+	resp, err := m.getHead(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	// size of an error page is not of the file
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: errors.New(`unexpected status ` + resp.Status)}
+	}
 	var acceptResume bool
 	if resp.Header.Get(acceptRangeHeader) == "" {
 		acceptResume = false
 	} else {
 		acceptResume = true
 	}
-	return resp.ContentLength, acceptResume, nil
+	return &resumeInfo{isResumable: acceptResume, contentLength: resp.ContentLength, etag: resp.Header.Get(`ETag`), header: resp.Header}, nil
+}
+
+// CheckResumable sends HEAD request to url and returns the file size and whether the server accepts range requests.
+// size is -1 if the server does not tell the size. Config.UserAgent is used for the request.
+// Response of non-2xx status fails with DownloadError of the status code.
+func (m *FileDownloader) CheckResumable(ctx context.Context, url string) (size int64, resumable bool, err error) {
+	return m.getFileSizeAndResumable(ctx, url)
+}
+
+// signed URL may be expired, get the new one before each request by Config.URLRefresher.
+func (m *FileDownloader) refreshURL(url string) (string, error) {
+	if m.conf.URLRefresher == nil {
+		return url, nil
+	}
+	return m.conf.URLRefresher(url)
+}
+
+// request with Config.UserAgent, headers of the download override it.
+func (m *FileDownloader) newRequest(ctx context.Context, method, url string, header http.Header) (*http.Request, error) {
+	return m.newRequestWithBody(ctx, method, url, nil, header)
+}
+
+// body is set before RequestInterceptor, so that it can sign the body.
+func (m *FileDownloader) newRequestWithBody(ctx context.Context, method, url string, body io.Reader, header http.Header) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if m.conf.UserAgent != `` {
+		r.Header.Set(`User-Agent`, m.conf.UserAgent)
+	}
+	for key, values := range header {
+		r.Header[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+	if m.conf.RequestInterceptor != nil {
+		if err := m.conf.RequestInterceptor(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
 }
 
 // Download Single File
-func downloadFile(ctx context.Context, url string, localFilePath string, downloadedBytes chan int, useResume bool, filesize int64, log func(param ...interface{})) {
+func (m *FileDownloader) downloadFile(ctx context.Context, d *Download, downloadedBytes chan fileBytes, progress *fileProgress, useResume bool, resume *resumeInfo) error {
+	log := m.logfunc
+	url := d.URL
 	select {
 	case <-ctx.Done():
 		log(`Download Cancelled by context`)
-		return
+		return &DownloadError{URL: url, Err: ErrCancelCopy}
 	default:
-		file, offset, err := setupDownloadFile(localFilePath, useResume)
+		// local path is decided by the response when it is not given.
+		pathFromResponse := d.LocalFilePath == ``
+		toStdout := isStdout(d.LocalFilePath)
+		// path resolved by the response is kept out of the Download, so that a retry resolves it from the same default
+		progress.localPath = d.LocalFilePath
+		var file io.WriteCloser
+		var offset int64
+		var err error
+		fs := m.fileSystem()
+		var partPath string
+		// compressed or transformed file can not be appended
+		if pathFromResponse || toStdout || d.hasBody() || m.conf.CASRoot != `` || m.conf.CompressOutput || m.conf.DecompressGzip || m.conf.StreamTransform != nil {
+			useResume = false
+		}
+		if toStdout {
+			// bytes of other files must not be mixed
+			m.stdoutMu.Lock()
+			defer m.stdoutMu.Unlock()
+			file = nopWriteCloser{d.stdoutWriter()}
+		} else if !pathFromResponse {
+			// download to temp file first, it is renamed to LocalFilePath when download completes.
+			partPath = m.downloadPartPath(url, d.LocalFilePath)
+			progress.partPath = partPath
+			// temp file left by previous run is used only when the remote file is not changed.
+			if useResume && !isPartFileResumable(fs, partPath, resume) {
+				log(`Partial file is not resumable, download from start[` + url + `]`)
+				useResume = false
+			}
+			if !useResume {
+				partPath = m.unusedPartFilePath(partPath)
+				progress.partPath = partPath
+			}
+			file, offset, err = m.setupDownloadFile(partPath, useResume, resume.contentLength)
+			if err != nil {
+				return &DownloadError{URL: url, Err: &FileSystemError{Err: err}}
+			}
+			file = closeOnce(file)
+			defer file.Close()
+			if m.conf.ResumeFromPartial {
+				if err := writeResumeMeta(fs, partPath, resume); err != nil {
+					m.removePartFile(file, partPath)
+					return &DownloadError{URL: url, Err: &FileSystemError{Err: err}}
+				}
+			}
+		}
+		requestURL, err := m.refreshURL(url)
 		if err != nil {
-			return
+			if file != nil && !m.conf.ResumeFromPartial {
+				m.removePartFile(file, partPath)
+			}
+			return &DownloadError{URL: url, Err: err}
+		}
+		r, err := m.newDownloadRequest(ctx, d, requestURL)
+		if err != nil {
+			if file != nil && !m.conf.ResumeFromPartial {
+				m.removePartFile(file, partPath)
+			}
+			return &DownloadError{URL: url, Err: err}
 		}
-		defer file.Close()
-		r, err := http.NewRequestWithContext(ctx, `GET`, url, nil)
 		if useResume {
-			r.Header.Add(`Range`, rangeHeaderValue(file, offset, filesize))
+			r.Header.Add(`Range`, rangeHeaderValue(offset, resume.contentLength))
 			log(`Resume enabled, added download header::`, r.Header)
-		}
-		if err != nil {
-			return
+		} else if m.singleRequest() && !d.hasBody() {
+			r.Header.Set(`Range`, wholeFileRange)
+		} else if encoding := m.acceptEncoding(); encoding != `` {
+			r.Header.Set(`Accept-Encoding`, encoding)
 		}
 		// download file
-		resp, err := http.DefaultClient.Do(r)
+		resp, err := m.do(r)
 		if err != nil {
-			ctx = context.WithValue(ctx, downloadError, err)
-			return
+			if file != nil && !m.conf.ResumeFromPartial {
+				m.removePartFile(file, partPath)
+			}
+			return &DownloadError{URL: url, Err: err}
 		}
 		defer resp.Body.Close()
-		readSource := &responseReader{Reader: resp.Body, readBytes: downloadedBytes}
-		_, err = copyBuffer(ctx, file, readSource, nil)
+		if m.conf.OnResponse != nil {
+			m.conf.OnResponse(d, resp)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			if file != nil && !m.conf.ResumeFromPartial {
+				m.removePartFile(file, partPath)
+			}
+			return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: errors.New(`unexpected status ` + resp.Status)}
+		}
+		if err := m.rejectHTML(d, resp); err != nil {
+			log(`Unexpected content[`+url+`]`, err)
+			if file != nil && !m.conf.ResumeFromPartial {
+				m.removePartFile(file, partPath)
+			}
+			return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
+		}
+		if useResume && resp.StatusCode == http.StatusOK {
+			// server ignored Range and sends the whole file, write it from start instead of appending
+			if offset > 0 {
+				log(`Range is ignored by the server, write from start[` + url + `]`)
+				file.Close()
+				if file, err = fs.Create(partPath); err != nil {
+					return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: &FileSystemError{Err: err}}
+				}
+				file = closeOnce(file)
+				defer file.Close()
+				offset = 0
+			}
+			if resp.ContentLength != resume.contentLength {
+				if d.KnownSize <= 0 {
+					downloadedBytes <- fileBytes{index: progress.index, resized: true, size: resp.ContentLength}
+				}
+				if err := writeResumeMeta(fs, partPath, &resumeInfo{contentLength: resp.ContentLength, etag: resp.Header.Get(`ETag`)}); err != nil {
+					m.removePartFile(file, partPath)
+					return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: &FileSystemError{Err: err}}
+				}
+			}
+		} else if useResume {
+			// partial file is made from the old remote file when the size differs, download it again from start.
+			if size, changed := resumedFileSize(resp, offset, resume.contentLength); changed {
+				log(`Remote file changed while resuming, download from start[`+url+`]`, resp.Header.Get(`Content-Range`))
+				resp.Body.Close()
+				m.removePartFile(file, partPath)
+				if d.KnownSize <= 0 {
+					downloadedBytes <- fileBytes{index: progress.index, resized: true, size: size}
+				}
+				return m.downloadFile(ctx, d, downloadedBytes, progress, false, &resumeInfo{contentLength: size, etag: resp.Header.Get(`ETag`)})
+			}
+		}
+		if m.sizeFromResponse(d) {
+			size, err := responseFileSize(resp)
+			if err != nil {
+				if file != nil {
+					m.removePartFile(file, partPath)
+				}
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
+			}
+			// retried download must not count the size again
+			if !progress.sizeSent && d.KnownSize <= 0 {
+				progress.sizeSent = true
+				downloadedBytes <- fileBytes{index: progress.index, sizeKnown: true, size: size}
+			}
+		}
+		if pathFromResponse || (m.conf.ResolvePath != nil && !toStdout) {
+			localPath, err := m.resolvePath(d, resp, pathFromResponse)
+			if err != nil {
+				log(`Could not decide local file path[`+url+`]`, err)
+				if file != nil && !m.conf.ResumeFromPartial {
+					m.removePartFile(file, partPath)
+				}
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
+			}
+			progress.localPath = localPath
+		}
+		if pathFromResponse {
+			partPath = m.unusedPartFilePath(m.downloadPartPath(url, progress.localPath))
+			progress.partPath = partPath
+			file, err = fs.Create(partPath)
+			if err != nil {
+				// file system may leave the file it failed to open
+				fs.Remove(partPath)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: &FileSystemError{Err: err}}
+			}
+			file = closeOnce(file)
+			defer file.Close()
+		}
+		// write errors are of the local file, not of the network
+		var dst io.Writer = fileSystemWriter{file}
+		// hash of the bytes written to the file, for Config.WriteChecksumManifest, CASRoot and ComputeChecksum
+		var fileHash hash.Hash
+		if m.conf.WriteChecksumManifest != `` || m.conf.CASRoot != `` || m.conf.ComputeChecksum {
+			if fileHash, err = m.newPartFileHash(partPath, offset); err != nil {
+				m.removePartFile(file, partPath)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: &FileSystemError{Err: err}}
+			}
+			dst = io.MultiWriter(file, fileHash)
+		}
+		var compressor io.WriteCloser
+		if m.conf.CompressOutput {
+			compressor, err = newCompressWriter(m.conf.CompressFormat, dst)
+			if err != nil {
+				m.removePartFile(file, partPath)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
+			}
+			dst = compressor
+		}
+		// progress is counted by bytes from network, before decoding
+		readSource := NewProgressReader(&pausableReader{ctx: ctx, m: m, r: resp.Body}, func(n int) {
+			m.addBatchBytes(n)
+			progress.received += int64(n)
+			m.releaseInFlight(progress, int64(n))
+			downloadedBytes <- fileBytes{index: progress.index, n: n}
+		})
+		// digest is of the bytes from network including Content-Encoding, not known for the resumed bytes
+		var digest *serverDigest
+		var body io.Reader = readSource
+		if m.conf.VerifyServerDigest && offset == 0 && !resp.Uncompressed {
+			if digest = responseDigest(resp); digest != nil {
+				body = io.TeeReader(readSource, digest.hash)
+			}
+		}
+		src, err := m.decodeBody(resp, body)
 		if err != nil {
-			if err == ErrCancelCopy {
-				ctx = context.WithValue(ctx, cancelError, err)
+			m.removePartFile(file, partPath)
+			return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
+		}
+		// resumed body is not the start of the file
+		if expected := m.expectedContentType(d, resp); expected != `` && offset == 0 {
+			if src, err = sniffContentType(src, expected); err != nil {
+				log(`Unexpected content[`+url+`]`, err)
+				m.removePartFile(file, partPath)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
+			}
+		}
+		if m.conf.StreamTransform != nil {
+			if src, err = m.conf.StreamTransform(src); err != nil {
+				m.removePartFile(file, partPath)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
+			}
+		}
+		var checksum hash.Hash
+		if d.ExpectedSHA256 != `` {
+			// resumed file has to be hashed from the start
+			if checksum, err = m.newPartFileHash(partPath, offset); err != nil {
+				m.removePartFile(file, partPath)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: &FileSystemError{Err: err}}
+			}
+		}
+		hashed := false
+		localPath := progress.localPath
+		if m.conf.DecompressGzip && isGzipFile(url, resp) {
+			if checksum != nil && m.conf.ChecksumBeforeDecompress {
+				src = io.TeeReader(src, checksum)
+				hashed = true
+			}
+			if src, err = gzip.NewReader(src); err != nil {
+				m.removePartFile(file, partPath)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
+			}
+			localPath = decompressedFilePath(localPath)
+		}
+		if checksum != nil && !hashed {
+			src = io.TeeReader(src, checksum)
+		}
+		buf := m.getBuffer()
+		defer m.putBuffer(buf)
+		_, err = copyBuffer(ctx, dst, src, *buf)
+		if err == nil && compressor != nil {
+			// write the rest of compressed stream
+			err = compressor.Close()
+		}
+		if err != nil {
+			// body read by cancel also fails with the error of the connection
+			if err == ErrCancelCopy || ctx.Err() != nil {
 				log(`Download File Cancelled[` + url + `]`)
-			} else {
-				ctx = context.WithValue(ctx, downloadError, err)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: ErrCancelCopy}
+			}
+			// keep the temp file to resume it next time
+			if !m.conf.ResumeFromPartial {
+				m.removePartFile(file, partPath)
+			}
+			var fsErr *FileSystemError
+			if !errors.As(err, &fsErr) {
+				err = &bodyReadError{err}
+			}
+			return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
+		}
+		if err := file.Close(); err != nil {
+			m.removePartFile(file, partPath)
+			return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: &FileSystemError{Err: err}}
+		}
+		if digest != nil {
+			if err := digest.verify(); err != nil {
+				log(`Downloaded file does not match the digest[`+url+`]`, err)
+				m.removePartFile(file, partPath)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
+			}
+		}
+		if checksum != nil {
+			if err := verifySHA256(checksum, d.ExpectedSHA256); err != nil {
+				m.removePartFile(file, partPath)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: err}
 			}
-			return
+		}
+		if toStdout {
+			progress.savedPath = StdoutPath
+		} else if m.conf.CASRoot != `` {
+			removeResumeMeta(fs, partPath)
+			if localPath != `` {
+				localPath = m.outputFilePath(localPath)
+			}
+			if progress.savedPath, err = m.storeCAS(partPath, hexSum(fileHash), localPath); err != nil {
+				fs.Remove(partPath)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: &FileSystemError{Err: err}}
+			}
+		} else {
+			removeResumeMeta(fs, partPath)
+			if err := m.finalizeDownloadFile(partPath, m.outputFilePath(localPath)); err != nil {
+				fs.Remove(partPath)
+				return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: &FileSystemError{Err: err}}
+			}
+			progress.savedPath = m.outputFilePath(localPath)
+		}
+		if fileHash != nil {
+			progress.sha256 = hexSum(fileHash)
 		}
 	}
 	log(`Download File Done[` + url + `]`)
+	return nil
+}
+
+// ask Config.PathFunc where to save the file, used when Download has no LocalFilePath. Empty if it is saved only in CASRoot.
+func (m *FileDownloader) pathFromResponse(url string, resp *http.Response) (string, error) {
+	if m.conf.PathFunc == nil {
+		// file is only stored in CASRoot
+		if m.conf.CASRoot != `` {
+			return ``, nil
+		}
+		return ``, errors.New(`LocalFilePath is empty and PathFunc is not configured[` + url + `]`)
+	}
+	return m.conf.PathFunc(url, resp)
 }
 
-// DownloadError is a string used for context value key.
-type DownloadError string
+// final local path decided by Config.ResolvePath with the path of LocalFilePath or PathFunc.
+func (m *FileDownloader) resolvePath(d *Download, resp *http.Response, pathFromResponse bool) (string, error) {
+	defaultPath := d.LocalFilePath
+	// ResolvePath may decide the path without PathFunc
+	if pathFromResponse && (m.conf.PathFunc != nil || m.conf.ResolvePath == nil) {
+		var err error
+		if defaultPath, err = m.pathFromResponse(d.URL, resp); err != nil {
+			return ``, err
+		}
+	}
+	if m.conf.ResolvePath == nil {
+		return defaultPath, nil
+	}
+	path, err := m.conf.ResolvePath(d, resp, defaultPath)
+	if err != nil {
+		return ``, err
+	}
+	if path == `` && m.conf.CASRoot == `` {
+		return ``, errors.New(`ResolvePath returned empty path[` + d.URL + `]`)
+	}
+	return path, nil
+}
 
-var downloadError DownloadError = `downloadError`
+// DownloadError is returned when downloading a file failed.
+// Use errors.As to get URL and StatusCode of the failed download.
+type DownloadError struct {
+	URL        string // downloading file URL
+	StatusCode int    // HTTP status code of the response, 0 if there was no response
+	Err        error  // underlying error
+}
 
-var cancelError DownloadError = `cancelDownloadError`
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf(`%v[%s]: %v`, ErrDownload, e.URL, e.Err)
+}
 
-// responseReader http response reader with channels
-type responseReader struct {
-	io.Reader
-	readBytes chan int // send read bytes to channel
+// Unwrap returns the underlying error
+func (e *DownloadError) Unwrap() error {
+	return e.Err
 }
 
-func (m *responseReader) Read(p []byte) (int, error) {
-	n, err := m.Reader.Read(p)
-	m.readBytes <- n
-	return n, err
+// Is makes errors.Is(err, ErrDownload) true for every DownloadError
+func (e *DownloadError) Is(target error) bool {
+	return target == ErrDownload
 }
@@ -0,0 +1,47 @@
+package filedownloader
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Config.MaxInFlightBytes bounds the sum of bytes remaining in downloading files.
+// size of a file is reserved when it starts, and released as its bytes are read.
+
+// wait until the file fits in MaxInFlightBytes and reserve its size. A file starts anyway if no bytes are in flight.
+// cancelled download is started to fail soon, so the result of wait is not returned.
+func (m *FileDownloader) reserveInFlight(ctx context.Context, f *fileProgress) {
+	if m.conf.MaxInFlightBytes <= 0 || f.total <= 0 {
+		return
+	}
+	for {
+		inFlight := atomic.LoadInt64(&m.inFlightBytes)
+		if inFlight == 0 || inFlight+f.total <= m.conf.MaxInFlightBytes {
+			break
+		}
+		select {
+		case <-m.inFlightReleased:
+		case <-ctx.Done():
+			return
+		}
+	}
+	atomic.AddInt64(&m.inFlightBytes, f.total)
+	f.inFlight = f.total
+}
+
+// release n read bytes of the file, called by the download goroutine of the file.
+func (m *FileDownloader) releaseInFlight(f *fileProgress, n int64) {
+	if f.inFlight == 0 {
+		return
+	}
+	if n > f.inFlight {
+		n = f.inFlight
+	}
+	f.inFlight -= n
+	atomic.AddInt64(&m.inFlightBytes, -n)
+	// launching loop may be waiting
+	select {
+	case m.inFlightReleased <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,147 @@
+// Package testutil provides a test server of deterministic slow and flaky responses, for tests of filedownloader.
+package testutil
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Behavior how the Server responds to GET requests. HEAD requests are always answered without delay.
+type Behavior struct {
+	Latency   time.Duration // delay before response headers
+	ChunkSize int           // body is written in chunks of this bytes, default is 1024
+	ChunkWait time.Duration // delay after each chunk of the body, for slow transfer
+	FailTimes int           // number of first GET requests which fail, -1 fails all requests
+	FailAt    int64         // body of the failing request is cut after this bytes. 0 responds 503 instead
+	NoRange   bool          // Range header is ignored and whole body is sent with 200
+	ETag      string        // ETag header, default is "fuso"
+}
+
+// Server is httptest.Server serving Content with the Behavior, at any path.
+type Server struct {
+	*httptest.Server
+	Content  []byte
+	Behavior Behavior
+	mu       sync.Mutex
+	requests map[string]int // count of requests by method
+	ranges   []string       // Range headers of GET requests
+}
+
+// NewServer starts the server. Close it after the test.
+func NewServer(content []byte, behavior Behavior) *Server {
+	s := &Server{Content: content, Behavior: behavior, requests: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Requests returns the number of requests of the method
+func (s *Server) Requests(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+// Ranges returns Range headers of GET requests in the received order, empty if a request had no Range header
+func (s *Server) Ranges() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.Method]++
+	count := s.requests[r.Method]
+	if r.Method == `GET` {
+		s.ranges = append(s.ranges, r.Header.Get(`Range`))
+	}
+	s.mu.Unlock()
+	etag := s.Behavior.ETag
+	if etag == `` {
+		etag = `"fuso"`
+	}
+	w.Header().Set(`ETag`, etag)
+	if s.Behavior.NoRange {
+		r.Header.Del(`Range`)
+	} else {
+		w.Header().Set(`Accept-Ranges`, `bytes`)
+	}
+	if r.Method != `GET` {
+		http.ServeContent(w, r, ``, time.Time{}, bytes.NewReader(s.Content))
+		return
+	}
+	if !sleep(r, s.Behavior.Latency) {
+		return
+	}
+	failing := s.Behavior.FailTimes < 0 || count <= s.Behavior.FailTimes
+	if failing && s.Behavior.FailAt <= 0 {
+		http.Error(w, `injected failure`, http.StatusServiceUnavailable)
+		return
+	}
+	cw := &chunkWriter{ResponseWriter: w, r: r, size: s.Behavior.ChunkSize, wait: s.Behavior.ChunkWait, limit: -1}
+	if failing {
+		cw.limit = s.Behavior.FailAt
+	}
+	http.ServeContent(cw, r, ``, time.Time{}, bytes.NewReader(s.Content))
+}
+
+// sleep for d, returns false if the request is cancelled while sleeping.
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// writes body in chunks with wait, and cuts the connection after limit bytes.
+type chunkWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	size    int
+	wait    time.Duration
+	limit   int64 // -1 means no limit
+	written int64
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	size := w.size
+	if size <= 0 {
+		size = 1024
+	}
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		cut := w.limit >= 0 && w.written+int64(len(chunk)) >= w.limit
+		if cut {
+			chunk = chunk[:w.limit-w.written]
+		}
+		written, err := w.ResponseWriter.Write(chunk)
+		n += written
+		w.written += int64(written)
+		if err != nil {
+			return n, err
+		}
+		w.ResponseWriter.(http.Flusher).Flush()
+		if cut {
+			// client sees the connection closed in the middle of the body
+			panic(http.ErrAbortHandler)
+		}
+		if !sleep(w.r, w.wait) {
+			return n, http.ErrHandlerTimeout
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,59 @@
+package filedownloader
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// limit of the bytes downloaded in a batch.
+
+// ErrMaxTotalBytes is returned when some files were not downloaded because of Config.MaxTotalBytes
+var ErrMaxTotalBytes = errors.New(`Reached to MaxTotalBytes`)
+
+// count up downloaded bytes of the batch, abort downloading files if configured.
+func (m *FileDownloader) addBatchBytes(n int) {
+	total := atomic.AddInt64(&m.batchBytes, int64(n))
+	if m.conf.MaxTotalBytes <= 0 || !m.conf.AbortAtMaxTotalBytes {
+		return
+	}
+	// call cancel only once when the limit is crossed
+	if total >= m.conf.MaxTotalBytes && total-int64(n) < m.conf.MaxTotalBytes {
+		m.logfunc(`Reached to MaxTotalBytes, abort downloading files.`)
+		m.cancelBatch()
+	}
+}
+
+func (m *FileDownloader) reachedMaxTotalBytes() bool {
+	return m.conf.MaxTotalBytes > 0 && atomic.LoadInt64(&m.batchBytes) >= m.conf.MaxTotalBytes
+}
+
+func (m *FileDownloader) addRemaining(downloads ...*Download) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remaining = append(m.remaining, downloads...)
+}
+
+// Remaining returns files not downloaded because Config.MaxTotalBytes was reached.
+// Files not started, and files aborted while downloading if AbortAtMaxTotalBytes is true.
+func (m *FileDownloader) Remaining() []*Download {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Download(nil), m.remaining...)
+}
+
+// file descriptors used by a downloading file, the connection and the temp file.
+const openFilesPerDownload = 2
+
+// parallel downloads limited by MaxDownloadThreads and MaxOpenFiles.
+func (m *FileDownloader) downloadThreads() int {
+	threads := m.conf.MaxDownloadThreads
+	if m.conf.MaxOpenFiles > 0 {
+		if limit := m.conf.MaxOpenFiles / openFilesPerDownload; limit < threads {
+			threads = limit
+		}
+		if threads < 1 {
+			threads = 1
+		}
+	}
+	return threads
+}
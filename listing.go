@@ -0,0 +1,153 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// download files of a directory index newer than a time by DownloadNewerThan, for incremental mirroring.
+
+// RemoteEntry is a file listed in a directory index by Config.Lister.
+type RemoteEntry struct {
+	Name    string    // file name, saved with this name in the destination directory
+	URL     string    // absolute URL of the file
+	Size    int64     // size of the file, -1 if unknown
+	ModTime time.Time // last modified time of the file, zero if unknown
+}
+
+// ErrUnsafeEntryName listed file name is not a plain file name, ex. ../fuso.jpg
+var ErrUnsafeEntryName = errors.New(`Listed file name is not a plain file name`)
+
+// ErrMissingEntries some listed files newer than the cutoff were not downloaded
+var ErrMissingEntries = errors.New(`Listed files are not downloaded`)
+
+// largest directory index read by the default lister
+const maxIndexBytes = 16 * 1024 * 1024
+
+var hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']+)["']`)
+
+// DownloadNewerThan lists files of the directory index baseURL by Config.Lister, and downloads the files modified
+// after cutoff to destDir as a batch. Files of unknown modified time are not downloaded. Without Lister, baseURL is
+// read as an HTML index and each linked file under it is checked by a HEAD request for Last-Modified and Content-Length.
+// A listed name which is not a plain file name fails with ErrUnsafeEntryName before downloading.
+// The count of files downloaded is compared with the count of listed files newer than cutoff, and names of the files
+// not downloaded are reported with ErrMissingEntries together with the errors of the files.
+func (m *FileDownloader) DownloadNewerThan(ctx context.Context, baseURL, destDir string, cutoff time.Time) error {
+	if m.State != StateReady {
+		panic(`filedownloader has already started or done`)
+	}
+	lister := m.conf.Lister
+	if lister == nil {
+		lister = m.listHTMLIndex
+	}
+	entries, err := lister(ctx, baseURL)
+	if err != nil {
+		return &DownloadError{URL: baseURL, Err: err}
+	}
+	var downloads []*Download
+	for _, entry := range entries {
+		if !entry.ModTime.After(cutoff) {
+			continue
+		}
+		if entry.Name == `` || entry.Name == `.` || entry.Name == `..` || strings.ContainsAny(entry.Name, `/\`) {
+			return &DownloadError{URL: entry.URL, Err: ErrUnsafeEntryName}
+		}
+		downloads = append(downloads, &Download{URL: entry.URL, LocalFilePath: filepath.Join(destDir, entry.Name)})
+	}
+	m.logfunc(`Download files newer than ` + cutoff.String() + ` from ` + baseURL)
+	m.State = StateDownloading
+	m.downloadFiles(ctx, downloads)
+	if err := m.missingEntries(downloads); err != nil {
+		m.err = joinErrors(m.err, err)
+	}
+	return m.err
+}
+
+// error with the names of the files failed or not started.
+func (m *FileDownloader) missingEntries(downloads []*Download) error {
+	results := m.Results()
+	var missing []string
+	for _, d := range downloads {
+		if err, ok := results[d]; !ok || err != nil {
+			missing = append(missing, filepath.Base(d.LocalFilePath))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	m.logfunc(fmt.Sprintf(`Downloaded %d of %d listed files`, len(downloads)-len(missing), len(downloads)), missing)
+	return fmt.Errorf(`%w: %d of %d files, %s`, ErrMissingEntries, len(missing), len(downloads), strings.Join(missing, `, `))
+}
+
+// default lister, files linked from the HTML index under its directory. Subdirectories are not listed.
+func (m *FileDownloader) listHTMLIndex(ctx context.Context, baseURL string) ([]RemoteEntry, error) {
+	r, err := m.newRequest(ctx, `GET`, baseURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &DownloadError{URL: baseURL, StatusCode: resp.StatusCode, Err: ErrDownload}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIndexBytes))
+	if err != nil {
+		return nil, err
+	}
+	// links are relative to the index after redirects, ex. /files to /files/
+	base := resp.Request.URL
+	dir := base.Path[:strings.LastIndex(base.Path, `/`)+1]
+	var entries []RemoteEntry
+	seen := make(map[string]bool)
+	for _, match := range hrefPattern.FindAllSubmatch(body, -1) {
+		link, err := base.Parse(html.UnescapeString(string(match[1])))
+		if err != nil || link.Host != base.Host || link.RawQuery != `` || strings.HasSuffix(link.Path, `/`) ||
+			path.Dir(link.Path)+`/` != dir {
+			continue
+		}
+		link.Fragment = ``
+		if seen[link.String()] {
+			continue
+		}
+		seen[link.String()] = true
+		entry, err := m.headEntry(ctx, link)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// size and modified time of the linked file by HEAD request.
+func (m *FileDownloader) headEntry(ctx context.Context, link *url.URL) (RemoteEntry, error) {
+	entry := RemoteEntry{Name: path.Base(link.Path), URL: link.String(), Size: -1}
+	resp, err := m.getHead(ctx, entry.URL, nil)
+	if err != nil {
+		return entry, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		m.logfunc(`Could not get modified time[`+entry.URL+`]`, resp.Status)
+		return entry, nil
+	}
+	entry.Size = resp.ContentLength
+	if modTime, err := http.ParseTime(resp.Header.Get(`Last-Modified`)); err == nil {
+		entry.ModTime = modTime
+	}
+	return entry, nil
+}
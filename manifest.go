@@ -0,0 +1,131 @@
+package filedownloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	neturl "net/url"
+	"strings"
+)
+
+// download files listed in a manifest file.
+//
+// TSV manifest has one file in a line, url<TAB>localpath[<TAB>sha256].
+// Blank lines and lines starting with # are ignored.
+//
+// JSON manifest is an array of {"url": "...", "localPath": "...", "sha256": "..."}.
+
+// ManifestError is returned when the manifest file has invalid entry
+type ManifestError struct {
+	Path string // manifest file path
+	Line int    // line number of TSV manifest, or entry number of JSON manifest
+	Err  error
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf(`invalid manifest %s:%d: %v`, e.Path, e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ManifestError) Unwrap() error {
+	return e.Err
+}
+
+type manifestEntry struct {
+	URL       string `json:"url"`
+	LocalPath string `json:"localPath"`
+	SHA256    string `json:"sha256"`
+}
+
+// DownloadFromManifest reads download list from the manifest file and downloads them by MultipleFileDownloadContext.
+func (m *FileDownloader) DownloadFromManifest(ctx context.Context, manifestPath string) error {
+	downloads, err := readManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	return m.MultipleFileDownloadContext(ctx, downloads)
+}
+
+func readManifest(manifestPath string) ([]*Download, error) {
+	b, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+		return parseJSONManifest(manifestPath, b)
+	}
+	return parseTSVManifest(manifestPath, b)
+}
+
+func parseJSONManifest(manifestPath string, b []byte) ([]*Download, error) {
+	var entries []manifestEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		line := 0
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line = bytes.Count(b[:syntaxErr.Offset], []byte("\n")) + 1
+		}
+		return nil, &ManifestError{Path: manifestPath, Line: line, Err: err}
+	}
+	var downloads []*Download
+	for i, entry := range entries {
+		d, err := entry.download()
+		if err != nil {
+			return nil, &ManifestError{Path: manifestPath, Line: i + 1, Err: err}
+		}
+		downloads = append(downloads, d)
+	}
+	return downloads, nil
+}
+
+func parseTSVManifest(manifestPath string, b []byte) ([]*Download, error) {
+	var downloads []*Download
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == `` || strings.HasPrefix(text, `#`) {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, &ManifestError{Path: manifestPath, Line: line, Err: errors.New(`expected url<TAB>localpath[<TAB>sha256]`)}
+		}
+		entry := manifestEntry{URL: fields[0], LocalPath: fields[1]}
+		if len(fields) == 3 {
+			entry.SHA256 = fields[2]
+		}
+		d, err := entry.download()
+		if err != nil {
+			return nil, &ManifestError{Path: manifestPath, Line: line, Err: err}
+		}
+		downloads = append(downloads, d)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return downloads, nil
+}
+
+func (e *manifestEntry) download() (*Download, error) {
+	u, err := neturl.Parse(e.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == `` || u.Host == `` {
+		return nil, errors.New(`url must be absolute: ` + e.URL)
+	}
+	if e.LocalPath == `` {
+		return nil, errors.New(`local path is empty`)
+	}
+	if e.SHA256 != `` {
+		if b, err := hex.DecodeString(e.SHA256); err != nil || len(b) != 32 {
+			return nil, errors.New(`invalid sha256: ` + e.SHA256)
+		}
+	}
+	return &Download{URL: e.URL, LocalFilePath: e.LocalPath, ExpectedSHA256: e.SHA256}, nil
+}
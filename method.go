@@ -0,0 +1,34 @@
+package filedownloader
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+)
+
+// download the file returned by a request with a body, ex. POST to a report generation endpoint, by Download.Method.
+
+func (d *Download) method() string {
+	if d.Method == `` {
+		return http.MethodGet
+	}
+	return d.Method
+}
+
+// request other than GET, whose body is sent and whose file is made for the request.
+func (d *Download) hasBody() bool {
+	return d.method() != http.MethodGet
+}
+
+// size of the file is told by the response instead of HEAD request.
+func (m *FileDownloader) sizeFromResponse(d *Download) bool {
+	return m.singleRequest() || d.hasBody()
+}
+
+// request of the download with its method and body.
+func (m *FileDownloader) newDownloadRequest(ctx context.Context, d *Download, url string) (*http.Request, error) {
+	if !d.hasBody() {
+		return m.newRequest(ctx, http.MethodGet, url, m.requestHeader(d))
+	}
+	return m.newRequestWithBody(ctx, d.method(), url, bytes.NewReader(d.Body), m.requestHeader(d))
+}
@@ -0,0 +1,43 @@
+package filedownloader
+
+// feed downloaded bytes and results to a metrics backend by Config.MetricsRecorder, ex. StatsD or Prometheus.
+
+// MetricsRecorder receives metrics of the download. Methods are called from several goroutines at once,
+// so they must be safe for concurrent use and should return soon, since downloading waits for them.
+type MetricsRecorder interface {
+	// AddBytes is called with bytes received from the network, as they arrive.
+	AddBytes(n int64)
+	// ObserveRate is called every second with bytes received in last second, not smoothed by SpeedSmoothing.
+	ObserveRate(bytesPerSecond int64)
+	// IncFilesDone is called when a file has been downloaded. Files skipped by SkipCompleted are not counted.
+	IncFilesDone()
+	// IncErrors is called when a file failed after its retries. Files stopped by cancel or timeout are not counted.
+	IncErrors()
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) AddBytes(n int64)                 {}
+func (noopMetrics) ObserveRate(bytesPerSecond int64) {}
+func (noopMetrics) IncFilesDone()                    {}
+func (noopMetrics) IncErrors()                       {}
+
+// Config.MetricsRecorder, no-op recorder if it is not set.
+func (m *FileDownloader) metrics() MetricsRecorder {
+	if m.conf.MetricsRecorder == nil {
+		return noopMetrics{}
+	}
+	return m.conf.MetricsRecorder
+}
+
+// record the result of the file, errors of cancelled downloads are not recorded.
+func (m *FileDownloader) recordFileMetrics(err error, cancelled bool) {
+	m.callRecovered(`MetricsRecorder`, func() {
+		switch {
+		case err == nil:
+			m.metrics().IncFilesDone()
+		case !cancelled:
+			m.metrics().IncErrors()
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// abort a download slower than Config.MinSpeedBytesPerSecond, so that it is retried.
+// the observer checks downloaded bytes of each attempt over Config.MinSpeedWindow.
+
+// ErrTooSlow download was slower than Config.MinSpeedBytesPerSecond over Config.MinSpeedWindow
+var ErrTooSlow = errors.New(`Download was slower than MinSpeedBytesPerSecond`)
+
+const defaultMinSpeedWindow = 30 * time.Second
+
+// download attempt of a file, cancelled by the observer when it is too slow.
+type speedAttempt struct {
+	cancel  context.CancelFunc
+	aborted int32
+	since   time.Time // start of the current window, zero until the observer sees the attempt
+	bytes   int64     // downloaded bytes of the file at the start of the window
+}
+
+func (m *FileDownloader) minSpeedWindow() time.Duration {
+	if m.conf.MinSpeedWindow <= 0 {
+		return defaultMinSpeedWindow
+	}
+	return m.conf.MinSpeedWindow
+}
+
+// context of a download attempt, and the function to end the attempt which returns true if it was aborted as too slow.
+func (m *FileDownloader) startAttempt(ctx context.Context, progress *fileProgress) (context.Context, func() bool) {
+	if m.conf.MinSpeedBytesPerSecond <= 0 {
+		return ctx, func() bool { return false }
+	}
+	attemptCtx, cancel := context.WithCancel(ctx)
+	a := &speedAttempt{cancel: cancel}
+	m.mu.Lock()
+	progress.attempt = a
+	m.mu.Unlock()
+	return attemptCtx, func() bool {
+		m.mu.Lock()
+		progress.attempt = nil
+		m.mu.Unlock()
+		cancel()
+		return atomic.LoadInt32(&a.aborted) == 1 && ctx.Err() == nil
+	}
+}
+
+// cancel attempts whose speed over the window is below the floor, called every progress report.
+// windows start again while paused.
+func (m *FileDownloader) abortSlowDownloads(files []*fileProgress) {
+	if m.conf.MinSpeedBytesPerSecond <= 0 {
+		return
+	}
+	now, window := time.Now(), m.minSpeedWindow()
+	var logs []string
+	defer func() {
+		for _, l := range logs {
+			m.logfunc(l)
+		}
+	}()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	paused := m.resumed != nil
+	for _, f := range files {
+		a := f.attempt
+		if a == nil || atomic.LoadInt32(&a.aborted) == 1 {
+			continue
+		}
+		if a.since.IsZero() || paused {
+			a.since, a.bytes = now, f.downloaded
+			continue
+		}
+		elapsed := now.Sub(a.since)
+		if elapsed < window {
+			continue
+		}
+		speed := (f.downloaded - a.bytes) * int64(time.Second) / int64(elapsed)
+		if speed >= m.conf.MinSpeedBytesPerSecond {
+			a.since, a.bytes = now, f.downloaded
+			continue
+		}
+		logs = append(logs, fmt.Sprintf(`Abort download of %d bytes per second[%s]`, speed, f.download.URL))
+		atomic.StoreInt32(&a.aborted, 1)
+		a.cancel()
+	}
+}
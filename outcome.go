@@ -0,0 +1,48 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// Outcome how the whole download has ended
+type Outcome string
+
+// OutcomeCompleted all files are downloaded
+const OutcomeCompleted Outcome = `completed`
+
+// OutcomeCancelled download is cancelled by Cancel or by the context given to the ...Context methods
+const OutcomeCancelled Outcome = `cancelled`
+
+// OutcomeTimedOut download did not finish in BatchTimeout or DownloadTimeoutMinutes
+const OutcomeTimedOut Outcome = `timedout`
+
+// OutcomeFailed some files could not be downloaded
+const OutcomeFailed Outcome = `failed`
+
+// Outcome returns how the download has ended. Empty until the download is done.
+func (m *FileDownloader) Outcome() Outcome {
+	return m.outcome
+}
+
+// timeout is checked first, since downloads cancelled by timeout also fail.
+func (m *FileDownloader) decideOutcome(ctx context.Context) Outcome {
+	if ctx.Err() == context.DeadlineExceeded {
+		return OutcomeTimedOut
+	}
+	if atomic.LoadInt32(&m.cancelled) == 1 || errors.Is(m.ctxErr, context.Canceled) {
+		return OutcomeCancelled
+	}
+	if m.err != nil {
+		return OutcomeFailed
+	}
+	return OutcomeCompleted
+}
+
+// ContextError returns context.DeadlineExceeded if the download timed out, or the error of the context given to
+// the ...Context methods if it was cancelled. nil if the download was not stopped by the context, including Cancel.
+// Error of the download has errors of the failed files and this error.
+func (m *FileDownloader) ContextError() error {
+	return m.ctxErr
+}
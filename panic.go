@@ -0,0 +1,52 @@
+package filedownloader
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+)
+
+// panic in a download goroutine, ex. in a callback of Config, fails only the file.
+// panic in a callback of progress, total size or metrics is logged, and the download is continued.
+
+// PanicError is the error of a download which panicked. It is the Err of DownloadError.
+type PanicError struct {
+	Value interface{} // recovered value
+	Stack []byte      // stack trace of the panic
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf(`panic while downloading: %v`, e.Value)
+}
+
+// Unwrap returns the recovered value if it is an error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// download with retry, panic is returned as PanicError unless Config.PropagatePanics is set.
+func (m *FileDownloader) downloadRecovered(ctx context.Context, d *Download, downloadedBytes chan fileBytes, progress *fileProgress, useResume bool, resume *resumeInfo) (err error) {
+	if !m.conf.PropagatePanics {
+		defer func() {
+			if r := recover(); r != nil {
+				stack := debug.Stack()
+				m.logfunc(`ERROR Download panicked[`+d.URL+`]`, r, string(stack))
+				err = &DownloadError{URL: d.URL, Err: &PanicError{Value: r, Stack: stack}}
+			}
+		}()
+	}
+	return m.downloadWithRetry(ctx, d, downloadedBytes, progress, useResume, resume)
+}
+
+// call a callback of Config outside of the download, panic is logged unless Config.PropagatePanics is set.
+func (m *FileDownloader) callRecovered(name string, callback func()) {
+	if !m.conf.PropagatePanics {
+		defer func() {
+			if r := recover(); r != nil {
+				m.logfunc(`ERROR `+name+` panicked`, r, string(debug.Stack()))
+			}
+		}()
+	}
+	callback()
+}
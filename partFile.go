@@ -0,0 +1,161 @@
+package filedownloader
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// file is downloaded to temp(.part) file and renamed to the local file path after download completes.
+// so the local file path never has half downloaded file.
+
+const partFileSuffix = `.part`
+
+// Config.PartSuffix or .part
+func (m *FileDownloader) partSuffix() string {
+	if m.conf.PartSuffix == `` {
+		return partFileSuffix
+	}
+	return m.conf.PartSuffix
+}
+
+// temp file path of the local file path
+func (m *FileDownloader) partFilePath(localPath string) string {
+	if m.conf.TempDir == `` {
+		return localPath + m.partSuffix()
+	}
+	// files in different directories may have same name, so add hash of the full path.
+	h := fnv.New32a()
+	h.Write([]byte(localPath))
+	return filepath.Join(m.conf.TempDir, fmt.Sprintf(`%s.%08x%s`, filepath.Base(localPath), h.Sum32(), m.partSuffix()))
+}
+
+// temp file path which does not overwrite other files. random number is added to the path
+// if a file of the batch is saved to it, or a file exists there which is not the temp file left by the previous run.
+func (m *FileDownloader) unusedPartFilePath(partPath string) string {
+	for p := partPath; ; {
+		if !m.isOtherFile(p) {
+			return p
+		}
+		p = fmt.Sprintf(`%s.%08x%s`, strings.TrimSuffix(partPath, m.partSuffix()), rand.Uint32(), m.partSuffix())
+	}
+}
+
+// temp file left by the previous run has resume metadata.
+func (m *FileDownloader) isOtherFile(path string) bool {
+	if m.localPaths[filepath.Clean(path)] {
+		return true
+	}
+	fs := m.fileSystem()
+	if _, err := fs.Stat(path); err != nil {
+		return false
+	}
+	_, err := fs.Stat(path + resumeMetaSuffix)
+	return err != nil
+}
+
+// saved paths of the batch, temp files must not be created there.
+func (m *FileDownloader) setLocalPaths(downloads []*Download) {
+	m.localPaths = make(map[string]bool, len(downloads))
+	for _, d := range downloads {
+		if d.LocalFilePath != `` {
+			m.localPaths[filepath.Clean(m.outputFilePath(d.LocalFilePath))] = true
+		}
+	}
+}
+
+// move downloaded temp file to the local file path
+func (m *FileDownloader) finalizeDownloadFile(partPath, localPath string) error {
+	fs := m.fileSystem()
+	err := fs.Rename(partPath, localPath)
+	if err == nil {
+		return nil
+	}
+	// rename does not work across file systems, and network file systems may refuse it. copy the file instead.
+	rfs, ok := fs.(ResumableFileSystem)
+	if !ok || !(errors.Is(err, errCrossDevice) || os.IsPermission(err)) {
+		return err
+	}
+	m.logfunc(`Could not rename temp file to `+localPath+`, copy it instead`, err)
+	// copied next to the local file and renamed there, so that the local file is not seen half written.
+	copyPath := fmt.Sprintf(`%s.%08x%s`, localPath, rand.Uint32(), m.partSuffix())
+	if err := copyFile(rfs, partPath, copyPath); err != nil {
+		fs.Remove(copyPath)
+		return err
+	}
+	if err = fs.Rename(copyPath, localPath); err == nil {
+		m.logfunc(`Temp file is copied and renamed to ` + localPath)
+		return fs.Remove(partPath)
+	}
+	fs.Remove(copyPath)
+	m.logfunc(`Could not rename copied file, copy to `+localPath+` directly`, err)
+	if err := copyFile(rfs, partPath, localPath); err != nil {
+		fs.Remove(localPath)
+		return err
+	}
+	return fs.Remove(partPath)
+}
+
+func copyFile(fs ResumableFileSystem, src, dst string) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// close and remove temp file of the failed download
+func (m *FileDownloader) removePartFile(file io.Closer, partPath string) {
+	file.Close()
+	// download to stdout has no temp file
+	if partPath == `` {
+		return
+	}
+	m.fileSystem().Remove(partPath)
+	removeResumeMeta(m.fileSystem(), partPath)
+}
+
+// CancelAndCleanup cancels downloading as Cancel, and removes temp files of the files not downloaded completely,
+// while Cancel keeps them to resume next time. It returns after the download goroutines ended and files are removed.
+// If the download has not started yet, it is cancelled as soon as it starts.
+func (m *FileDownloader) CancelAndCleanup() {
+	atomic.StoreInt32(&m.cleanup, 1)
+	atomic.StoreInt32(&m.cancelled, 1)
+	m.mu.Lock()
+	cancel := m.cancelBatch
+	m.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-m.finished
+}
+
+// remove temp files created in the batch and not renamed to the local file path
+func (m *FileDownloader) removePartFiles(files []*fileProgress) {
+	fs := m.fileSystem()
+	for _, f := range files {
+		if f.partPath == `` || f.savedPath != `` {
+			continue
+		}
+		if err := fs.Remove(f.partPath); err != nil && !os.IsNotExist(err) {
+			m.logfunc(`Could not remove temp file `+f.partPath, err)
+		}
+		removeResumeMeta(fs, f.partPath)
+	}
+}
@@ -0,0 +1,86 @@
+package filedownloader
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// pause and resume of the downloading batch.
+
+// Pause stops reading downloading files and starting new downloads until Resume is called.
+// Connections are kept while paused, so servers may close them when paused long. Paused time is counted in timeouts.
+// Paused time is excluded from the bytes per second values.
+func (m *FileDownloader) Pause() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.resumed != nil {
+		return
+	}
+	m.resumed = make(chan struct{})
+	m.pausedAt = time.Now()
+	m.logfunc(`Download paused.`)
+}
+
+// Resume restarts the download paused by Pause.
+func (m *FileDownloader) Resume() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.resumed == nil {
+		return
+	}
+	close(m.resumed)
+	m.resumed = nil
+	m.pausedTotal += time.Since(m.pausedAt)
+	m.logfunc(`Download resumed.`)
+}
+
+// Paused returns true while the download is paused.
+func (m *FileDownloader) Paused() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resumed != nil
+}
+
+// wait while paused, returns false if ctx is done while waiting.
+func (m *FileDownloader) waitResume(ctx context.Context) bool {
+	m.mu.Lock()
+	resumed := m.resumed
+	m.mu.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// total paused time until now, including current pause.
+func (m *FileDownloader) pausedDuration() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.resumed != nil {
+		return m.pausedTotal + time.Since(m.pausedAt)
+	}
+	return m.pausedTotal
+}
+
+// reader of the response body which does not read while paused
+type pausableReader struct {
+	ctx context.Context
+	m   *FileDownloader
+	r   io.Reader
+}
+
+func (p *pausableReader) Read(b []byte) (int, error) {
+	if !p.m.waitResume(p.ctx) {
+		return 0, ErrCancelCopy
+	}
+	if p.m.conf.SuspendOutsideWindows && !p.m.waitWindow(p.ctx) {
+		return 0, ErrCancelCopy
+	}
+	return p.r.Read(b)
+}
@@ -0,0 +1,180 @@
+package filedownloader
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// progress of each downloading file.
+
+const (
+	fileWaiting int32 = iota
+	fileDownloading
+	fileDone
+)
+
+// interval of progress reports
+var progressInterval = time.Second
+
+// bytes read by download goroutine, sent to the observer
+type fileBytes struct {
+	index     int // index of the file in the batch
+	n         int
+	sizeKnown bool  // size is told instead of bytes in SingleRequestMode
+	resized   bool  // size differs from HEAD request, the remote file changed while resuming
+	size      int64 // whole size of the file, -1 if unknown
+}
+
+type fileProgress struct {
+	status      int32 // fileWaiting, fileDownloading or fileDone, set by download goroutine
+	index       int
+	download    *Download
+	total       int64
+	partPath    string        // temp file path of the download, set when it is decided
+	localPath   string        // LocalFilePath or the path decided by PathFunc or ResolvePath, set by download goroutine
+	savedPath   string        // path of the downloaded file, set when download succeeded
+	err         error         // error of the download, set when download failed
+	sha256      string        // hex checksum of the saved file, set if Config.WriteChecksumManifest is set
+	copies      []string      // paths the saved file was copied to for duplicated downloads
+	sizeSent    bool          // size told by the response has been sent to the observer in SingleRequestMode
+	inFlight    int64         // bytes reserved by MaxInFlightBytes and not read yet, used by download goroutine
+	received    int64         // bytes read from network including retries, used by download goroutine
+	retries     int           // retries of the download, used by download goroutine
+	skipped     bool          // saved completely by the previous run, not downloaded
+	attempt     *speedAttempt // download attempt checked by MinSpeedBytesPerSecond, guarded by FileDownloader.mu
+	downloaded  int64         // downloaded bytes, following fields are used only by observer
+	lastBytes   int64         // downloaded bytes at last report
+	reported    bool          // last progress of the done file has been reported
+	sizePending bool          // size will be told by the response in SingleRequestMode
+}
+
+func (f *fileProgress) isDownloading() bool {
+	return atomic.LoadInt32(&f.status) == fileDownloading
+}
+
+// files skipped or failed before downloading have no response to tell their sizes, called before the observer starts.
+func settleSkippedSizes(files []*fileProgress) {
+	for _, f := range files {
+		if f.sizePending && (f.skipped || f.err != nil) {
+			f.sizePending, f.sizeSent = false, true
+		}
+	}
+}
+
+// size of the file ended without response is told as 0 bytes, so that progress of the batch is available
+// after the sizes of other files are told. called when the file is not downloaded any more.
+func (m *FileDownloader) resolvePendingSize(downloadedBytes chan<- fileBytes, f *fileProgress) {
+	if f.sizeSent || !m.sizeFromResponse(f.download) || f.download.KnownSize > 0 {
+		return
+	}
+	f.sizeSent = true
+	downloadedBytes <- fileBytes{index: f.index, sizeKnown: true, size: 0}
+}
+
+// fraction of finished files in the batch, used as progress when some file sizes are unknown.
+func doneFileFraction(files []*fileProgress) float64 {
+	if len(files) == 0 {
+		return 0
+	}
+	done := 0
+	for _, f := range files {
+		if atomic.LoadInt32(&f.status) == fileDone {
+			done++
+		}
+	}
+	return float64(done) / float64(len(files))
+}
+
+const defaultProgressBuffer = 10
+
+func (m *FileDownloader) progressBuffer() int {
+	if m.conf.ProgressBuffer <= 0 {
+		return defaultProgressBuffer
+	}
+	return m.conf.ProgressBuffer
+}
+
+// send to ProgressChan, the oldest value is dropped if the buffer is full and ProgressDropOnBackpressure is set.
+func (m *FileDownloader) sendProgress(p float64) {
+	if !m.conf.ProgressDropOnBackpressure {
+		m.ProgressChan <- p
+		return
+	}
+	for {
+		select {
+		case m.ProgressChan <- p:
+			return
+		default:
+		}
+		// reader may take it at the same time
+		select {
+		case <-m.ProgressChan:
+		default:
+		}
+	}
+}
+
+// send to DownloadBytesPerSecond, same as sendProgress.
+func (m *FileDownloader) sendSpeed(bytesPerSecond int64) {
+	if !m.conf.ProgressDropOnBackpressure {
+		m.DownloadBytesPerSecond <- bytesPerSecond
+		return
+	}
+	for {
+		select {
+		case m.DownloadBytesPerSecond <- bytesPerSecond:
+			return
+		default:
+		}
+		select {
+		case <-m.DownloadBytesPerSecond:
+		default:
+		}
+	}
+}
+
+// ActiveDownloads returns the number of files downloading now.
+// Files waiting for a thread or StartJitter and files finished are not counted.
+func (m *FileDownloader) ActiveDownloads() int {
+	return int(atomic.LoadInt32(&m.active))
+}
+
+// call OnFileProgress for files downloading now or finished after last report.
+// rate converts bytes since last report to bytes per second.
+func (m *FileDownloader) reportFileProgress(files []*fileProgress, rate func(bytes int64) int64) {
+	if m.conf.OnFileProgress == nil {
+		return
+	}
+	for _, f := range files {
+		status := atomic.LoadInt32(&f.status)
+		if status == fileWaiting || f.reported {
+			continue
+		}
+		m.callRecovered(`OnFileProgress`, func() {
+			m.conf.OnFileProgress(f.download, f.downloaded, f.total, rate(f.downloaded-f.lastBytes))
+		})
+		f.lastBytes = f.downloaded
+		f.reported = status == fileDone
+	}
+}
+
+// ProgressReader wraps io.Reader and reports bytes read to OnRead.
+// It is used to count downloaded bytes, and can also be used to pipe downloading data to other readers.
+type ProgressReader struct {
+	io.Reader
+	OnRead func(n int) // called with read bytes every time Read reads data
+}
+
+// NewProgressReader creates ProgressReader
+func NewProgressReader(r io.Reader, onRead func(n int)) *ProgressReader {
+	return &ProgressReader{Reader: r, OnRead: onRead}
+}
+
+func (m *ProgressReader) Read(p []byte) (int, error) {
+	n, err := m.Reader.Read(p)
+	if n > 0 && m.OnRead != nil {
+		m.OnRead(n)
+	}
+	return n, err
+}
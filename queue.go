@@ -0,0 +1,67 @@
+package filedownloader
+
+// files waiting for a download thread are started in the order of the queue, Prioritize moves a file to the front.
+
+// files except ones skipped by SkipCompleted or failed before start are queued in the batch order.
+func (m *FileDownloader) setQueue(files []*fileProgress) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queue = nil
+	for _, f := range files {
+		if !f.skipped && f.err == nil {
+			m.queue = append(m.queue, f)
+		}
+	}
+}
+
+func (m *FileDownloader) queued() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queue)
+}
+
+// report the files failed before start, ex. by ErrPathCollision.
+func (m *FileDownloader) failBeforeStart(files []*fileProgress, fileErrs map[*Download]error) {
+	for _, f := range files {
+		if f.err != nil {
+			fileErrs[f.download] = f.err
+			m.sendResult(f.download, ``, f.err)
+		}
+	}
+}
+
+// take the front file, the queue must not be empty.
+func (m *FileDownloader) dequeue() *fileProgress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.queue[0]
+	m.queue = m.queue[1:]
+	return f
+}
+
+// take all waiting files
+func (m *FileDownloader) drainQueue() []*fileProgress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := m.queue
+	m.queue = nil
+	return files
+}
+
+// Prioritize moves the download waiting for a thread to the front of the queue, so that it starts next.
+// It does nothing if the download is already downloading, finished, or not in the batch.
+// Download dropped as duplicated prioritizes the download of the same URL actually fetched.
+func (m *FileDownloader) Prioritize(d *Download) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.duplicates[d]; ok {
+		d = p
+	}
+	for i, f := range m.queue {
+		if f.download == d {
+			copy(m.queue[1:i+1], m.queue[:i])
+			m.queue[0] = f
+			return
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// read many byte ranges of a remote file by few requests.
+// adjacent or overlapping ranges are merged, and merged ranges are requested together as multipart/byteranges.
+
+// ranges requested at once, servers limit the number of ranges in a request.
+const maxRangesPerRequest = 64
+
+// RangeRead is a byte range of the remote file, written to Dest by ReadRanges.
+type RangeRead struct {
+	Offset int64
+	Length int64
+	Dest   io.Writer
+}
+
+// range of the remote file requested, which covers some RangeReads
+type byteRange struct {
+	start, end int64 // end is inclusive as Range header
+}
+
+// ReadRanges reads the ranges of the remote file at url and writes them to Dest of each read.
+// Adjacent or overlapping ranges are merged and requested in a request as multipart/byteranges.
+// Server which does not support multiple ranges may send the whole file, which is also accepted.
+// Config.UserAgent, URLRefresher and RequestInterceptor are used for the requests.
+func (m *FileDownloader) ReadRanges(ctx context.Context, url string, reads []*RangeRead) error {
+	for _, r := range reads {
+		if r.Offset < 0 || r.Length <= 0 {
+			return fmt.Errorf(`invalid range offset %d length %d`, r.Offset, r.Length)
+		}
+	}
+	merged := mergeRanges(reads)
+	written := make(map[*RangeRead]int64, len(reads))
+	for len(merged) > 0 {
+		n := len(merged)
+		if n > maxRangesPerRequest {
+			n = maxRangesPerRequest
+		}
+		if err := m.readRanges(ctx, url, merged[:n], reads, written); err != nil {
+			if _, ok := err.(*DownloadError); ok {
+				return err
+			}
+			return &DownloadError{URL: url, Err: err}
+		}
+		merged = merged[n:]
+	}
+	for _, r := range reads {
+		if written[r] != r.Length {
+			return &DownloadError{URL: url, Err: fmt.Errorf(`range %d-%d is not sent by the server`, r.Offset, r.Offset+r.Length-1)}
+		}
+	}
+	return nil
+}
+
+// sorted ranges of the reads, adjacent or overlapping ranges are merged.
+func mergeRanges(reads []*RangeRead) []byteRange {
+	var ranges []byteRange
+	for _, r := range reads {
+		ranges = append(ranges, byteRange{start: r.Offset, end: r.Offset + r.Length - 1})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	var merged []byteRange
+	for _, r := range ranges {
+		if last := len(merged) - 1; last >= 0 && r.start <= merged[last].end+1 {
+			if r.end > merged[last].end {
+				merged[last].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func rangesHeaderValue(ranges []byteRange) string {
+	values := make([]string, len(ranges))
+	for i, r := range ranges {
+		values[i] = fmt.Sprintf(`%d-%d`, r.start, r.end)
+	}
+	return `bytes=` + strings.Join(values, `,`)
+}
+
+// request the ranges and route the parts of the response to the reads.
+func (m *FileDownloader) readRanges(ctx context.Context, url string, ranges []byteRange, reads []*RangeRead, written map[*RangeRead]int64) error {
+	requestURL, err := m.refreshURL(url)
+	if err != nil {
+		return err
+	}
+	req, err := m.newRequest(ctx, `GET`, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(`Range`, rangesHeaderValue(ranges))
+	resp, err := m.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// whole file, only the requested ranges are needed
+		last := ranges[len(ranges)-1].end
+		return routeRange(ctx, io.LimitReader(resp.Body, last+1), 0, reads, written)
+	case http.StatusPartialContent:
+	default:
+		return &DownloadError{URL: url, StatusCode: resp.StatusCode, Err: errors.New(`unexpected status ` + resp.Status)}
+	}
+	mediaType, params, _ := mime.ParseMediaType(resp.Header.Get(`Content-Type`))
+	if mediaType != `multipart/byteranges` {
+		// single range of the merged ranges
+		start, _, _, err := parseContentRange(resp.Header.Get(`Content-Range`))
+		if err != nil {
+			return err
+		}
+		return routeRange(ctx, resp.Body, start, reads, written)
+	}
+	parts := multipart.NewReader(resp.Body, params[`boundary`])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, _, _, err := parseContentRange(part.Header.Get(`Content-Range`))
+		if err != nil {
+			return err
+		}
+		if err := routeRange(ctx, part, start, reads, written); err != nil {
+			return err
+		}
+	}
+}
+
+// write the bytes of the remote file from start to the reads which cover them.
+func routeRange(ctx context.Context, r io.Reader, start int64, reads []*RangeRead, written map[*RangeRead]int64) error {
+	buf := make([]byte, copyBufferSize)
+	pos := start
+	for {
+		if ctx.Err() != nil {
+			return ErrCancelCopy
+		}
+		n, err := r.Read(buf)
+		for _, read := range reads {
+			from, to := maxInt64(pos, read.Offset), minInt64(pos+int64(n), read.Offset+read.Length)
+			// bytes of the read must be written in order
+			if from >= to || from != read.Offset+written[read] {
+				continue
+			}
+			if _, err := read.Dest.Write(buf[from-pos : to-pos]); err != nil {
+				return err
+			}
+			written[read] += to - from
+		}
+		pos += int64(n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// start, end and total size of Content-Range, ex. bytes 0-1023/1024. total is -1 if unknown.
+func parseContentRange(contentRange string) (start, end, total int64, err error) {
+	invalid := errors.New(`unexpected Content-Range ` + contentRange)
+	spec := strings.TrimPrefix(contentRange, `bytes `)
+	slash := strings.Index(spec, `/`)
+	dash := strings.Index(spec, `-`)
+	if spec == contentRange || slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, invalid
+	}
+	if start, err = strconv.ParseInt(spec[:dash], 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if end, err = strconv.ParseInt(spec[dash+1:slash], 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if total, err = strconv.ParseInt(spec[slash+1:], 10, 64); err != nil {
+		total = -1
+	}
+	return start, end, total, nil
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
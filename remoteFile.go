@@ -0,0 +1,125 @@
+package filedownloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// random access to a remote file by range requests, ex. to read the central directory of a remote zip.
+
+// ErrRangeNotSupported server does not accept range requests or does not tell the file size
+var ErrRangeNotSupported = errors.New(`Range requests are not supported`)
+
+// size of the blocks fetched and cached by RemoteFile, replaced in tests
+var remoteBlockSize int64 = 64 * 1024
+
+// cached blocks of a RemoteFile, older blocks are dropped over it
+const maxRemoteBlocks = 256
+
+// RemoteFile is a remote file read by range requests. It implements io.ReaderAt, so that formats needing
+// random access like archive/zip.NewReader can read it without downloading the whole file.
+// Bytes are fetched in blocks of 64KB and up to 256 blocks are cached. It is safe for concurrent use.
+type RemoteFile struct {
+	m      *FileDownloader
+	ctx    context.Context
+	url    string
+	size   int64
+	mu     sync.Mutex
+	blocks map[int64][]byte // cached blocks by index
+	order  []int64          // indexes of cached blocks, oldest first
+}
+
+// OpenRemote checks by HEAD request that the server accepts range requests and tells the size of the file,
+// and returns RemoteFile reading url. ctx bounds all requests of the RemoteFile.
+// It fails with ErrRangeNotSupported if the server does not, and with DownloadError of the status code for non-2xx response.
+func (m *FileDownloader) OpenRemote(ctx context.Context, url string) (*RemoteFile, error) {
+	info, err := m.getResumeInfo(ctx, url, nil)
+	if _, ok := err.(*DownloadError); ok {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &DownloadError{URL: url, Err: err}
+	}
+	if !info.isResumable || info.contentLength < 0 {
+		return nil, &DownloadError{URL: url, Err: ErrRangeNotSupported}
+	}
+	return &RemoteFile{m: m, ctx: ctx, url: url, size: info.contentLength, blocks: make(map[int64][]byte)}, nil
+}
+
+// Size returns the size of the remote file told by HEAD request.
+func (f *RemoteFile) Size() int64 {
+	return f.size
+}
+
+// ReadAt reads len(p) bytes at off of the remote file. Missing blocks are fetched by a request.
+func (f *RemoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New(`negative offset`)
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > f.size {
+		end = f.size
+	}
+	first := off / remoteBlockSize
+	blocks, err := f.fetch(first, (end-1)/remoteBlockSize)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i, block := range blocks {
+		if i == 0 {
+			block = block[off-first*remoteBlockSize:]
+		}
+		n += copy(p[n:], block)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// blocks from first to last, blocks not cached yet are fetched.
+func (f *RemoteFile) fetch(first, last int64) ([][]byte, error) {
+	var reads []*RangeRead
+	buffers := make(map[int64]*bytes.Buffer)
+	f.mu.Lock()
+	for i := first; i <= last; i++ {
+		if _, ok := f.blocks[i]; ok {
+			continue
+		}
+		length := minInt64(remoteBlockSize, f.size-i*remoteBlockSize)
+		buffers[i] = bytes.NewBuffer(make([]byte, 0, length))
+		reads = append(reads, &RangeRead{Offset: i * remoteBlockSize, Length: length, Dest: buffers[i]})
+	}
+	blocks := make([][]byte, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		blocks = append(blocks, f.blocks[i])
+	}
+	f.mu.Unlock()
+	if len(reads) == 0 {
+		return blocks, nil
+	}
+	if err := f.m.ReadRanges(f.ctx, f.url, reads); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, b := range buffers {
+		blocks[i-first] = b.Bytes()
+		if _, ok := f.blocks[i]; !ok {
+			f.blocks[i] = b.Bytes()
+			f.order = append(f.order, i)
+		}
+	}
+	for len(f.order) > maxRemoteBlocks {
+		delete(f.blocks, f.order[0])
+		f.order = f.order[1:]
+	}
+	return blocks, nil
+}
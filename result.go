@@ -0,0 +1,55 @@
+package filedownloader
+
+import "context"
+
+// Result of each file download delivered by DownloadChan
+type Result struct {
+	Download *Download
+	Path     string // local path of the downloaded file, empty if the download failed
+	Err      error  // nil if the download succeeded
+	Skipped  bool   // file was saved completely by the previous run and not downloaded, by Config.SkipCompleted
+	// AdditionalPaths are hard links or copies of the file created for Download.AdditionalPaths
+	AdditionalPaths []string
+	RetryCount      int    // retries of the download, 0 if it ended at the first try
+	SHA256          string // hex SHA-256 of the saved file if Config.ComputeChecksum is set
+}
+
+// DownloadChan downloads files as MultipleFileDownload does in background, and returns a channel
+// receiving the Result of each file as soon as it finished. The channel is closed when all downloads are done.
+// Error of the whole download (ex. timeout) is available by Outcome after the channel is closed.
+func (m *FileDownloader) DownloadChan(downloads []*Download) <-chan Result {
+	if m.State != StateReady {
+		panic(`filedownloader has already started or done`)
+	}
+	m.State = StateDownloading
+	// results are buffered so that downloads do not wait for the receiver
+	results := make(chan Result, len(downloads))
+	m.results = results
+	go func() {
+		defer close(results)
+		m.downloadFiles(context.Background(), downloads)
+	}()
+	return results
+}
+
+func (m *FileDownloader) sendResult(d *Download, path string, err error) {
+	m.sendResultPaths(d, path, nil, 0, ``, err)
+}
+
+func (m *FileDownloader) sendResultPaths(d *Download, path string, additional []string, retries int, sum string, err error) {
+	m.recordResult(d, retries, err)
+	m.emitEvent(Event{Type: EventFileDone, Download: d, Path: path, Err: err})
+	if m.results == nil {
+		return
+	}
+	m.results <- Result{Download: d, Path: path, Err: err, AdditionalPaths: additional, RetryCount: retries, SHA256: sum}
+}
+
+func (m *FileDownloader) sendSkipped(d *Download, path, sum string) {
+	m.recordResult(d, 0, nil)
+	m.emitEvent(Event{Type: EventFileDone, Download: d, Path: path, Skipped: true})
+	if m.results == nil {
+		return
+	}
+	m.results <- Result{Download: d, Path: path, Skipped: true, SHA256: sum}
+}
@@ -1,23 +1,17 @@
 package filedownloader
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
-	"os"
+	"io"
+	"net/http"
 )
 
 // helper functions to resume file.
 
 // check start point of resume file
 func getFileStartOffset(localfilePath string) (int64, error) {
-	f, err := os.Stat(localfilePath)
-	if err != nil {
-		return 0, err
-	}
-	if f.IsDir() {
-		return 0, errors.New(localfilePath + ` is directory. Not a file`)
-	}
-	return f.Size(), nil
+	return fileSize(osFileSystem{}, localfilePath)
 }
 
 // small files should not use resume
@@ -28,31 +22,132 @@ func isFileShouldResume(contentLength int64) bool {
 	return true
 }
 
-// exmaple Range: bytes=0-1023
-func rangeHeaderValue(file *os.File, currentLocalFileSize int64, contentLength int64) string {
-	var begin int64
-	if isFileShouldResume(contentLength) {
-		// while process may killed suddenly, last buffer of the file has possibility to be broken. so over write last buffer.
-		modChunk := currentLocalFileSize % int64(copyBufferSize)
-		begin = currentLocalFileSize - modChunk
-		file.Seek(begin, 0)
+// while process may killed suddenly, last buffer of the file has possibility to be broken. so over write last buffer.
+func resumeOffset(currentLocalFileSize int64, contentLength int64) int64 {
+	if !isFileShouldResume(contentLength) {
+		return 0
 	}
+	modChunk := currentLocalFileSize % int64(copyBufferSize)
+	return currentLocalFileSize - modChunk
+}
+
+// exmaple Range: bytes=0-1023
+func rangeHeaderValue(begin int64, contentLength int64) string {
 	return fmt.Sprintf(`bytes=%d-%d`, begin, contentLength)
 }
 
-// find download target file and its size to know the progress of download
-func setupDownloadFile(localPath string, useResume bool) (*os.File, int64, error) {
-	offset, err := getFileStartOffset(localPath)
-	var file *os.File
-	if err != nil && os.IsNotExist(err) {
-		file, err = os.Create(localPath)
-		return file, 0, err
+// open download target file, returns the offset to start writing.
+// existing file is used only if useResume is true and the file system supports it.
+func (m *FileDownloader) setupDownloadFile(localPath string, useResume bool, contentLength int64) (io.WriteCloser, int64, error) {
+	fs := m.fileSystem()
+	if rfs, ok := fs.(ResumableFileSystem); ok && useResume {
+		size, err := fileSize(fs, localPath)
+		if err == nil {
+			if begin := resumeOffset(size, contentLength); begin > 0 {
+				file, err := rfs.OpenAt(localPath, begin)
+				return file, begin, err
+			}
+		}
+	}
+	file, err := fs.Create(localPath)
+	return file, 0, err
+}
+
+// resume metadata is saved next to the temp file to know the partial file is made from the same remote file.
+const resumeMetaSuffix = `.meta`
+
+type resumeMeta struct {
+	ContentLength int64  `json:"contentLength"`
+	ETag          string `json:"etag"`
+}
+
+func writeResumeMeta(fs FileSystem, partPath string, resume *resumeInfo) error {
+	b, err := json.Marshal(&resumeMeta{ContentLength: resume.contentLength, ETag: resume.etag})
+	if err != nil {
+		return err
+	}
+	w, err := fs.Create(partPath + resumeMetaSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func readResumeMeta(fs ResumableFileSystem, partPath string) (*resumeMeta, error) {
+	r, err := fs.Open(partPath + resumeMetaSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var meta resumeMeta
+	if err := json.NewDecoder(r).Decode(&meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func removeResumeMeta(fs FileSystem, partPath string) {
+	fs.Remove(partPath + resumeMetaSuffix)
+}
+
+// partial file can be resumed only if the remote file has same size and ETag as the time partial file was made.
+func isPartFileResumable(fs FileSystem, partPath string, resume *resumeInfo) bool {
+	rfs, ok := fs.(ResumableFileSystem)
+	if !ok {
+		return false
 	}
-	// use file that already exists
-	file, err = os.OpenFile(localPath, os.O_RDWR, os.ModeExclusive)
+	size, err := fileSize(fs, partPath)
+	if err != nil || size == 0 || size > resume.contentLength {
+		return false
+	}
+	meta, err := readResumeMeta(rfs, partPath)
 	if err != nil {
-		// can't open file for some reason
-		return nil, 0, err
+		return false
+	}
+	return meta.ContentLength == resume.contentLength && meta.ETag == resume.etag
+}
+
+// whole size of the remote file told by 206 response of the resumed request.
+// changed is true if the response can not be appended to the partial file since the remote file changed.
+func resumedFileSize(resp *http.Response, offset int64, contentLength int64) (size int64, changed bool) {
+	start, _, total, err := parseContentRange(resp.Header.Get(`Content-Range`))
+	if err != nil {
+		return -1, true
+	}
+	return total, start != offset || total != contentLength
+}
+
+// ResumeState returns bytes of each file already on disk, without network access. It is the size of the saved file
+// if it exists, otherwise the size of the temp file left by ResumeFromPartial, which is resumed if the remote file
+// has not changed. 0 if nothing is on disk, or LocalFilePath is empty or StdoutPath.
+func (m *FileDownloader) ResumeState(downloads []*Download) map[*Download]int64 {
+	fs := m.fileSystem()
+	state := make(map[*Download]int64, len(downloads))
+	for _, d := range downloads {
+		state[d] = 0
+		if d.LocalFilePath == `` || isStdout(d.LocalFilePath) {
+			continue
+		}
+		if size, err := fileSize(fs, m.outputFilePath(d.LocalFilePath)); err == nil {
+			state[d] = size
+			continue
+		}
+		// temp file without metadata is not resumed
+		partPath := m.downloadPartPath(d.URL, d.LocalFilePath)
+		rfs, ok := fs.(ResumableFileSystem)
+		if !ok || m.conf.CASRoot != `` {
+			continue
+		}
+		if _, err := readResumeMeta(rfs, partPath); err != nil {
+			continue
+		}
+		if size, err := fileSize(fs, partPath); err == nil {
+			state[d] = size
+		}
 	}
-	return file, offset, nil
+	return state
 }
@@ -0,0 +1,141 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// retry failed downloads up to Config.MaxRetry times.
+
+const defaultRetryDelay = time.Second
+
+const maxRetryDelay = time.Minute
+
+// ErrRetryBudgetExhausted is joined to the error of a file not retried because the batch used up Config.MaxTotalRetries
+var ErrRetryBudgetExhausted = errors.New(`Retries of the batch reached MaxTotalRetries`)
+
+func (m *FileDownloader) downloadWithRetry(ctx context.Context, d *Download, downloadedBytes chan fileBytes, progress *fileProgress, useResume bool, resume *resumeInfo) error {
+	maxRetry := m.maxRetry(d)
+	for attempt := 1; ; attempt++ {
+		attemptCtx, endAttempt := m.startAttempt(ctx, progress)
+		err := m.downloadFile(attemptCtx, d, downloadedBytes, progress, useResume, resume)
+		if endAttempt() && err != nil {
+			err = &DownloadError{URL: d.URL, Err: ErrTooSlow}
+			// temp file of the aborted attempt is kept as cancelled, but it is not resumed without ResumeFromPartial
+			if !m.conf.ResumeFromPartial && progress.partPath != `` {
+				m.fileSystem().Remove(progress.partPath)
+			}
+		}
+		// bytes written to stdout can not be taken back
+		if err == nil || ctx.Err() != nil || attempt > maxRetry || !m.isRetryable(err) || isStdout(d.LocalFilePath) {
+			return err
+		}
+		if !m.takeRetryBudget() {
+			m.logfunc(`Retries of the batch reached MaxTotalRetries, not retried[` + d.URL + `]`)
+			return joinErrors(err, ErrRetryBudgetExhausted)
+		}
+		delay := m.retryDelay(attempt)
+		m.logfunc(`Retry download ` + strconv.Itoa(attempt) + `/` + strconv.Itoa(maxRetry) + ` after ` + delay.String() + `[` + d.URL + `]`)
+		progress.retries++
+		atomic.AddInt32(&m.retries, 1)
+		traceRetry(ctx, attempt, err, delay)
+		m.emitEvent(Event{Type: EventRetry, Download: d, Attempt: attempt, Err: err})
+		if m.conf.OnRetry != nil {
+			m.conf.OnRetry(d, attempt, err, delay)
+		}
+		if !sleepContext(ctx, delay) {
+			return err
+		}
+	}
+}
+
+// Download.MaxRetry or Config.MaxRetry
+func (m *FileDownloader) maxRetry(d *Download) int {
+	if d.MaxRetry != nil {
+		return *d.MaxRetry
+	}
+	return m.conf.MaxRetry
+}
+
+// count a retry of the batch, false if Config.MaxTotalRetries is used up.
+func (m *FileDownloader) takeRetryBudget() bool {
+	if m.conf.MaxTotalRetries <= 0 {
+		return true
+	}
+	return atomic.AddInt32(&m.totalRetries, 1) <= int32(m.conf.MaxTotalRetries)
+}
+
+// exponential backoff of the retry count
+func (m *FileDownloader) retryDelay(attempt int) time.Duration {
+	delay := m.conf.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// error reading the response body, ex. the connection is reset. the status code was 2xx but the body is broken.
+type bodyReadError struct {
+	err error
+}
+
+func (e *bodyReadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *bodyReadError) Unwrap() error {
+	return e.err
+}
+
+// 403 of the expired signed URL may succeed with the URL refreshed by Config.URLRefresher
+func (m *FileDownloader) isRetryable(err error) bool {
+	var downloadErr *DownloadError
+	if m.conf.URLRefresher != nil && errors.As(err, &downloadErr) && downloadErr.StatusCode == http.StatusForbidden {
+		return true
+	}
+	return isRetryableError(err)
+}
+
+// network errors and server errors may succeed next time
+func isRetryableError(err error) bool {
+	if errors.Is(err, ErrCancelCopy) || isRefusedConnection(err) {
+		return false
+	}
+	// full disk or permission is not fixed by retry
+	var fsErr *FileSystemError
+	if errors.As(err, &fsErr) {
+		return false
+	}
+	// broken transfer may succeed next time
+	if errors.Is(err, ErrDigestMismatch) || errors.Is(err, ErrChecksumMismatch) {
+		return true
+	}
+	// connection cut while reading the body of 2xx response
+	var readErr *bodyReadError
+	if errors.As(err, &readErr) {
+		return true
+	}
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) {
+		return false
+	}
+	switch code := downloadErr.StatusCode; {
+	case code == 0:
+		return true
+	case code == http.StatusRequestTimeout || code == http.StatusTooManyRequests:
+		return true
+	case code >= 500:
+		return true
+	}
+	return false
+}
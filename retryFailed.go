@@ -0,0 +1,97 @@
+package filedownloader
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// download again only the files failed in the previous run of the downloader, by RetryFailed.
+
+// record the result of the file, called once for each download of the run.
+func (m *FileDownloader) recordResult(d *Download, retries int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fileResults == nil {
+		m.fileResults = make(map[*Download]error)
+		m.fileRetries = make(map[*Download]int)
+	}
+	m.fileResults[d] = err
+	m.fileRetries[d] = retries
+}
+
+// Results returns the result of each download, nil if it was downloaded or skipped.
+// Results of the files downloaded again by RetryFailed are updated.
+func (m *FileDownloader) Results() map[*Download]error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	results := make(map[*Download]error, len(m.fileResults))
+	for d, err := range m.fileResults {
+		results[d] = err
+	}
+	return results
+}
+
+// RetryCounts returns the retries of each download, 0 if it ended at the first try or was skipped.
+// Retry counts of the files downloaded again by RetryFailed are of the last run.
+func (m *FileDownloader) RetryCounts() map[*Download]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[*Download]int, len(m.fileRetries))
+	for d, retries := range m.fileRetries {
+		counts[d] = retries
+	}
+	return counts
+}
+
+// TotalRetries returns the retries of all files in the batch. It can be called while downloading.
+// It is reset by RetryFailed.
+func (m *FileDownloader) TotalRetries() int {
+	return int(atomic.LoadInt32(&m.retries))
+}
+
+// RetryFailed downloads again the files failed, cancelled or not started in the previous run with the same Config,
+// and returns the error of them. Downloaded files are not touched. Sizes, progress channels, MaxTotalBytes and
+// MaxTotalRetries are reset for the retry. It can be called only after the download is done, nil if nothing failed.
+func (m *FileDownloader) RetryFailed() error {
+	if m.State != StateDone {
+		panic(`filedownloader has not finished`)
+	}
+	var failed []*Download
+	m.mu.Lock()
+	for _, d := range m.batch {
+		if err, ok := m.fileResults[d]; !ok || err != nil {
+			failed = append(failed, d)
+		}
+	}
+	m.mu.Unlock()
+	if len(failed) == 0 {
+		return nil
+	}
+	m.logfunc(`Retry failed downloads`, len(failed))
+	m.resetForRetry()
+	m.State = StateDownloading
+	m.downloadFiles(context.Background(), failed)
+	return m.err
+}
+
+// reset state of the previous run, results of downloaded files are kept.
+func (m *FileDownloader) resetForRetry() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finished = make(chan struct{})
+	m.err, m.ctxErr, m.spaceErr = nil, nil, nil
+	m.outcome = ``
+	m.remaining, m.skipped, m.duplicates = nil, nil, nil
+	m.results = nil
+	m.cancelled, m.cleanup = 0, 0
+	m.batchBytes, m.totalRetries, m.retries = 0, 0, 0
+	m.TotalFilesSize, m.unknownSize = 0, false
+	// channels of the previous run are closed
+	if m.conf.RequiresDetailProgress {
+		m.ProgressChan = make(chan float64, m.progressBuffer())
+		m.DownloadBytesPerSecond = make(chan int64, m.progressBuffer())
+	}
+	if m.conf.OrderedEvents {
+		m.Events = make(chan Event, m.progressBuffer())
+	}
+}
@@ -0,0 +1,67 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// download URLs of other schemes than http and https, ex. ftp or s3, by handlers given to RegisterScheme.
+
+// DownloadHandler downloads files of a URL scheme registered by RegisterScheme.
+// Methods are called from several download goroutines at once.
+type DownloadHandler interface {
+	// Size returns the size of the file at url, -1 if it is unknown.
+	Size(ctx context.Context, url string) (int64, error)
+	// Open returns the content of the file at url from the start. It is closed after reading.
+	Open(ctx context.Context, url string) (io.ReadCloser, error)
+}
+
+// RegisterScheme downloads URLs of scheme, ex. ftp, by h in the batch together with HTTP URLs.
+// The files are counted in progress, limited by MaxDownloadThreads, retried and reported as HTTP files.
+// They are not resumed since the handler reads from the start. Register handlers before the download starts.
+func (m *FileDownloader) RegisterScheme(scheme string, h DownloadHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.schemes == nil {
+		m.schemes = make(map[string]DownloadHandler)
+	}
+	m.schemes[strings.ToLower(scheme)] = h
+}
+
+// send the request by the handler of the scheme, or by HTTP client.
+func (m *FileDownloader) do(r *http.Request) (*http.Response, error) {
+	m.mu.Lock()
+	h, ok := m.schemes[strings.ToLower(r.URL.Scheme)]
+	m.mu.Unlock()
+	if !ok {
+		return m.client.Do(r)
+	}
+	return handlerResponse(r, h)
+}
+
+// response made from the handler, as a server not accepting range requests.
+func handlerResponse(r *http.Request, h DownloadHandler) (*http.Response, error) {
+	url := r.URL.String()
+	resp := &http.Response{Status: `200 OK`, StatusCode: http.StatusOK, Proto: `HTTP/1.1`, ProtoMajor: 1, ProtoMinor: 1,
+		Header: make(http.Header), Request: r, ContentLength: -1, Body: http.NoBody}
+	switch r.Method {
+	case http.MethodHead:
+		size, err := h.Size(r.Context(), url)
+		if err != nil {
+			return nil, err
+		}
+		resp.ContentLength = size
+	case http.MethodGet:
+		body, err := h.Open(r.Context(), url)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = body
+	default:
+		return nil, errors.New(r.Method + ` is not supported by the handler of ` + r.URL.Scheme)
+	}
+	return resp, nil
+}
@@ -0,0 +1,54 @@
+package filedownloader
+
+import (
+	"net/http"
+	"time"
+)
+
+// decide whether each file is downloaded by Config.ShouldDownload.
+
+// HeadInfo is the remote file told by HEAD request, given to Config.ShouldDownload.
+type HeadInfo struct {
+	Size         int64       // Content-Length, -1 if unknown
+	Resumable    bool        // server accepts range requests
+	ETag         string      // ETag header, empty if not sent
+	LastModified time.Time   // Last-Modified header, zero if not sent
+	Header       http.Header // headers of the response, nil if HEAD request was not sent
+}
+
+func headInfo(resume *resumeInfo) HeadInfo {
+	info := HeadInfo{Size: resume.contentLength, Resumable: resume.isResumable, ETag: resume.etag, Header: resume.header}
+	if modTime, err := http.ParseTime(resume.header.Get(`Last-Modified`)); err == nil {
+		info.LastModified = modTime
+	}
+	return info
+}
+
+// skip or fail the files by ShouldDownload, files skipped or failed already are not asked.
+func (m *FileDownloader) askShouldDownload(files []*fileProgress, resumableUrls map[string]*resumeInfo) {
+	if m.conf.ShouldDownload == nil {
+		return
+	}
+	fs := m.fileSystem()
+	for _, f := range files {
+		d := f.download
+		if f.skipped || f.err != nil || d.LocalFilePath == `` || isStdout(d.LocalFilePath) {
+			continue
+		}
+		size, err := fileSize(fs, m.outputFilePath(d.LocalFilePath))
+		exists := err == nil
+		if !exists {
+			size = 0
+		}
+		download, err := m.conf.ShouldDownload(d, exists, size, headInfo(resumableUrls[d.URL]))
+		if err != nil {
+			m.logfunc(`ShouldDownload failed[`+d.URL+`]`, err)
+			f.err = &DownloadError{URL: d.URL, Err: err}
+			continue
+		}
+		if !download {
+			m.logfunc(`Skipped by ShouldDownload[` + d.URL + `]`)
+			m.markSkipped(f)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package filedownloader
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Config.SingleRequestMode gets file sizes from the responses of ranged GET requests instead of HEAD requests.
+
+// range of the whole file, 206 response tells the file size by Content-Range.
+const wholeFileRange = `bytes=0-`
+
+// HEAD requests are still needed to check files before download.
+func (m *FileDownloader) singleRequest() bool {
+	return m.conf.SingleRequestMode && !m.conf.ResumeFromPartial && !m.conf.SkipCompleted && m.conf.ShouldDownload == nil
+}
+
+// whole size of the file from Content-Range of 206 response or Content-Length of 200 response, -1 if unknown.
+func responseFileSize(resp *http.Response) (int64, error) {
+	if resp.StatusCode != http.StatusPartialContent {
+		return resp.ContentLength, nil
+	}
+	start, _, total, err := parseContentRange(resp.Header.Get(`Content-Range`))
+	if err != nil {
+		return 0, err
+	}
+	if start != 0 {
+		return 0, errors.New(`unexpected Content-Range ` + resp.Header.Get(`Content-Range`))
+	}
+	return total, nil
+}
+
+// call OnTotalSizeKnown with the sizes told by HEAD requests or responses.
+func (m *FileDownloader) totalSizeKnown(fileCount int) {
+	if m.conf.OnTotalSizeKnown == nil {
+		return
+	}
+	total := m.TotalFilesSize
+	if m.unknownSize {
+		total = -1
+	}
+	m.callRecovered(`OnTotalSizeKnown`, func() { m.conf.OnTotalSizeKnown(total, fileCount) })
+}
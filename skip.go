@@ -0,0 +1,84 @@
+package filedownloader
+
+import (
+	"crypto/sha256"
+	"io"
+	"strings"
+)
+
+// skip files saved completely by the previous run of the batch, when Config.SkipCompleted is set.
+
+// mark files whose saved file is complete, they are counted as downloaded.
+func (m *FileDownloader) skipCompleted(files []*fileProgress) {
+	if !m.conf.SkipCompleted || m.conf.CompressOutput || m.conf.DecompressGzip || m.conf.StreamTransform != nil {
+		return
+	}
+	for _, f := range files {
+		if f.err != nil {
+			continue
+		}
+		sum, ok := m.isCompleted(f.download, f.total)
+		if !ok {
+			continue
+		}
+		m.logfunc(`Already downloaded, skipped[` + f.download.URL + `]`)
+		f.sha256 = sum
+		m.markSkipped(f)
+	}
+}
+
+// skipped file is counted as downloaded.
+func (m *FileDownloader) markSkipped(f *fileProgress) {
+	f.skipped = true
+	f.savedPath = f.download.LocalFilePath
+	if f.total > 0 {
+		f.downloaded = f.total
+		f.lastBytes = f.total
+	}
+	f.status = fileDone
+	m.mu.Lock()
+	m.skipped = append(m.skipped, f.download)
+	m.mu.Unlock()
+	m.sendSkipped(f.download, f.savedPath, f.sha256)
+}
+
+// saved file has the remote size and the expected checksum, checksum is returned if it was computed.
+func (m *FileDownloader) isCompleted(d *Download, total int64) (string, bool) {
+	if d.LocalFilePath == `` || isStdout(d.LocalFilePath) || total < 0 {
+		return ``, false
+	}
+	fs := m.fileSystem()
+	size, err := fileSize(fs, d.LocalFilePath)
+	if err != nil || size != total {
+		return ``, false
+	}
+	if d.ExpectedSHA256 == `` && m.conf.WriteChecksumManifest == `` && !m.conf.ComputeChecksum {
+		return ``, true
+	}
+	rfs, ok := fs.(ResumableFileSystem)
+	if !ok {
+		return ``, false
+	}
+	f, err := rfs.Open(d.LocalFilePath)
+	if err != nil {
+		return ``, false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ``, false
+	}
+	sum := hexSum(h)
+	if d.ExpectedSHA256 != `` && !strings.EqualFold(sum, d.ExpectedSHA256) {
+		return ``, false
+	}
+	return sum, true
+}
+
+// Skipped returns files not downloaded because they were saved completely by the previous run, by Config.SkipCompleted,
+// or because Config.ShouldDownload returned false.
+func (m *FileDownloader) Skipped() []*Download {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Download(nil), m.skipped...)
+}
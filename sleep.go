@@ -0,0 +1,57 @@
+package filedownloader
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// sleep for d, returns false if ctx is done while sleeping.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// wait random duration up to Config.StartJitter before starting download.
+func (m *FileDownloader) waitStartJitter(ctx context.Context) {
+	if m.conf.StartJitter <= 0 {
+		return
+	}
+	sleepContext(ctx, time.Duration(rand.Int63n(int64(m.conf.StartJitter))))
+}
+
+// launchPacer spaces starts of downloads by Config.MaxFilesPerSecond.
+type launchPacer struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// nil pacer does not wait, when there is no limit.
+func newLaunchPacer(filesPerSecond float64) *launchPacer {
+	if filesPerSecond <= 0 {
+		return nil
+	}
+	return &launchPacer{interval: time.Duration(float64(time.Second) / filesPerSecond)}
+}
+
+// wait until next download can start, returns false if ctx is done while waiting.
+func (p *launchPacer) wait(ctx context.Context) bool {
+	if p == nil {
+		return true
+	}
+	now := time.Now()
+	if p.next.After(now) {
+		if !sleepContext(ctx, p.next.Sub(now)) {
+			return false
+		}
+		now = p.next
+	}
+	p.next = now.Add(p.interval)
+	return true
+}
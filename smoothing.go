@@ -0,0 +1,81 @@
+package filedownloader
+
+// smoothing of bytes per second values delivered on DownloadBytesPerSecond.
+
+// SpeedSmoothing algorithm of Config.SpeedSmoothing
+type SpeedSmoothing string
+
+// SmoothingRaw delivers bytes downloaded in last second as it is
+const SmoothingRaw SpeedSmoothing = `raw`
+
+// SmoothingMovingAverage delivers the average of last SpeedSmoothingWindow seconds
+const SmoothingMovingAverage SpeedSmoothing = `sma`
+
+// SmoothingExponential delivers exponential moving average weighted by SpeedSmoothingAlpha
+const SmoothingExponential SpeedSmoothing = `ema`
+
+const defaultSmoothingWindow = 5
+
+const defaultSmoothingAlpha = 0.3
+
+func isKnownSmoothing(smoothing SpeedSmoothing) bool {
+	switch smoothing {
+	case ``, SmoothingRaw, SmoothingMovingAverage, SmoothingExponential:
+		return true
+	}
+	return false
+}
+
+type speedSmoother struct {
+	smoothing SpeedSmoothing
+	alpha     float64
+	window    []int64 // last values of moving average, used as ring buffer
+	next      int     // index of window to put next value
+	count     int     // values in window
+	sum       int64   // sum of values in window
+	average   float64 // exponential moving average
+}
+
+// unknown smoothing is checked by New
+func newSpeedSmoother(conf *Config) *speedSmoother {
+	s := &speedSmoother{smoothing: conf.SpeedSmoothing}
+	switch conf.SpeedSmoothing {
+	case ``, SmoothingRaw:
+	case SmoothingMovingAverage:
+		size := conf.SpeedSmoothingWindow
+		if size <= 0 {
+			size = defaultSmoothingWindow
+		}
+		s.window = make([]int64, size)
+	case SmoothingExponential:
+		s.alpha = conf.SpeedSmoothingAlpha
+		if s.alpha <= 0 || s.alpha > 1 {
+			s.alpha = defaultSmoothingAlpha
+		}
+	}
+	return s
+}
+
+// smoothed value after bytesPerSecond of last second is added
+func (s *speedSmoother) add(bytesPerSecond int64) int64 {
+	switch s.smoothing {
+	case SmoothingMovingAverage:
+		s.sum += bytesPerSecond - s.window[s.next]
+		s.window[s.next] = bytesPerSecond
+		s.next = (s.next + 1) % len(s.window)
+		if s.count < len(s.window) {
+			s.count++
+		}
+		return s.sum / int64(s.count)
+	case SmoothingExponential:
+		// first value starts the average
+		if s.count == 0 {
+			s.count = 1
+			s.average = float64(bytesPerSecond)
+		} else {
+			s.average = s.alpha*float64(bytesPerSecond) + (1-s.alpha)*s.average
+		}
+		return int64(s.average + 0.5)
+	}
+	return bytesPerSecond
+}
@@ -0,0 +1,118 @@
+package filedownloader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// detect content type from the first bytes of the body, to find error pages sent with 200 status.
+
+// ErrContentTypeMismatch detected content type of the body is not the expected one
+var ErrContentTypeMismatch = errors.New(`Content type mismatch`)
+
+// ErrHTMLResponse server sent an HTML page instead of the file, by Config.RejectHTMLResponses
+var ErrHTMLResponse = errors.New(`HTML response`)
+
+// http.DetectContentType reads at most 512 bytes
+const sniffLen = 512
+
+// different names of the same type
+var contentTypeAliases = map[string]string{
+	`application/x-gzip`:           `application/gzip`,
+	`application/x-zip-compressed`: `application/zip`,
+}
+
+// expected type of the body, empty if it is not validated.
+func (m *FileDownloader) expectedContentType(d *Download, resp *http.Response) string {
+	if d.ExpectedContentType != `` {
+		return d.ExpectedContentType
+	}
+	if m.conf.ValidateContentType {
+		return resp.Header.Get(`Content-Type`)
+	}
+	return ``
+}
+
+// HTML page is rejected by Content-Type header without reading the body, ex. a captive portal.
+func (m *FileDownloader) rejectHTML(d *Download, resp *http.Response) error {
+	if !m.conf.RejectHTMLResponses || d.AllowHTML || mediaType(d.ExpectedContentType) == `text/html` {
+		return nil
+	}
+	if contentType := resp.Header.Get(`Content-Type`); mediaType(contentType) == `text/html` {
+		return fmt.Errorf(`%w: Content-Type is %s`, ErrHTMLResponse, contentType)
+	}
+	return nil
+}
+
+// returns reader of the same bytes as r after verifying its content type.
+func sniffContentType(r io.Reader, expected string) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	detected := http.DetectContentType(head)
+	if !contentTypeMatches(detected, expected) {
+		return nil, fmt.Errorf(`%w: expected %s but %s`, ErrContentTypeMismatch, expected, detected)
+	}
+	return br, nil
+}
+
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	if alias, ok := contentTypeAliases[t]; ok {
+		return alias
+	}
+	return t
+}
+
+// expected can have wildcard subtype like image/*.
+// bodies detected as application/octet-stream or text/plain are not distinguishable, so they match to binary or text types.
+// application/octet-stream is declared by servers for any binary file, so it matches to any type but text.
+// XML documents like image/svg+xml are detected as text/xml, and containers like docx, jar, apk and epub are detected as application/zip.
+func contentTypeMatches(detected, expected string) bool {
+	d, e := mediaType(detected), mediaType(expected)
+	switch {
+	case d == e:
+		return true
+	case strings.HasSuffix(e, `/*`) && strings.HasPrefix(d, strings.TrimSuffix(e, `*`)):
+		return true
+	case e == `application/octet-stream`:
+		return !isTextType(d)
+	case d == `application/octet-stream`:
+		return !strings.HasPrefix(e, `text/`)
+	case d == `text/plain`:
+		return isTextType(e)
+	case d == `text/xml` || d == `application/xml`:
+		return isXMLType(e)
+	case d == `application/zip`:
+		return !isTextType(e)
+	}
+	return false
+}
+
+func isXMLType(t string) bool {
+	return strings.HasSuffix(t, `/xml`) || strings.HasSuffix(t, `+xml`)
+}
+
+func isTextType(t string) bool {
+	switch {
+	case strings.HasPrefix(t, `text/`):
+		return true
+	case strings.HasSuffix(t, `+json`) || strings.HasSuffix(t, `+xml`):
+		return true
+	}
+	switch t {
+	case `application/json`, `application/xml`, `application/javascript`, `application/x-ndjson`:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package filedownloader
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// download to stdout for piping to other commands.
+
+// StdoutPath is the LocalFilePath to write the file to stdout. The file is not written to temp file, not resumed and not retried,
+// and files to stdout are written one by one. Default log function writes to stderr, so it does not mix with the file.
+const StdoutPath = `-`
+
+// replaced in tests
+var stdout io.Writer = os.Stdout
+
+// stdout is never closed by downloads
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func isStdout(localPath string) bool {
+	return localPath == StdoutPath
+}
+
+// DownloadToWriter downloads url and writes the file to w as a batch of the file, so that progress, speed, OnFileProgress
+// and timeouts of the Config are applied. Bytes are counted as they are written to w, so a slow writer lowers the reported
+// speed. As StdoutPath, the file is not written to temp file, not resumed and not retried, and its path in results is StdoutPath.
+func (m *FileDownloader) DownloadToWriter(ctx context.Context, url string, w io.Writer) error {
+	if m.State != StateReady {
+		panic(`filedownloader has already started or done`)
+	}
+	m.State = StateDownloading
+	m.downloadFiles(ctx, []*Download{{URL: url, LocalFilePath: StdoutPath, writer: w}})
+	return m.err
+}
+
+// writer of the download to StdoutPath
+func (d *Download) stdoutWriter() io.Writer {
+	if d.writer != nil {
+		return d.writer
+	}
+	return stdout
+}
@@ -0,0 +1,48 @@
+package filedownloader
+
+import (
+	"sync/atomic"
+)
+
+// stop downloading before exit and resume it next launch by Suspend.
+
+// Suspend cancels downloading as Cancel, and keeps the temp files of the files not downloaded completely with their
+// resume metadata, so that the next run with ResumeFromPartial resumes them even if ResumeFromPartial is not set
+// in this run. It returns after the download goroutines ended and bytes received are written to the temp files.
+// Temp files of servers not accepting range requests or not telling the size are kept without metadata, and they are
+// downloaded from start next time. It returns the error of writing the metadata.
+// If the download has not started yet, it is cancelled as soon as it starts.
+func (m *FileDownloader) Suspend() error {
+	atomic.StoreInt32(&m.suspended, 1)
+	atomic.StoreInt32(&m.cancelled, 1)
+	m.mu.Lock()
+	cancel := m.cancelBatch
+	m.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	<-m.finished
+	return m.suspendErr
+}
+
+// write resume metadata of the temp files not renamed to the local file path.
+// metadata is already written by ResumeFromPartial, and compressed or transformed files are not resumed.
+func (m *FileDownloader) writeSuspendedMeta(files []*fileProgress, resumableUrls map[string]*resumeInfo) error {
+	if m.conf.ResumeFromPartial || m.conf.CASRoot != `` || m.conf.CompressOutput || m.conf.DecompressGzip || m.conf.StreamTransform != nil {
+		return nil
+	}
+	var errs []error
+	fs := m.fileSystem()
+	for _, f := range files {
+		resume := resumableUrls[f.download.URL]
+		if f.partPath == `` || f.savedPath != `` || !resume.isResumable {
+			continue
+		}
+		if err := writeResumeMeta(fs, f.partPath, resume); err != nil {
+			m.logfunc(`Could not write resume metadata of `+f.partPath, err)
+			errs = append(errs, &FileSystemError{Err: err})
+		}
+	}
+	return joinErrors(errs...)
+}
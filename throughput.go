@@ -0,0 +1,71 @@
+package filedownloader
+
+import (
+	"math"
+	"sort"
+)
+
+// percentiles of bytes per second in recent seconds, by ThroughputPercentile.
+
+// seconds kept by default, 5 minutes
+const defaultThroughputSampleWindow = 300
+
+// bytes per second of last seconds, oldest values are overwritten so that memory is bounded in long downloads.
+type throughputSamples struct {
+	values []int64 // used as ring buffer
+	next   int     // index of values to put next value
+	count  int     // values in the buffer
+}
+
+func newThroughputSamples(size int) *throughputSamples {
+	if size <= 0 {
+		size = defaultThroughputSampleWindow
+	}
+	return &throughputSamples{values: make([]int64, size)}
+}
+
+func (s *throughputSamples) add(bytesPerSecond int64) {
+	s.values[s.next] = bytesPerSecond
+	s.next = (s.next + 1) % len(s.values)
+	if s.count < len(s.values) {
+		s.count++
+	}
+}
+
+// nearest-rank percentile, 0 if no value.
+func (s *throughputSamples) percentile(p float64) int64 {
+	if s.count == 0 {
+		return 0
+	}
+	sorted := append([]int64(nil), s.values[:s.count]...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p/100*float64(s.count))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= s.count {
+		rank = s.count - 1
+	}
+	return sorted[rank]
+}
+
+func (m *FileDownloader) addThroughputSample(bytesPerSecond int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.throughput == nil {
+		m.throughput = newThroughputSamples(m.conf.ThroughputSampleWindow)
+	}
+	m.throughput.add(bytesPerSecond)
+}
+
+// ThroughputPercentile returns the p-th percentile (0 to 100) of bytes downloaded in each second of the last
+// Config.ThroughputSampleWindow seconds, ex. 50 for the median. Paused seconds are not counted. 0 if no second is measured yet.
+// It can be called while downloading.
+func (m *FileDownloader) ThroughputPercentile(p float64) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.throughput == nil {
+		return 0
+	}
+	return m.throughput.percentile(p)
+}
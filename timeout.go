@@ -0,0 +1,39 @@
+package filedownloader
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrFileTimeout a file download did not finish in Config.PerFileTimeout
+var ErrFileTimeout = errors.New(`File download timed out`)
+
+const defaultTimeoutMinutes = 60
+
+// BatchTimeout is used if set, then DownloadTimeoutMinutes, otherwise 60 minutes.
+func (m *FileDownloader) batchTimeout() time.Duration {
+	if m.conf.BatchTimeout > 0 {
+		return m.conf.BatchTimeout
+	}
+	if m.conf.DownloadTimeoutMinutes > 0 {
+		return time.Minute * time.Duration(m.conf.DownloadTimeoutMinutes)
+	}
+	return time.Minute * defaultTimeoutMinutes
+}
+
+// context of a file download including its retries, not bounded if PerFileTimeout is 0.
+func (m *FileDownloader) fileContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.conf.PerFileTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, m.conf.PerFileTimeout)
+}
+
+// replace the cancel error by ErrFileTimeout when only the file context has timed out.
+func fileTimeoutError(batchCtx, fileCtx context.Context, d *Download, err error) error {
+	if err != nil && batchCtx.Err() == nil && fileCtx.Err() == context.DeadlineExceeded {
+		return &DownloadError{URL: d.URL, Err: ErrFileTimeout}
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package filedownloader
+
+import (
+	"context"
+	"time"
+)
+
+// trace each file download by Config.Tracer, ex. with OpenTelemetry, without depending on a tracing library.
+
+// Tracer starts spans of file downloads. Adapter of OpenTelemetry calls trace.Tracer.Start and wraps the span,
+// then spans of the downloads are children of the span in the context given to MultipleFileDownloadContext.
+type Tracer interface {
+	// Start starts a span named name as a child of the span in ctx, and returns the context with the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span of a file download. Attributes are url, size, bytes, retries and outcome. Events are retry and completed.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	AddEvent(name string, attributes map[string]interface{})
+	RecordError(err error)
+	End()
+}
+
+// name of the span of each file download
+const downloadSpanName = `filedownloader.download`
+
+type spanKey struct{}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{})              {}
+func (noopSpan) AddEvent(name string, attributes map[string]interface{}) {}
+func (noopSpan) RecordError(err error)                                   {}
+func (noopSpan) End()                                                    {}
+
+// start the span of the file, no-op span if Config.Tracer is not set.
+func (m *FileDownloader) startSpan(ctx context.Context, f *fileProgress) (context.Context, Span) {
+	if m.conf.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, span := m.conf.Tracer.Start(ctx, downloadSpanName)
+	span.SetAttribute(`url`, f.download.URL)
+	span.SetAttribute(`size`, f.total)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// span of the file download in ctx, no-op span if it is not traced.
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+func traceRetry(ctx context.Context, attempt int, err error, delay time.Duration) {
+	spanFromContext(ctx).AddEvent(`retry`, map[string]interface{}{`attempt`: attempt, `error`: err.Error(), `delay`: delay.String()})
+}
+
+// end the span with the result of the file, errors of cancelled downloads are not recorded.
+func endSpan(span Span, f *fileProgress, err error, cancelled bool) {
+	span.SetAttribute(`bytes`, f.received)
+	span.SetAttribute(`retries`, f.retries)
+	switch {
+	case err == nil:
+		span.SetAttribute(`outcome`, `succeeded`)
+		span.AddEvent(`completed`, map[string]interface{}{`path`: f.savedPath})
+	case cancelled:
+		span.SetAttribute(`outcome`, `cancelled`)
+	default:
+		span.SetAttribute(`outcome`, `failed`)
+		span.RecordError(err)
+	}
+	span.End()
+}
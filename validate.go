@@ -0,0 +1,82 @@
+package filedownloader
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	neturl "net/url"
+	"path/filepath"
+	"strings"
+)
+
+// check URLs and destinations of the downloads before a long batch by Validate.
+
+// ErrInvalidDownload URL or local file path of the download can not be used
+var ErrInvalidDownload = errors.New(`Invalid download`)
+
+// Validate checks the downloads without downloading them, and returns all problems found at once.
+// URL must be http or https with a host, or of a scheme registered by RegisterScheme.
+// LocalFilePath must not be a directory, and a file must be creatable in the directory of its temp file,
+// which is checked by creating and removing an empty file there on Config.FileSystem.
+// Errors are DownloadError of ErrInvalidDownload, ordered as the downloads.
+func (m *FileDownloader) Validate(downloads []*Download) error {
+	var errs []error
+	for _, d := range downloads {
+		if err := m.validateURL(d.URL); err != nil {
+			errs = append(errs, &DownloadError{URL: d.URL, Err: fmt.Errorf(`%w: %v`, ErrInvalidDownload, err)})
+		}
+		if err := m.validateLocalPath(d); err != nil {
+			errs = append(errs, &DownloadError{URL: d.URL, Err: fmt.Errorf(`%w: %v`, ErrInvalidDownload, err)})
+		}
+	}
+	return joinErrors(errs...)
+}
+
+func (m *FileDownloader) validateURL(url string) error {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == `http` || scheme == `https` {
+		if u.Host == `` {
+			return errors.New(`no host in ` + url)
+		}
+		return nil
+	}
+	m.mu.Lock()
+	_, ok := m.schemes[scheme]
+	m.mu.Unlock()
+	if !ok {
+		return errors.New(`unsupported scheme of ` + url)
+	}
+	return nil
+}
+
+func (m *FileDownloader) validateLocalPath(d *Download) error {
+	if isStdout(d.LocalFilePath) {
+		return nil
+	}
+	fs := m.fileSystem()
+	if d.LocalFilePath != `` {
+		localPath := m.outputFilePath(d.LocalFilePath)
+		if info, err := fs.Stat(localPath); err == nil && info.IsDir() {
+			return errors.New(localPath + ` is a directory`)
+		}
+	}
+	dir := m.downloadDir(d)
+	if dir == `` {
+		return nil
+	}
+	// CASRoot is created when the download starts
+	if _, err := fs.Stat(dir); err != nil && dir == m.conf.CASRoot {
+		return nil
+	}
+	probe := filepath.Join(dir, fmt.Sprintf(`.validate.%08x%s`, rand.Uint32(), m.partSuffix()))
+	w, err := fs.Create(probe)
+	if err != nil {
+		return fmt.Errorf(`could not create a file in %s: %v`, dir, err)
+	}
+	w.Close()
+	return fs.Remove(probe)
+}
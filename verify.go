@@ -0,0 +1,80 @@
+package filedownloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// verify files saved by previous downloads without downloading them again.
+
+// ErrSizeMismatch local file does not have the size of the remote file
+var ErrSizeMismatch = errors.New(`Size mismatch`)
+
+// VerifyOnly checks files saved by previous downloads without downloading them.
+// Each LocalFilePath must exist and have the size told by HEAD request, and the checksum of ExpectedSHA256 if it is set.
+// Size is not checked if the server does not tell it. Files saved with CompressOutput, DecompressGzip or
+// StreamTransform are changed from the remote files, so only their existence is checked.
+// Result of each download is nil if the file is verified, or DownloadError of the reason.
+func (m *FileDownloader) VerifyOnly(downloads []*Download) map[*Download]error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.batchTimeout())
+	defer cancel()
+	results := make(map[*Download]error, len(downloads))
+	for _, d := range downloads {
+		if err := m.verifyFile(ctx, d); err != nil {
+			m.logfunc(`Verification failed[`+d.URL+`]`, err)
+			// error status of HEAD request is already DownloadError
+			if _, ok := err.(*DownloadError); !ok {
+				err = &DownloadError{URL: d.URL, Err: err}
+			}
+			results[d] = err
+		} else {
+			results[d] = nil
+		}
+	}
+	return results
+}
+
+func (m *FileDownloader) verifyFile(ctx context.Context, d *Download) error {
+	if d.LocalFilePath == `` || isStdout(d.LocalFilePath) {
+		return errors.New(`no local file to verify`)
+	}
+	fs := m.fileSystem()
+	localPath := m.outputFilePath(d.LocalFilePath)
+	if m.conf.DecompressGzip {
+		localPath = decompressedFilePath(localPath)
+	}
+	size, err := fileSize(fs, localPath)
+	if err != nil {
+		return err
+	}
+	if m.conf.CompressOutput || m.conf.DecompressGzip || m.conf.StreamTransform != nil {
+		return nil
+	}
+	info, err := m.getResumeInfo(ctx, d.URL, m.requestHeader(d))
+	if err != nil {
+		return err
+	}
+	if info.contentLength >= 0 && size != info.contentLength {
+		return fmt.Errorf(`%w: expected %d bytes but %d`, ErrSizeMismatch, info.contentLength, size)
+	}
+	if d.ExpectedSHA256 == `` {
+		return nil
+	}
+	rfs, ok := fs.(ResumableFileSystem)
+	if !ok {
+		return errors.New(`can not read saved file ` + localPath)
+	}
+	f, err := rfs.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	return verifySHA256(h, d.ExpectedSHA256)
+}
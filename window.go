@@ -0,0 +1,83 @@
+package filedownloader
+
+import (
+	"context"
+	"time"
+)
+
+// run downloads only in Config.AllowedWindows of each day.
+
+// TimeWindow is a daily time range in local time, as durations since midnight.
+// ex. 1am to 5am is TimeWindow{Start: time.Hour, End: 5 * time.Hour}. End before Start crosses midnight.
+type TimeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+const day = 24 * time.Hour
+
+// replaced in tests
+var timeNow = time.Now
+
+// window is checked again in this interval while waiting, so that clock changes are followed.
+var windowCheckInterval = time.Minute
+
+// contains t
+func (w TimeWindow) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	since := t.Sub(midnight)
+	start, end := w.Start%day, w.End%day
+	if start <= end {
+		return start <= since && since < end
+	}
+	return since >= start || since < end
+}
+
+// duration from t until the window starts, 0 if t is in the window.
+func (w TimeWindow) until(t time.Time) time.Duration {
+	if w.contains(t) {
+		return 0
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	wait := midnight.Add(w.Start % day).Sub(t)
+	if wait < 0 {
+		wait += day
+	}
+	return wait
+}
+
+// duration until one of the windows starts, 0 if downloads are allowed now.
+func (m *FileDownloader) untilWindow() time.Duration {
+	if len(m.conf.AllowedWindows) == 0 {
+		return 0
+	}
+	now := timeNow()
+	wait := day
+	for _, w := range m.conf.AllowedWindows {
+		if d := w.until(now); d < wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// wait until downloads are allowed by AllowedWindows, returns false if ctx is done while waiting.
+func (m *FileDownloader) waitWindow(ctx context.Context) bool {
+	logged := false
+	for {
+		wait := m.untilWindow()
+		if wait <= 0 {
+			return true
+		}
+		if !logged {
+			m.logfunc(`Out of allowed windows, wait ` + wait.String())
+			logged = true
+		}
+		if wait > windowCheckInterval {
+			wait = windowCheckInterval
+		}
+		if !sleepContext(ctx, wait) {
+			return false
+		}
+	}
+}